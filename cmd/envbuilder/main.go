@@ -36,8 +36,26 @@ func envbuilderCmd() serpent.Command {
 		Use:     "envbuilder",
 		Options: o.CLI(),
 		Handler: func(inv *serpent.Invocation) error {
+			if o.GitExpandEnv {
+				if err := o.ExpandGitURLs(os.LookupEnv); err != nil {
+					return err
+				}
+			}
 			o.SetDefaults()
-			o.Logger = log.New(os.Stderr, o.Verbose)
+			o.Logger = log.Correlated(log.New(os.Stderr, o.Verbose), o.LogCorrelationID)
+			if o.LogSyslog != "" {
+				network, addr, err := log.ParseSyslogAddress(o.LogSyslog)
+				if err != nil {
+					return err
+				}
+				syslogLog, closeSyslog, err := log.Syslog(network, addr, o.LogSyslogTag)
+				if err == nil {
+					o.Logger = log.Wrap(o.Logger, log.Correlated(syslogLog, o.LogCorrelationID))
+					defer closeSyslog()
+				} else {
+					o.Logger(log.LevelError, "unable to send logs to syslog: %s", err.Error())
+				}
+			}
 			if o.CoderAgentURL != "" {
 				if o.CoderAgentToken == "" {
 					return errors.New("CODER_AGENT_URL must be set if CODER_AGENT_TOKEN is set")
@@ -46,10 +64,24 @@ func envbuilderCmd() serpent.Command {
 				if err != nil {
 					return fmt.Errorf("unable to parse CODER_AGENT_URL as URL: %w", err)
 				}
-				coderLog, closeLogs, err := log.Coder(inv.Context(), u, o.CoderAgentToken)
+				coderLog, closeLogs, coderStats, err := log.CoderWithStats(inv.Context(), u, o.CoderAgentToken, log.CoderMetadata{
+					Owner:       o.LogWorkspaceOwner,
+					Template:    o.LogTemplate,
+					BuildNumber: o.LogBuildNumber,
+				})
 				if err == nil {
-					o.Logger = log.Wrap(o.Logger, coderLog)
-					defer closeLogs()
+					stderrLog := o.Logger
+					o.Logger = log.Wrap(o.Logger, log.Correlated(log.Capped(coderLog, int(o.LogMaxMessageSize), o.LogOversizeMode), o.LogCorrelationID))
+					defer func() {
+						closeLogs()
+						stats := coderStats()
+						level := log.LevelDebug
+						if stats.Dropped > 0 {
+							level = log.LevelWarn
+						}
+						stderrLog(level, "Coder log sender: %d sent, %d retried, %d dropped, last send took %s",
+							stats.Sent, stats.Retried, stats.Dropped, stats.LastSendLatency)
+					}()
 					// This adds the envbuilder subsystem.
 					// If telemetry is enabled in a Coder deployment,
 					// this will be reported and help us understand
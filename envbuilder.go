@@ -61,6 +61,7 @@ type DockerConfig configfile.ConfigFile
 // Defaults to the host filesystem.
 func Run(ctx context.Context, opts options.Options) error {
 	defer options.UnsetEnv()
+	ctx, opts.Logger = correlate(ctx, opts)
 	if opts.GetCachedImage {
 		return fmt.Errorf("developer error: use RunCacheProbe instead")
 	}
@@ -105,12 +106,15 @@ func Run(ctx context.Context, opts options.Options) error {
 	buildTimeWorkspaceFolder := opts.WorkspaceFolder
 	var fallbackErr error
 	var cloned bool
+	var cloneOpts git.CloneRepoOptions
 	if opts.GitURL != "" {
-		cloneOpts, err := git.CloneOptionsFromOptions(opts)
+		// Built once, since it may fetch credentials with GitSecretFetcher.
+		cloneOpts, err = git.CloneOptionsFromOptions(opts)
 		if err != nil {
 			return fmt.Errorf("git clone options: %w", err)
 		}
-
+	}
+	if opts.GitURL != "" && !skipCloneAfterPrecheck(ctx, opts, cloneOpts) {
 		endStage := startStage("📦 Cloning %s to %s...",
 			newColor(color.FgCyan).Sprintf(opts.GitURL),
 			newColor(color.FgCyan).Sprintf(cloneOpts.Path),
@@ -128,6 +132,12 @@ func Run(ctx context.Context, opts options.Options) error {
 			} else {
 				endStage("📦 The repository already exists!")
 			}
+			if opts.GitWriteProvenance != "" {
+				if err := git.WriteProvenance(cloneOpts, opts.GitWriteProvenance); err != nil {
+					return fmt.Errorf("write clone provenance: %w", err)
+				}
+				opts.Logger(log.LevelInfo, "📜 Wrote clone provenance to %s", opts.GitWriteProvenance)
+			}
 		} else {
 			opts.Logger(log.LevelError, "Failed to clone repository: %s", fallbackErr.Error())
 			opts.Logger(log.LevelError, "Falling back to the default image...")
@@ -138,10 +148,7 @@ func Run(ctx context.Context, opts options.Options) error {
 		// Always clone the repo in remote repo build mode into a location that
 		// we control that isn't affected by the users changes.
 		if opts.RemoteRepoBuildMode {
-			cloneOpts, err := git.CloneOptionsFromOptions(opts)
-			if err != nil {
-				return fmt.Errorf("git clone options: %w", err)
-			}
+			cloneOpts := cloneOpts
 			cloneOpts.Path = opts.RemoteRepoDir
 
 			endStage := startStage("📦 Remote repo build mode enabled, cloning %s to %s for build context...",
@@ -855,6 +862,7 @@ func Run(ctx context.Context, opts options.Options) error {
 // all of the resulting layers are present in options.CacheRepo.
 func RunCacheProbe(ctx context.Context, opts options.Options) (v1.Image, error) {
 	defer options.UnsetEnv()
+	ctx, opts.Logger = correlate(ctx, opts)
 	if !opts.GetCachedImage {
 		return nil, fmt.Errorf("developer error: RunCacheProbe must be run with --get-cached-image")
 	}
@@ -889,15 +897,18 @@ func RunCacheProbe(ctx context.Context, opts options.Options) (v1.Image, error)
 	buildTimeWorkspaceFolder := opts.WorkspaceFolder
 	var fallbackErr error
 	var cloned bool
+	var cloneOpts git.CloneRepoOptions
 	if opts.GitURL != "" {
+		// Built once, since it may fetch credentials with GitSecretFetcher.
+		cloneOpts, err = git.CloneOptionsFromOptions(opts)
+		if err != nil {
+			return nil, fmt.Errorf("git clone options: %w", err)
+		}
+	}
+	if opts.GitURL != "" && !skipCloneAfterPrecheck(ctx, opts, cloneOpts) {
 		// In cache probe mode we should only attempt to clone the full
 		// repository if remote repo build mode isn't enabled.
 		if !opts.RemoteRepoBuildMode {
-			cloneOpts, err := git.CloneOptionsFromOptions(opts)
-			if err != nil {
-				return nil, fmt.Errorf("git clone options: %w", err)
-			}
-
 			endStage := startStage("📦 Cloning %s to %s...",
 				newColor(color.FgCyan).Sprintf(opts.GitURL),
 				newColor(color.FgCyan).Sprintf(cloneOpts.Path),
@@ -922,10 +933,7 @@ func RunCacheProbe(ctx context.Context, opts options.Options) (v1.Image, error)
 
 			_ = w.Close()
 		} else {
-			cloneOpts, err := git.CloneOptionsFromOptions(opts)
-			if err != nil {
-				return nil, fmt.Errorf("git clone options: %w", err)
-			}
+			cloneOpts := cloneOpts
 			cloneOpts.Path = opts.RemoteRepoDir
 
 			endStage := startStage("📦 Remote repo build mode enabled, cloning %s to %s for build context...",
@@ -1215,6 +1223,16 @@ func RunCacheProbe(ctx context.Context, opts options.Options) (v1.Image, error)
 	return image, nil
 }
 
+// correlate returns ctx carrying the correlation ID of opts, or of ctx
+// if opts has none, and the logger of opts tagged with it. The
+// LogTransform of opts sees messages before they are tagged.
+func correlate(ctx context.Context, opts options.Options) (context.Context, log.Func) {
+	if opts.LogCorrelationID != "" {
+		ctx = log.WithCorrelationID(ctx, opts.LogCorrelationID)
+	}
+	return ctx, log.Transformed(log.Correlated(opts.Logger, log.CorrelationID(ctx)), opts.LogTransform)
+}
+
 type userInfo struct {
 	uid  int
 	gid  int
@@ -1414,6 +1432,67 @@ func findDevcontainerJSON(workspaceFolder string, options options.Options) (stri
 	return "", "", errors.New("can't find devcontainer.json, is it a correct spec?")
 }
 
+// skipCloneAfterPrecheck reports whether the clone can be skipped because
+// opts.GitClonePrecheck found that the repository lacks the paths needed
+// to build it, so that the fallback image would be used anyway. Checking
+// costs a fetch of the tree of the ref, so it is only done if a fallback
+// image is set and the repository has not been cloned yet. Any failure
+// to check is logged and the clone goes ahead. cloneOpts are those the
+// clone would use, so that both see the same credentials.
+func skipCloneAfterPrecheck(ctx context.Context, opts options.Options, cloneOpts git.CloneRepoOptions) bool {
+	if !opts.GitClonePrecheck || opts.FallbackImage == "" {
+		return false
+	}
+	if _, err := opts.Filesystem.Stat(filepath.Join(cloneOpts.Path, ".git")); err == nil {
+		return false
+	}
+	// At least one devcontainer.json location must exist, but all of the
+	// required paths.
+	paths, requireAll := opts.RequiredPaths, true
+	if len(paths) == 0 {
+		paths, requireAll = devcontainerPrecheckPaths(opts), false
+	}
+	if len(paths) == 0 {
+		return false
+	}
+	opts.Logger(log.LevelInfo, "🔎 Checking %s for %s before cloning...", opts.GitURL, strings.Join(paths, ", "))
+	missing, err := git.MissingPathsAtRef(ctx, cloneOpts, paths)
+	if err != nil {
+		opts.Logger(log.LevelWarn, "Failed to check the repository before cloning, cloning anyway: %s", err.Error())
+		return false
+	}
+	if len(missing) == 0 || !requireAll && len(missing) < len(paths) {
+		return false
+	}
+	opts.Logger(log.LevelInfo, "🔎 The repository is missing %s, skipping the clone and falling back to the default image...", strings.Join(missing, ", "))
+	return true
+}
+
+// devcontainerPrecheckPaths returns the paths, relative to the repository
+// root, that findDevcontainerJSON looks for a devcontainer.json at, or nil
+// if it looks outside of the repository.
+func devcontainerPrecheckPaths(opts options.Options) []string {
+	if opts.DevcontainerDir == "" && opts.DevcontainerJSONPath == "" {
+		return []string{
+			".devcontainer/devcontainer.json",
+			"devcontainer.json",
+			".devcontainer/*/devcontainer.json",
+		}
+	}
+	dir := opts.DevcontainerDir
+	if dir == "" {
+		dir = ".devcontainer"
+	}
+	file := opts.DevcontainerJSONPath
+	if file == "" {
+		file = "devcontainer.json"
+	}
+	if filepath.IsAbs(dir) || filepath.IsAbs(file) {
+		return nil
+	}
+	return []string{filepath.ToSlash(filepath.Join(dir, file))}
+}
+
 // maybeDeleteFilesystem wraps util.DeleteFilesystem with a guard to hopefully stop
 // folks from unwittingly deleting their entire root directory.
 func maybeDeleteFilesystem(logger log.Func, force bool) error {
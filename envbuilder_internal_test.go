@@ -1,11 +1,16 @@
 package envbuilder
 
 import (
+	"context"
 	"testing"
 
+	"github.com/coder/envbuilder/git"
+	"github.com/coder/envbuilder/log"
 	"github.com/coder/envbuilder/options"
+	"github.com/coder/envbuilder/testutil/gittest"
 
 	"github.com/go-git/go-billy/v5/memfs"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -179,3 +184,72 @@ func TestFindDevcontainerJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestDevcontainerPrecheckPaths(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name string
+		opts options.Options
+		want []string
+	}{
+		{
+			name: "Default",
+			want: []string{".devcontainer/devcontainer.json", "devcontainer.json", ".devcontainer/*/devcontainer.json"},
+		},
+		{
+			name: "Dir",
+			opts: options.Options{DevcontainerDir: "config"},
+			want: []string{"config/devcontainer.json"},
+		},
+		{
+			name: "JSONPath",
+			opts: options.Options{DevcontainerJSONPath: "go.json"},
+			want: []string{".devcontainer/go.json"},
+		},
+		{
+			name: "AbsoluteDir",
+			opts: options.Options{DevcontainerDir: "/config"},
+		},
+		{
+			name: "AbsoluteJSONPath",
+			opts: options.Options{DevcontainerJSONPath: "/config/devcontainer.json"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.want, devcontainerPrecheckPaths(tt.opts))
+		})
+	}
+}
+
+func TestSkipCloneAfterPrecheck(t *testing.T) {
+	t.Parallel()
+
+	srv := gittest.CreateGitServer(t, gittest.Options{
+		Files:    map[string]string{"README.md": "Hello, world!"},
+		Username: "user",
+		Password: "pass",
+	})
+	defer srv.Close()
+	opts := options.Options{
+		GitURL:           srv.URL,
+		GitClonePrecheck: true,
+		FallbackImage:    "alpine",
+		WorkspaceFolder:  "/workspace",
+		Filesystem:       memfs.New(),
+		Logger:           func(log.Level, string, ...any) {},
+	}
+	cloneOpts := git.CloneRepoOptions{
+		Path:    "/workspace",
+		RepoURL: srv.URL,
+		Storage: opts.Filesystem,
+		Logger:  opts.Logger,
+	}
+
+	// Without credentials the check fails, and the clone goes ahead.
+	require.False(t, skipCloneAfterPrecheck(context.Background(), opts, cloneOpts))
+	// The credentials of the clone options are used, not those in opts.
+	cloneOpts.RepoAuth = &githttp.BasicAuth{Username: "user", Password: "pass"}
+	require.True(t, skipCloneAfterPrecheck(context.Background(), opts, cloneOpts))
+}
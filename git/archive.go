@@ -0,0 +1,228 @@
+package git
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	giturls "github.com/chainguard-dev/git-urls"
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// ArchiveAuto can be set as CloneRepoOptions.ArchiveURL to derive the
+// archive URL from the repository URL with ArchiveURL.
+const ArchiveAuto = "auto"
+
+// ArchiveURL returns the URL of a tarball snapshot of the repository at
+// repoURL, for hosts that serve one. Currently github.com and gitlab.com
+// are supported. The ref in the URL fragment is used, or HEAD if there is
+// none.
+func ArchiveURL(repoURL string) (string, bool) {
+	normalized, err := NormalizeGitURL(repoURL)
+	if err != nil {
+		return "", false
+	}
+	parsed, err := giturls.Parse(normalized)
+	if err != nil {
+		return "", false
+	}
+	ref := parsed.Fragment
+	if pullRequestID(ref) != "" {
+		// Neither host serves archives of pull requests.
+		return "", false
+	}
+	ref = strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	if ref == "" {
+		ref = "HEAD"
+	}
+	repoPath := strings.TrimSuffix(strings.Trim(parsed.Path, "/"), ".git")
+	if repoPath == "" {
+		return "", false
+	}
+	switch strings.ToLower(parsed.Hostname()) {
+	case "github.com":
+		return fmt.Sprintf("https://codeload.github.com/%s/tar.gz/%s", repoPath, ref), true
+	case "gitlab.com":
+		name := path.Base(repoPath)
+		return fmt.Sprintf("https://gitlab.com/%s/-/archive/%s/%s-%s.tar.gz", repoPath, ref, name, strings.ReplaceAll(ref, "/", "-")), true
+	default:
+		return "", false
+	}
+}
+
+// cloneFromArchive downloads and extracts the tarball at opts.ArchiveURL
+// into opts.Path. It only runs when opts.Path is empty, so that a
+// workspace is never overwritten. The returned bool is false if the
+// archive could not be used, in which case opts.Path is left empty and
+// the caller should fall back to a normal clone.
+func cloneFromArchive(ctx context.Context, opts CloneRepoOptions) (bool, error) {
+	archiveURL := opts.ArchiveURL
+	if archiveURL == ArchiveAuto {
+		var ok bool
+		archiveURL, ok = ArchiveURL(RewriteGitURL(opts.RepoURL, opts.URLRewrites))
+		if !ok {
+			opts.logf(log.PhaseCloning, log.LevelInfo, "📦 No archive available for %s, cloning instead", redactURL(opts.RepoURL))
+			return false, nil
+		}
+	}
+	entries, err := opts.Storage.ReadDir(opts.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("read %q: %w", opts.Path, err)
+	}
+	if len(entries) > 0 {
+		// The archive is only a shortcut for first builds.
+		return false, nil
+	}
+	if err := opts.Storage.MkdirAll(opts.Path, 0o755); err != nil {
+		return false, fmt.Errorf("mkdir %q: %w", opts.Path, err)
+	}
+	fs, err := opts.Storage.Chroot(opts.Path)
+	if err != nil {
+		return false, fmt.Errorf("chroot %q: %w", opts.Path, err)
+	}
+	log.ReportPhase(opts.ProgressReporter, log.PhaseConnecting)
+	err = downloadArchive(ctx, limitFiles(fs, opts.MaxFiles), archiveURL, opts)
+	if errors.Is(err, ErrTooManyFiles) {
+		// A clone would not have fewer files.
+		if rmErr := emptyDir(fs); rmErr != nil {
+			return false, fmt.Errorf("%w (clean up failed archive download: %s)", err, rmErr)
+		}
+		return false, err
+	}
+	if err != nil {
+		opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Failed to download archive %s, cloning instead: %s", redactURL(archiveURL), err)
+		if err := emptyDir(fs); err != nil {
+			return false, fmt.Errorf("clean up failed archive download: %w", err)
+		}
+		return false, nil
+	}
+	opts.logf(log.PhaseCloning, log.LevelInfo, "📦 Extracted archive %s, no .git directory was created", redactURL(archiveURL))
+	if err := checkRequiredPaths(fs, opts.RequiredPaths); err != nil {
+		// A non-empty workspace would skip the archive on the next run.
+		if rmErr := emptyDir(fs); rmErr != nil {
+			return true, fmt.Errorf("%w (clean up failed archive download: %s)", err, rmErr)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// downloadArchive fetches the gzipped tarball at archiveURL, using the
+// clone's auth, TLS and proxy settings, and extracts it into fs.
+func downloadArchive(ctx context.Context, fs billy.Filesystem, archiveURL string, opts CloneRepoOptions) error {
+	tlsConfig, err := gitTLSConfig("", opts)
+	if err != nil {
+		return err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	if opts.ProxyOptions.URL != "" {
+		proxyURL, err := opts.ProxyOptions.FullURL()
+		if err != nil {
+			return fmt.Errorf("parse proxy url: %w", err)
+		}
+		tr.Proxy = http.ProxyURL(proxyURL)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, archiveURL, nil)
+	if err != nil {
+		return err
+	}
+	if auth, ok := opts.RepoAuth.(githttp.AuthMethod); ok {
+		auth.SetAuth(req)
+	}
+	res, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	log.ReportPhase(opts.ProgressReporter, log.PhaseCloning)
+	return extractTarball(fs, res.Body)
+}
+
+// extractTarball extracts the gzipped tarball r into fs. The top-level
+// directory that GitHub and GitLab wrap the tree in is stripped.
+func extractTarball(fs billy.Filesystem, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("read gzip: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read tar: %w", err)
+		}
+		_, name, ok := strings.Cut(hdr.Name, "/")
+		if !ok || name == "" {
+			continue
+		}
+		name = path.Clean(name)
+		if name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			return fmt.Errorf("archive entry %q is outside the workspace", hdr.Name)
+		}
+		name = filepath.FromSlash(name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := fs.MkdirAll(name, 0o755); err != nil {
+				return fmt.Errorf("mkdir %q: %w", name, err)
+			}
+		case tar.TypeReg:
+			if err := fs.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+				return fmt.Errorf("mkdir %q: %w", filepath.Dir(name), err)
+			}
+			f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return fmt.Errorf("create %q: %w", name, err)
+			}
+			_, err = io.Copy(f, tr)
+			closeErr := f.Close()
+			if err != nil {
+				return fmt.Errorf("write %q: %w", name, err)
+			}
+			if closeErr != nil {
+				return fmt.Errorf("close %q: %w", name, closeErr)
+			}
+		case tar.TypeSymlink:
+			if err := fs.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+				return fmt.Errorf("mkdir %q: %w", filepath.Dir(name), err)
+			}
+			if err := fs.Symlink(hdr.Linkname, name); err != nil {
+				return fmt.Errorf("symlink %q: %w", name, err)
+			}
+		}
+		// Other entries, such as the pax header GitHub uses to record the
+		// commit SHA, carry no files.
+	}
+}
+
+// emptyDir removes everything in fs.
+func emptyDir(fs billy.Filesystem) error {
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := util.RemoveAll(fs, e.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// askpassScript is the GIT_ASKPASS helper. git runs it with the prompt as
+// its argument and reads the answer from its output. Only one line is
+// read, as the pipe may be written to again before it is closed.
+const askpassScript = `#!/bin/sh
+case "$1" in
+Username*) pipe=%s ;;
+*) pipe=%s ;;
+esac
+IFS= read -r answer < "$pipe"
+printf '%%s\n' "$answer"
+`
+
+// askpass serves credentials to the git CLI through a GIT_ASKPASS script.
+// The script reads them from named pipes in a private directory, so they
+// never appear in the arguments or environment of git or its children,
+// are never written to disk, and can only be read while the clone runs.
+type askpass struct {
+	// script is the path to set GIT_ASKPASS to.
+	script string
+	fifos  []string
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// startAskpass writes the askpass script and pipes to dir, which must only
+// be accessible by the current user, and serves username and password
+// until Close is called. Any number of prompts is answered, since git asks
+// again when retrying.
+func startAskpass(dir, username, password string) (*askpass, error) {
+	a := &askpass{
+		script: filepath.Join(dir, "askpass.sh"),
+		done:   make(chan struct{}),
+	}
+	values := []string{username, password}
+	for _, name := range []string{"username", "password"} {
+		fifo := filepath.Join(dir, name)
+		if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+			return nil, fmt.Errorf("create askpass pipe: %w", err)
+		}
+		a.fifos = append(a.fifos, fifo)
+	}
+	script := fmt.Sprintf(askpassScript, shellQuote(a.fifos[0]), shellQuote(a.fifos[1]))
+	if err := os.WriteFile(a.script, []byte(script), 0o700); err != nil {
+		return nil, fmt.Errorf("write askpass: %w", err)
+	}
+	for i, fifo := range a.fifos {
+		a.wg.Add(1)
+		go a.serve(fifo, values[i])
+	}
+	return a, nil
+}
+
+// serve writes value to each reader of fifo until a is closed.
+func (a *askpass) serve(fifo, value string) {
+	defer a.wg.Done()
+	for {
+		// Opening blocks until the script opens the pipe for reading.
+		f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		select {
+		case <-a.done:
+			_ = f.Close()
+			return
+		default:
+		}
+		_, _ = io.WriteString(f, value+"\n")
+		_ = f.Close()
+	}
+}
+
+// Close stops serving credentials. The caller removes the directory.
+func (a *askpass) Close() {
+	close(a.done)
+	// Open each pipe for reading to unblock the servers waiting for a
+	// reader, and keep it open until they have seen that a is closed.
+	var readers []*os.File
+	for _, fifo := range a.fifos {
+		if f, err := os.OpenFile(fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0); err == nil {
+			readers = append(readers, f)
+		}
+	}
+	a.wg.Wait()
+	for _, f := range readers {
+		_ = f.Close()
+	}
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
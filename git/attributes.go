@@ -0,0 +1,155 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// builtinAttributes are the macros Git defines itself.
+const builtinAttributes = "[attr]binary -diff -merge -text\n"
+
+// loadHeadAttributes loads the .gitattributes files of the commit at HEAD
+// into fs, before it is checked out.
+func loadHeadAttributes(repo *git.Repository, fs *checkoutFS, opts CloneRepoOptions) error {
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("get head: %w", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return fmt.Errorf("get commit %s: %w", head.Hash(), err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("get tree: %w", err)
+	}
+	n, err := fs.loadAttributes(tree)
+	if err != nil {
+		return fmt.Errorf("load .gitattributes: %w", err)
+	}
+	if n > 0 {
+		opts.logf(log.PhaseCheckingOut, log.LevelInfo, "📝 Applying line endings from %d .gitattributes file(s)", n)
+	}
+	return nil
+}
+
+// loadAttributes reads the .gitattributes files in tree, which is about
+// to be checked out, so that their text and eol attributes are applied.
+// It returns the number of files read.
+func (fs *checkoutFS) loadAttributes(tree *object.Tree) (int, error) {
+	type attributesFile struct {
+		dir   []string
+		entry object.TreeEntry
+	}
+	var files []attributesFile
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if path.Base(name) != ".gitattributes" || !entry.Mode.IsFile() || entry.Mode == filemode.Symlink {
+			continue
+		}
+		var dir []string
+		if d := path.Dir(name); d != "." {
+			dir = strings.Split(d, "/")
+		}
+		files = append(files, attributesFile{dir: dir, entry: entry})
+	}
+	// Patterns further down the tree take precedence, and only the root
+	// file may define macros.
+	sort.SliceStable(files, func(i, j int) bool {
+		return len(files[i].dir) < len(files[j].dir)
+	})
+	stack, err := gitattributes.ReadAttributes(strings.NewReader(builtinAttributes), nil, true)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range files {
+		blob, err := tree.TreeEntryFile(&f.entry)
+		if err != nil {
+			return 0, err
+		}
+		content, err := blob.Contents()
+		if err != nil {
+			return 0, err
+		}
+		attrs, err := gitattributes.ReadAttributes(strings.NewReader(content), f.dir, len(f.dir) == 0)
+		if err != nil {
+			return 0, fmt.Errorf("read %s: %w", path.Join(append(f.dir, ".gitattributes")...), err)
+		}
+		stack = append(stack, attrs...)
+	}
+	fs.attributes = newAttributeMatcher(stack)
+	return len(files), nil
+}
+
+// attributeMatcher is a gitattributes.Matcher where, as in Git, the last
+// pattern matching a path sets each attribute. The matcher of go-git lets
+// earlier patterns override later ones, so that a .gitattributes file
+// further down the tree cannot override the root one.
+type attributeMatcher struct {
+	stack  []gitattributes.MatchAttribute
+	macros map[string][]gitattributes.Attribute
+}
+
+func newAttributeMatcher(stack []gitattributes.MatchAttribute) *attributeMatcher {
+	m := &attributeMatcher{stack: stack, macros: map[string][]gitattributes.Attribute{}}
+	for _, a := range stack {
+		if a.Pattern == nil {
+			m.macros[a.Name] = a.Attributes
+		}
+	}
+	return m
+}
+
+func (m *attributeMatcher) Match(path []string, names []string) (map[string]gitattributes.Attribute, bool) {
+	results := make(map[string]gitattributes.Attribute, len(names))
+	set := func(a gitattributes.Attribute) {
+		if _, ok := results[a.Name()]; ok {
+			return
+		}
+		if len(names) == 0 || slices.Contains(names, a.Name()) {
+			results[a.Name()] = a
+		}
+	}
+	matched := false
+	for i := len(m.stack) - 1; i >= 0; i-- {
+		if len(names) > 0 && len(results) == len(names) {
+			break
+		}
+		p := m.stack[i].Pattern
+		if p == nil || !p.Match(path) {
+			continue
+		}
+		matched = true
+		// Attributes later on a line override earlier ones, including
+		// those set by a macro.
+		attrs := m.stack[i].Attributes
+		for j := len(attrs) - 1; j >= 0; j-- {
+			set(attrs[j])
+			if attrs[j].IsSet() {
+				for _, a := range m.macros[attrs[j].Name()] {
+					set(a)
+				}
+			}
+		}
+	}
+	return results, matched
+}
@@ -0,0 +1,59 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MergeCABundles reads the PEM files at paths and returns their
+// certificates as a single bundle for CloneRepoOptions.CABundle.
+// Certificates that appear in more than one file are included once, and
+// blocks that are not valid certificates are skipped. It fails if a file
+// cannot be read, or lists every file that contained no valid
+// certificate.
+func MergeCABundles(paths ...string) ([]byte, error) {
+	var (
+		bundle bytes.Buffer
+		seen   = map[[sha256.Size]byte]bool{}
+		empty  []string
+	)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		found := false
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+				continue
+			}
+			found = true
+			sum := sha256.Sum256(block.Bytes)
+			if seen[sum] {
+				continue
+			}
+			seen[sum] = true
+			_ = pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: block.Bytes})
+		}
+		if !found {
+			empty = append(empty, path)
+		}
+	}
+	if len(empty) > 0 {
+		return nil, fmt.Errorf("no valid certificates in %s", strings.Join(empty, ", "))
+	}
+	return bundle.Bytes(), nil
+}
@@ -0,0 +1,153 @@
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// CloneRepoResult describes the parts of a cloned repository that determine
+// the content of its worktree.
+type CloneRepoResult struct {
+	// Cloned reports whether the repository was cloned, rather than
+	// already existing. It does not contribute to CacheKey.
+	Cloned bool
+	// Commit is the SHA of the checked out commit.
+	Commit string
+	// SparsePaths is the sparse checkout set, or nil if the worktree is
+	// not sparse.
+	SparsePaths []string
+	// Submodules maps each submodule path to the commit SHA recorded for it
+	// in Commit.
+	Submodules map[string]string
+	// LFS reports whether the repository uses Git LFS.
+	LFS bool
+	// AdvertisedCommit is the SHA the remote advertised for the requested
+	// ref when the repository was cloned with VerifyHead, or empty. It is
+	// the same as Commit unless the remote changed or was tampered with.
+	// It does not contribute to CacheKey.
+	AdvertisedCommit string
+	// Repository is the repository the result was read from, opened on the
+	// Storage of the clone, or nil if there is no .git directory. Cloners
+	// other than GoGitCloner and CLIGitCloner may leave it nil. It does
+	// not contribute to CacheKey.
+	Repository *git.Repository
+}
+
+// ResolveCloneResult reads the CloneRepoResult of the repository at
+// repoPath. If HEAD cannot be resolved, e.g. in an empty repository, the
+// error is returned along with a result that only has Repository set.
+func ResolveCloneResult(storage billy.Filesystem, repoPath string) (CloneRepoResult, error) {
+	repo, err := openRepo(storage, repoPath)
+	if err != nil {
+		return CloneRepoResult{}, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return CloneRepoResult{Repository: repo}, fmt.Errorf("get head: %w", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return CloneRepoResult{}, fmt.Errorf("get commit %s: %w", head.Hash(), err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return CloneRepoResult{}, fmt.Errorf("get tree: %w", err)
+	}
+	result := CloneRepoResult{
+		Commit:     head.Hash().String(),
+		Submodules: map[string]string{},
+		LFS:        usesLFS(storage, repoPath),
+		Repository: repo,
+	}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return CloneRepoResult{}, fmt.Errorf("walk tree: %w", err)
+		}
+		if entry.Mode == filemode.Submodule {
+			result.Submodules[name] = entry.Hash.String()
+		}
+	}
+	sparse, err := readSparseCheckout(storage, filepath.Join(repoPath, ".git", "info", "sparse-checkout"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return CloneRepoResult{}, err
+	}
+	result.SparsePaths = sparse
+	cfg, err := repo.Config()
+	if err != nil {
+		return CloneRepoResult{}, fmt.Errorf("read config: %w", err)
+	}
+	// See advertisedHeadKey.
+	result.AdvertisedCommit = cfg.Raw.Section("envbuilder").Option("advertisedHead")
+	return result, nil
+}
+
+// CacheKey returns a deterministic key for external build caches derived
+// from the content of a clone. The following contribute to the key:
+//
+//   - result.Commit
+//   - result.SparsePaths, in any order
+//   - result.Submodules, both paths and SHAs
+//   - result.LFS
+//   - opts.ExcludePaths, in any order, since they are deleted from the worktree
+//   - opts.AutoCRLF and opts.DisableSymlinks, or the core.autocrlf and
+//     core.symlinks values in opts.GitConfig, since they change the files
+//     written to the worktree
+//   - opts.ApplyAttributes, since it changes line endings in the worktree
+//   - opts.Depth, as shallow or not, since it changes the .git directory
+//   - opts.PruneMode, since it changes or removes the .git directory
+//
+// Everything else, including the URL the repository was cloned from and
+// credentials, is ignored so that mirrors and rotated secrets share a key.
+func CacheKey(result CloneRepoResult, opts CloneRepoOptions) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "commit %s\n", result.Commit)
+	sparse := slices.Clone(result.SparsePaths)
+	slices.Sort(sparse)
+	for _, p := range sparse {
+		_, _ = fmt.Fprintf(h, "sparse %q\n", p)
+	}
+	paths := make([]string, 0, len(result.Submodules))
+	for p := range result.Submodules {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	for _, p := range paths {
+		_, _ = fmt.Fprintf(h, "submodule %q %s\n", p, result.Submodules[p])
+	}
+	_, _ = fmt.Fprintf(h, "lfs %t\n", result.LFS)
+	exclude := slices.Clone(opts.ExcludePaths)
+	slices.Sort(exclude)
+	for _, p := range exclude {
+		_, _ = fmt.Fprintf(h, "exclude %q\n", p)
+	}
+	// Invalid settings fail the clone, so they need no key of their own.
+	gitConfig, _ := cloneGitConfig(opts)
+	checkout, _ := checkoutSettingsFromConfig(gitConfig)
+	_, _ = fmt.Fprintf(h, "crlf %t\n", checkout.crlf)
+	_, _ = fmt.Fprintf(h, "symlinks %t\n", checkout.symlinks)
+	_, _ = fmt.Fprintf(h, "attributes %t\n", opts.ApplyAttributes)
+	_, _ = fmt.Fprintf(h, "shallow %t\n", opts.Depth > 0)
+	pruneMode := opts.PruneMode
+	if pruneMode == "" {
+		pruneMode = PruneNone
+	}
+	_, _ = fmt.Fprintf(h, "prune %s\n", pruneMode)
+	return hex.EncodeToString(h.Sum(nil))
+}
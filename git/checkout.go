@@ -0,0 +1,191 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+)
+
+// Supported values of CloneRepoOptions.AutoCRLF, as for core.autocrlf.
+const (
+	// AutoCRLFTrue converts LF line endings to CRLF in text files when they
+	// are checked out.
+	AutoCRLFTrue = "true"
+	// AutoCRLFInput checks files out as committed. Git only converts CRLF
+	// to LF when committing, which envbuilder never does.
+	AutoCRLFInput = "input"
+	// AutoCRLFFalse checks files out as committed.
+	AutoCRLFFalse = "false"
+)
+
+// checkoutSettings are the core.autocrlf and core.symlinks values that
+// affect how the worktree is written, and whether .gitattributes is
+// honored.
+type checkoutSettings struct {
+	crlf       bool
+	symlinks   bool
+	attributes bool
+}
+
+// checkoutSettingsFromConfig reads core.autocrlf and core.symlinks from
+// the Git config values that will be applied to the repository.
+func checkoutSettingsFromConfig(gitConfig map[string]string) (checkoutSettings, error) {
+	settings := checkoutSettings{symlinks: true}
+	for key, value := range gitConfig {
+		switch {
+		case strings.EqualFold(key, "core.autocrlf"):
+			switch strings.ToLower(value) {
+			case AutoCRLFTrue:
+				settings.crlf = true
+			case AutoCRLFInput, AutoCRLFFalse:
+			default:
+				return checkoutSettings{}, fmt.Errorf("invalid core.autocrlf %q: must be one of true, input or false", value)
+			}
+		case strings.EqualFold(key, "core.symlinks"):
+			symlinks, err := strconv.ParseBool(value)
+			if err != nil {
+				return checkoutSettings{}, fmt.Errorf("invalid core.symlinks %q: %w", value, err)
+			}
+			settings.symlinks = symlinks
+		}
+	}
+	return settings, nil
+}
+
+// worktree returns fs wrapped so that go-git writes the worktree according
+// to the settings. fs is returned as is if no conversion is needed.
+func (s checkoutSettings) worktree(fs billy.Filesystem) billy.Filesystem {
+	if !s.crlf && s.symlinks && !s.attributes {
+		return fs
+	}
+	return &checkoutFS{Filesystem: fs, settings: s}
+}
+
+// checkoutFS applies core.autocrlf, core.symlinks and the text and eol
+// attributes to files written by a go-git checkout, which ignores them.
+type checkoutFS struct {
+	billy.Filesystem
+	settings checkoutSettings
+	// attributes matches the .gitattributes patterns of the commit being
+	// checked out. It is set by loadAttributes before the checkout.
+	attributes gitattributes.Matcher
+}
+
+// OpenFile converts line endings in files that go-git checks out, which it
+// always opens with O_TRUNC.
+func (fs *checkoutFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := fs.Filesystem.OpenFile(name, flag, perm)
+	if err != nil || flag&os.O_TRUNC == 0 {
+		return f, err
+	}
+	switch fs.lineEnding(name) {
+	case eolCRLF:
+		return &eolFile{File: f, convert: toCRLF}, nil
+	case eolLF:
+		return &eolFile{File: f, convert: toLF}, nil
+	}
+	return f, nil
+}
+
+// Line endings files are converted to on checkout.
+const (
+	eolLF   = "lf"
+	eolCRLF = "crlf"
+)
+
+// lineEnding returns the line endings to convert the file name to, or ""
+// to check it out as committed. An eol attribute takes precedence over
+// core.autocrlf, and text unset, e.g. by the binary macro, disables both.
+func (fs *checkoutFS) lineEnding(name string) string {
+	var eol string
+	if fs.settings.crlf {
+		eol = eolCRLF
+	}
+	if fs.attributes == nil {
+		return eol
+	}
+	attrs, _ := fs.attributes.Match(strings.Split(name, "/"), []string{"text", "eol"})
+	if text, ok := attrs["text"]; ok && text.IsUnset() {
+		return ""
+	}
+	if value, ok := attrs["eol"]; ok && value.IsValueSet() {
+		switch v := strings.ToLower(value.Value()); v {
+		case eolLF, eolCRLF:
+			return v
+		}
+	}
+	return eol
+}
+
+// Symlink writes the link as a plain file containing its target when
+// symlinks are disabled, like Git does.
+func (fs *checkoutFS) Symlink(target, link string) error {
+	if fs.settings.symlinks {
+		return fs.Filesystem.Symlink(target, link)
+	}
+	f, err := fs.Filesystem.OpenFile(link, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(target)); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// eolFile buffers everything written to it and converts line endings on
+// Close, once it can tell whether the content is text.
+type eolFile struct {
+	billy.File
+	buf     bytes.Buffer
+	convert func([]byte) []byte
+}
+
+func (f *eolFile) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+func (f *eolFile) Close() error {
+	content := f.buf.Bytes()
+	if !isBinary(content) {
+		content = f.convert(content)
+	}
+	if _, err := f.File.Write(content); err != nil {
+		_ = f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
+
+// isBinary uses the same heuristic as Git: content with a NUL byte in the
+// first 8000 bytes is binary.
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), 8000)], 0) >= 0
+}
+
+// toCRLF converts lone LF line endings to CRLF, leaving existing CRLF
+// line endings alone.
+func toCRLF(content []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(content) + bytes.Count(content, []byte("\n")))
+	for i, b := range content {
+		if b == '\n' && (i == 0 || content[i-1] != '\r') {
+			out.WriteByte('\r')
+		}
+		out.WriteByte(b)
+	}
+	return out.Bytes()
+}
+
+// toLF converts CRLF line endings to LF. Git normalizes line endings when
+// files are committed, so this only changes files that were committed
+// with CRLF despite their eol attribute.
+func toLF(content []byte) []byte {
+	return bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+}
@@ -0,0 +1,334 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"golang.org/x/sync/errgroup"
+)
+
+// errCheckoutSerially is returned by checkoutHeadParallel, without
+// touching the worktree, when the tree has to be checked out serially.
+var errCheckoutSerially = errors.New("checking out serially")
+
+// checkoutEntry is a tree entry to write to the worktree.
+type checkoutEntry struct {
+	name string
+	hash plumbing.Hash
+	mode filemode.FileMode
+}
+
+// checkoutWorktree populates the worktree from HEAD, writing files with
+// opts.CheckoutWorkers goroutines if it is above one.
+func checkoutWorktree(repo *git.Repository, gitDir billy.Filesystem, opts CloneRepoOptions) error {
+	if opts.CheckoutWorkers > 1 {
+		err := checkoutHeadParallel(repo, gitDir, opts.Storage, opts.CheckoutWorkers)
+		if !errors.Is(err, errCheckoutSerially) {
+			return err
+		}
+		opts.logf(log.PhaseCheckingOut, log.LevelInfo, "📂 Not checking out with %d workers, %s", opts.CheckoutWorkers, err)
+	}
+	return checkoutHead(repo)
+}
+
+// checkoutHeadParallel populates the empty worktree from HEAD like
+// checkoutHead, writing regular files with up to workers goroutines.
+// go-git storage is not safe for concurrent use, so each goroutine reads
+// objects through its own, and filesystem calls are serialized for
+// filesystems such as memfs that are not either. Directories are created
+// before any file and symlinks written after all of them.
+//
+// Paths that only differ in case would overwrite each other on a
+// case-insensitive filesystem, with a result that depends on the order
+// they are written in, so such trees are checked out serially, as are
+// worktrees that already have files in them.
+func checkoutHeadParallel(repo *git.Repository, gitDir, storage billy.Filesystem, workers int) error {
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	existing, err := w.Filesystem.ReadDir(".")
+	if err != nil {
+		return err
+	}
+	for _, fi := range existing {
+		if fi.Name() != ".git" {
+			return fmt.Errorf("%w: the worktree is not empty", errCheckoutSerially)
+		}
+	}
+
+	var dirs []string
+	var files, links, submodules []checkoutEntry
+	folded := map[string]string{}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if other, ok := folded[strings.ToLower(name)]; ok {
+			return fmt.Errorf("%w: %s and %s only differ in case", errCheckoutSerially, other, name)
+		}
+		folded[strings.ToLower(name)] = name
+		e := checkoutEntry{name: name, hash: entry.Hash, mode: entry.Mode}
+		switch entry.Mode {
+		case filemode.Dir:
+			dirs = append(dirs, name)
+		case filemode.Submodule:
+			submodules = append(submodules, e)
+		case filemode.Symlink:
+			if strings.EqualFold(name, ".gitmodules") {
+				return git.ErrGitModulesSymlink
+			}
+			links = append(links, e)
+		default:
+			files = append(files, e)
+		}
+	}
+
+	// The walker returns parents before their children.
+	for _, dir := range dirs {
+		if err := w.Filesystem.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	for _, e := range submodules {
+		if err := w.Filesystem.MkdirAll(e.name, 0o755); err != nil {
+			return err
+		}
+	}
+	var mu sync.Mutex
+	if err := writeCheckoutFiles(files, workers, &lockedFS{Filesystem: w.Filesystem, mu: &mu}, func() *filesystem.Storage {
+		return filesystem.NewStorageWithOptions(&lockedFS{Filesystem: gitDir, mu: &mu}, cache.NewObjectLRUDefault(), filesystem.Options{
+			AlternatesFS: &lockedFS{Filesystem: storage, mu: &mu},
+		})
+	}); err != nil {
+		return err
+	}
+	for _, e := range links {
+		blob, err := repo.BlobObject(e.hash)
+		if err != nil {
+			return err
+		}
+		target, err := readBlob(blob)
+		if err != nil {
+			return err
+		}
+		if err := w.Filesystem.Symlink(string(target), e.name); err != nil {
+			return err
+		}
+	}
+
+	// The index records what was written, as go-git does, so that the
+	// worktree is clean.
+	idx := &index.Index{Version: 2}
+	for _, e := range append(files, links...) {
+		fi, err := w.Filesystem.Lstat(e.name)
+		if err != nil {
+			return err
+		}
+		mode, err := filemode.NewFromOSFileMode(fi.Mode())
+		if err != nil {
+			return err
+		}
+		idx.Entries = append(idx.Entries, &index.Entry{
+			Hash:       e.hash,
+			Name:       e.name,
+			Mode:       mode,
+			ModifiedAt: fi.ModTime(),
+			Size:       uint32(fi.Size()),
+		})
+	}
+	for _, e := range submodules {
+		idx.Entries = append(idx.Entries, &index.Entry{Hash: e.hash, Name: e.name, Mode: e.mode})
+	}
+	sort.Slice(idx.Entries, func(i, j int) bool {
+		return idx.Entries[i].Name < idx.Entries[j].Name
+	})
+	return repo.Storer.SetIndex(idx)
+}
+
+// writeCheckoutFiles writes files to fs with up to workers goroutines,
+// each reading blobs from a storage returned by newStorage.
+func writeCheckoutFiles(files []checkoutEntry, workers int, fs billy.Filesystem, newStorage func() *filesystem.Storage) error {
+	eg, ctx := errgroup.WithContext(context.Background())
+	jobs := make(chan checkoutEntry)
+	eg.Go(func() error {
+		defer close(jobs)
+		for _, e := range files {
+			select {
+			case jobs <- e:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		return nil
+	})
+	for i := 0; i < min(workers, len(files)); i++ {
+		eg.Go(func() error {
+			s := newStorage()
+			defer s.Close()
+			for e := range jobs {
+				if err := writeCheckoutFile(s, fs, e); err != nil {
+					return fmt.Errorf("write %s: %w", e.name, err)
+				}
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// writeCheckoutFile writes the blob of the regular file e to fs.
+func writeCheckoutFile(s *filesystem.Storage, fs billy.Filesystem, e checkoutEntry) (err error) {
+	mode, err := e.mode.ToOSFileMode()
+	if err != nil {
+		return err
+	}
+	blob, err := object.GetBlob(s, e.hash)
+	if err != nil {
+		return err
+	}
+	from, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	to, err := fs.OpenFile(e.name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := to.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	_, err = io.Copy(to, from)
+	return err
+}
+
+// readBlob returns the content of blob.
+func readBlob(blob *object.Blob) ([]byte, error) {
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// lockedFS serializes the calls that look up or change the files in a
+// billy.Filesystem. Reads and writes of open files are not serialized.
+type lockedFS struct {
+	billy.Filesystem
+	mu *sync.Mutex
+}
+
+func (fs *lockedFS) Create(filename string) (billy.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.Create(filename)
+}
+
+func (fs *lockedFS) Open(filename string) (billy.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.Open(filename)
+}
+
+func (fs *lockedFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.OpenFile(filename, flag, perm)
+}
+
+func (fs *lockedFS) Stat(filename string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.Stat(filename)
+}
+
+func (fs *lockedFS) Lstat(filename string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.Lstat(filename)
+}
+
+func (fs *lockedFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.Rename(oldpath, newpath)
+}
+
+func (fs *lockedFS) Remove(filename string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.Remove(filename)
+}
+
+func (fs *lockedFS) TempFile(dir, prefix string) (billy.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.TempFile(dir, prefix)
+}
+
+func (fs *lockedFS) ReadDir(path string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.ReadDir(path)
+}
+
+func (fs *lockedFS) MkdirAll(filename string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.MkdirAll(filename, perm)
+}
+
+func (fs *lockedFS) Symlink(target, link string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.Symlink(target, link)
+}
+
+func (fs *lockedFS) Readlink(link string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.Filesystem.Readlink(link)
+}
+
+// Chroot keeps the calls on the returned filesystem serialized.
+func (fs *lockedFS) Chroot(path string) (billy.Filesystem, error) {
+	return chroot.New(fs, path), nil
+}
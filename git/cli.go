@@ -0,0 +1,367 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// minGitVersion is the oldest git CLI that CLIGitCloner uses, the first
+// to speak protocol v2 by default.
+var minGitVersion = [2]int{2, 26}
+
+var gitVersionRE = regexp.MustCompile(`^git version (\d+)\.(\d+)`)
+
+// CLIGitCloner is a Cloner that runs the git CLI, which supports features
+// go-git lacks such as protocol v2, partial clone, credential helpers and
+// Git LFS.
+//
+// It falls back to GoGitCloner if git is not installed or is older than
+// 2.26, if a repository already exists at CloneRepoOptions.Path, if Path
+// is not empty, and for options it cannot translate: SSH and gits:// URLs,
+// pull request and commit refs, auth other than HTTP basic auth,
+// Transport, MaxBandwidth, MaxFiles, PathCredentials, Resolver,
+// ResolveHostToIP, TLSServerName, TLS client certificates, CachePath,
+// TempDir, ArchiveURL, VerifyHead, TagFilter, Mirrors, Retries, redirect
+// options and AlternateObjectDirs.
+type CLIGitCloner struct {
+	// Root is the directory on the local disk that CloneRepoOptions.Storage
+	// is rooted at, since git cannot write through a billy.Filesystem.
+	// Defaults to "/", like the default options.Filesystem.
+	Root string
+	// GitPath is the git binary to run. Defaults to git in PATH.
+	GitPath string
+}
+
+// Clone implements Cloner.
+func (c CLIGitCloner) Clone(ctx context.Context, opts CloneRepoOptions) (CloneRepoResult, error) {
+	if err := checkExplicitRef(opts); err != nil {
+		return CloneRepoResult{}, err
+	}
+	if err := opts.ProtocolVersion.Validate(); err != nil {
+		return CloneRepoResult{}, err
+	}
+	if _, err := openRepo(opts.Storage, opts.Path); err == nil {
+		// Mismatches and recloning are handled by go-git.
+		return GoGitCloner{}.Clone(ctx, opts)
+	}
+	gitPath, err := c.findGit(ctx)
+	var clone *cliClone
+	if err == nil {
+		clone, err = newCLIClone(opts)
+	}
+	if err != nil {
+		opts.logf(log.PhaseCloning, log.LevelInfo, "ℹ️ Cloning with go-git instead of the git CLI: %s", err)
+		return GoGitCloner{}.Clone(ctx, opts)
+	}
+	root := c.Root
+	if root == "" {
+		root = "/"
+	}
+	dir := filepath.Join(root, filepath.FromSlash(opts.Path))
+
+	tmp, err := os.MkdirTemp("", "envbuilder-git-")
+	if err != nil {
+		return CloneRepoResult{}, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	env, err := clone.env(tmp)
+	if err != nil {
+		return CloneRepoResult{}, err
+	}
+	if auth, ok := opts.RepoAuth.(*githttp.BasicAuth); ok {
+		ap, err := startAskpass(tmp, auth.Username, auth.Password)
+		if err != nil {
+			return CloneRepoResult{}, err
+		}
+		defer ap.Close()
+		env = append(env, "GIT_ASKPASS="+ap.script)
+	}
+	// The packet trace shows the protocol version the server agreed to.
+	tracePath := filepath.Join(tmp, "packet-trace")
+	if opts.ProtocolVersion == ProtocolV2 {
+		env = append(env, "GIT_TRACE_PACKET="+tracePath)
+	}
+
+	log.ReportPhase(opts.ProgressReporter, log.PhaseCloning)
+	opts.logf(log.PhaseCloning, log.LevelInfo, "🧰 Cloning %s with %s", redactURL(opts.RepoURL), gitPath)
+	cmd := exec.CommandContext(ctx, gitPath, append(clone.args(), "--", clone.url, dir)...)
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if opts.Progress != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, opts.Progress)
+	}
+	if err := cmd.Run(); err != nil {
+		return CloneRepoResult{}, fmt.Errorf("git clone %q: %w: %s", redactURL(opts.RepoURL), err, lastLine(stderr.String()))
+	}
+	if opts.ProtocolVersion == ProtocolV2 && !negotiatedV2(tracePath) {
+		opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ %s does not support Git protocol v2, cloned over v0 instead", redactURL(opts.RepoURL))
+	}
+
+	fs, err := opts.Storage.Chroot(opts.Path)
+	if err != nil {
+		return CloneRepoResult{Cloned: true}, fmt.Errorf("chroot %q: %w", opts.Path, err)
+	}
+	// git refuses to check out traversing paths itself, but not symlinks
+	// pointing outside the worktree.
+	if repo, err := openRepo(opts.Storage, opts.Path); err == nil {
+		links, err := checkHeadPaths(repo, opts)
+		if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return CloneRepoResult{Cloned: true}, err
+		}
+		if err := removeEscapingSymlinks(fs, links, opts); err != nil {
+			return CloneRepoResult{Cloned: true}, err
+		}
+	}
+	if err := checkRequiredPaths(fs, opts.RequiredPaths); err != nil {
+		// git only clones into an empty directory.
+		if rmErr := discardClone(opts, fs, true); rmErr != nil {
+			return CloneRepoResult{Cloned: true}, fmt.Errorf("%w (clean up failed clone: %s)", err, rmErr)
+		}
+		return CloneRepoResult{}, err
+	}
+	if err := removeExcludedPaths(fs, opts); err != nil {
+		return CloneRepoResult{Cloned: true}, err
+	}
+	if opts.Repack != nil && opts.PruneMode != PruneRemove {
+		// git also honors the depth and bitmaps, which go-git does not.
+		reclaimed, err := repackGitDir(opts.Storage, opts.Path, *opts.Repack, func(*git.Repository) error {
+			out, err := exec.CommandContext(ctx, gitPath, "-C", dir, "repack", "-a", "-d", "-q").CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("git repack: %w: %s", err, lastLine(string(out)))
+			}
+			return nil
+		})
+		logRepack(opts, reclaimed, err)
+		opts.Repack = nil
+	}
+	optimizeGitDir(opts)
+	result, err := ResolveCloneResult(opts.Storage, opts.Path)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) || opts.PruneMode == PruneRemove {
+		err = nil
+	}
+	result.Cloned = true
+	return result, err
+}
+
+// findGit returns the path of the git binary, or an error if it is not
+// installed or too old.
+func (c CLIGitCloner) findGit(ctx context.Context) (string, error) {
+	name := c.GitPath
+	if name == "" {
+		name = "git"
+	}
+	gitPath, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("find git: %w", err)
+	}
+	out, err := exec.CommandContext(ctx, gitPath, "version").Output()
+	if err != nil {
+		return "", fmt.Errorf("git version: %w", err)
+	}
+	m := gitVersionRE.FindSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("unknown git version %q", strings.TrimSpace(string(out)))
+	}
+	major, _ := strconv.Atoi(string(m[1]))
+	minor, _ := strconv.Atoi(string(m[2]))
+	if major < minGitVersion[0] || major == minGitVersion[0] && minor < minGitVersion[1] {
+		return "", fmt.Errorf("git %d.%d is older than %d.%d", major, minor, minGitVersion[0], minGitVersion[1])
+	}
+	return gitPath, nil
+}
+
+// cliClone is a clone translated into git CLI arguments.
+type cliClone struct {
+	opts   CloneRepoOptions
+	url    string
+	branch string
+	config map[string]string
+}
+
+// newCLIClone translates opts, or returns an error naming the first
+// option that the git CLI cannot be used with.
+func newCLIClone(opts CloneRepoOptions) (*cliClone, error) {
+	switch {
+	case opts.Transport != nil:
+		return nil, errors.New("a custom transport is set")
+	case opts.MaxBandwidth > 0:
+		return nil, errors.New("a bandwidth limit is set")
+	case opts.MaxFiles > 0:
+		return nil, errors.New("a file count limit is set")
+	case len(opts.PathCredentials) > 0:
+		return nil, errors.New("path credentials are set")
+	case opts.Resolver != nil:
+		return nil, errors.New("a custom resolver is set")
+	case opts.ResolveHostToIP != "" || opts.TLSServerName != "":
+		return nil, errors.New("host pinning is set")
+	case len(opts.TLSClientCert) > 0 || len(opts.TLSClientKey) > 0:
+		return nil, errors.New("a TLS client certificate is set")
+	case opts.CachePath != "":
+		return nil, errors.New("a clone cache is set")
+	case opts.TempDir != "":
+		return nil, errors.New("a temp dir is set")
+	case opts.ArchiveURL != "":
+		return nil, errors.New("an archive URL is set")
+	case opts.VerifyHead || opts.VerifyHeadStrict:
+		return nil, errors.New("head verification is enabled")
+	case opts.TagFilter != "":
+		return nil, errors.New("a tag filter is set")
+	case len(opts.Mirrors) > 0:
+		return nil, errors.New("mirrors are set")
+	case opts.Retries > 0:
+		return nil, errors.New("retries are enabled")
+	case opts.MaxRedirects != 0 || opts.FollowRedirectCredentials:
+		return nil, errors.New("redirect options are set")
+	case len(opts.AlternateObjectDirs) > 0:
+		return nil, errors.New("alternate object directories are set")
+	}
+	switch opts.RepoAuth.(type) {
+	case nil, *githttp.BasicAuth:
+	default:
+		return nil, fmt.Errorf("%T auth is not supported", opts.RepoAuth)
+	}
+	if entries, err := opts.Storage.ReadDir(opts.Path); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", opts.Path)
+	}
+
+	normalized, err := NormalizeGitURL(RewriteGitURL(opts.RepoURL, opts.URLRewrites))
+	if err != nil {
+		return nil, err
+	}
+	cloneURL, ref, _ := strings.Cut(normalized, "#")
+	if !strings.HasPrefix(cloneURL, "/") {
+		parsed, err := url.Parse(cloneURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse url %q: %w", redactURL(cloneURL), err)
+		}
+		if !slices.Contains([]string{"http", "https", "file"}, parsed.Scheme) {
+			return nil, fmt.Errorf("%s URLs are not supported", parsed.Scheme)
+		}
+	}
+	switch {
+	case pullRequestID(ref) != "":
+		return nil, errors.New("pull request refs are not supported")
+	case isCommitRef(ref):
+		return nil, errors.New("commit refs are not supported")
+	case strings.HasPrefix(ref, "refs/") && !strings.HasPrefix(ref, "refs/heads/") && !strings.HasPrefix(ref, "refs/tags/"):
+		return nil, fmt.Errorf("ref %q is not a branch or tag", ref)
+	}
+	branch := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	if branch == "" && opts.SingleBranch {
+		// Like the go-git clone.
+		branch = "main"
+	}
+
+	gitConfig, err := cloneGitConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &cliClone{opts: opts, url: cloneURL, branch: branch, config: gitConfig}, nil
+}
+
+// args returns the git clone arguments, without the URL and directory.
+func (c *cliClone) args() []string {
+	var args []string
+	// Passed with -c rather than --config so that they are not persisted
+	// to the cloned repository.
+	switch c.opts.ProtocolVersion {
+	case ProtocolV0:
+		args = append(args, "-c", "protocol.version=0")
+	case ProtocolV2:
+		args = append(args, "-c", "protocol.version=2")
+	}
+	if c.opts.MaxResolveWorkers > 0 {
+		args = append(args, "-c", "pack.threads="+strconv.Itoa(c.opts.MaxResolveWorkers))
+	}
+	if c.opts.CheckoutWorkers > 1 {
+		args = append(args, "-c", "checkout.workers="+strconv.Itoa(c.opts.CheckoutWorkers))
+	}
+	args = append(args, "clone", "--progress")
+	keys := make([]string, 0, len(c.config))
+	for key := range c.config {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		args = append(args, "--config", key+"="+c.config[key])
+	}
+	if c.branch != "" {
+		args = append(args, "--branch", c.branch)
+	}
+	if c.opts.SingleBranch {
+		args = append(args, "--single-branch")
+	}
+	if c.opts.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(c.opts.Depth))
+		if !c.opts.SingleBranch {
+			// --depth implies --single-branch, which go-git does not.
+			args = append(args, "--no-single-branch")
+		}
+	}
+	return args
+}
+
+// env returns the environment passing TLS and proxy options to git. Files
+// it needs are written to tmp. Credentials are passed by startAskpass.
+func (c *cliClone) env(tmp string) ([]string, error) {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	if c.opts.Insecure {
+		env = append(env, "GIT_SSL_NO_VERIFY=true")
+	}
+	if len(c.opts.CABundle) > 0 {
+		caPath := filepath.Join(tmp, "ca.pem")
+		if err := os.WriteFile(caPath, c.opts.CABundle, 0o600); err != nil {
+			return nil, fmt.Errorf("write CA bundle: %w", err)
+		}
+		env = append(env, "GIT_SSL_CAINFO="+caPath)
+	}
+	if c.opts.ProxyOptions.URL != "" {
+		proxyURL, err := c.opts.ProxyOptions.FullURL()
+		if err != nil {
+			return nil, fmt.Errorf("proxy url: %w", err)
+		}
+		for _, name := range []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY"} {
+			env = append(env, name+"="+proxyURL.String())
+		}
+	}
+	return env, nil
+}
+
+// negotiatedV2 reports whether the packet trace at path shows the server
+// speaking protocol v2. git falls back to v0 silently otherwise.
+func negotiatedV2(path string) bool {
+	trace, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(trace, []byte("< version 2"))
+}
+
+// lastLine returns the last non-empty line of git's output, which has the
+// error message.
+func lastLine(s string) string {
+	lines := strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == '\r' })
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return line
+		}
+	}
+	return ""
+}
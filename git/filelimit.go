@@ -0,0 +1,59 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// ErrTooManyFiles is returned by CloneRepo when the repository has more
+// files than CloneRepoOptions.MaxFiles. The checkout is aborted as soon as
+// the limit is reached.
+var ErrTooManyFiles = errors.New("too many files")
+
+// limitFiles returns fs failing with ErrTooManyFiles once more than max
+// files have been created in it, or fs as is if max is not positive.
+func limitFiles(fs billy.Filesystem, max int) billy.Filesystem {
+	if max <= 0 {
+		return fs
+	}
+	return &fileLimitFS{Filesystem: fs, max: int64(max)}
+}
+
+// fileLimitFS counts the files and symlinks created in a worktree. It is
+// safe for concurrent use if the underlying billy.Filesystem is.
+type fileLimitFS struct {
+	billy.Filesystem
+	max   int64
+	files atomic.Int64
+}
+
+func (fs *fileLimitFS) count() error {
+	if fs.files.Add(1) > fs.max {
+		return fmt.Errorf("%w: the repository has more than %d", ErrTooManyFiles, fs.max)
+	}
+	return nil
+}
+
+func (fs *fileLimitFS) Create(name string) (billy.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (fs *fileLimitFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&os.O_CREATE != 0 {
+		if err := fs.count(); err != nil {
+			return nil, err
+		}
+	}
+	return fs.Filesystem.OpenFile(name, flag, perm)
+}
+
+func (fs *fileLimitFS) Symlink(target, link string) error {
+	if err := fs.count(); err != nil {
+		return err
+	}
+	return fs.Filesystem.Symlink(target, link)
+}
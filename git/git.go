@@ -1,31 +1,56 @@
 package git
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/coder/envbuilder/options"
 
 	giturls "github.com/chainguard-dev/git-urls"
 	"github.com/coder/envbuilder/log"
 	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/cache"
+	commitgraph "github.com/go-git/go-git/v5/plumbing/format/commitgraph/v2"
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
 	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
 	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
 	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
 	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
+	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/skeema/knownhosts"
 	"golang.org/x/crypto/ssh"
 	gossh "golang.org/x/crypto/ssh"
+	xknownhosts "golang.org/x/crypto/ssh/knownhosts"
 )
 
 type CloneRepoOptions struct {
@@ -40,19 +65,684 @@ type CloneRepoOptions struct {
 	Depth        int
 	CABundle     []byte
 	ProxyOptions transport.ProxyOptions
+	// PathCredentials maps URL path prefixes to the credentials sent with
+	// HTTP requests for paths under them, e.g. for monorepos behind a proxy
+	// that authenticates by path. The longest prefix matching whole path
+	// segments wins, and RepoAuth, if any, is used for other paths.
+	// ParsePathCredentials reads them from username:password values.
+	PathCredentials map[string]*githttp.BasicAuth
+	// TLSClientCert and TLSClientKey are a PEM encoded client certificate
+	// and key presented to git daemons behind a TLS terminator, i.e. for
+	// gits:// URLs. Both are optional.
+	TLSClientCert []byte
+	TLSClientKey  []byte
+	// Resolver resolves the Git host for HTTP and SSH clones instead of the
+	// system resolver, e.g. NewResolver for internal DNS servers. SSH host
+	// keys are still checked against the host name in the URL.
+	Resolver Resolver
+	// ResolveHostToIP is an IP address to connect to instead of resolving
+	// the host of RepoURL. TLS certificates are still verified against the
+	// host name, and SSH host keys are checked against it.
+	ResolveHostToIP string
+	// TLSServerName is the server name sent in the TLS handshake, and the
+	// Host header, for https:// and gits:// URLs. Certificates are verified
+	// against it. If ResolveHostToIP is not set, the host of RepoURL is
+	// still the one connected to.
+	TLSServerName string
+	// SSHDialTimeout bounds the time spent establishing the TCP connection
+	// to the SSH host, and then the SSH handshake. It is ignored for
+	// non-SSH auth methods.
+	SSHDialTimeout time.Duration
+	// GitConfig is a set of section[.subsection].key=value pairs written to
+	// the repository's .git/config after a successful clone.
+	GitConfig map[string]string
+	// URLRewrites maps URL prefixes to replacement prefixes, mirroring git's
+	// url.<base>.insteadOf. The rewrites are also persisted to the cloned
+	// repository's config.
+	URLRewrites map[string]string
+	// SubmoduleURLRewrites maps submodule URL prefixes to replacement
+	// prefixes. The longest matching prefix is applied to the URL of each
+	// submodule of a fresh clone, and the result recorded in .git/config
+	// so that git submodule update fetches from it.
+	SubmoduleURLRewrites map[string]string
+	// PruneMode controls what happens to the .git directory after a fresh
+	// clone. Defaults to PruneNone.
+	PruneMode PruneMode
+	// SSHPort is the port to connect to for SSH URLs that do not specify
+	// one. If zero, the transport default of 22 is used.
+	SSHPort int
+	// SSHCiphers and SSHKeyExchanges restrict the ciphers and key exchange
+	// algorithms offered to the SSH host, in order of preference. Names
+	// golang.org/x/crypto/ssh does not support are ignored with a warning.
+	// If empty, its defaults are used.
+	SSHCiphers      []string
+	SSHKeyExchanges []string
+	// AutoCRLF sets core.autocrlf, which go-git otherwise ignores. With
+	// AutoCRLFTrue, LF line endings in text files are converted to CRLF on
+	// checkout. AutoCRLFInput and AutoCRLFFalse check files out as
+	// committed. It can also be set with GitConfig.
+	AutoCRLF string
+	// DisableSymlinks sets core.symlinks to false, so that symbolic links
+	// are checked out as plain files containing the link target. It can
+	// also be set with GitConfig. Symlinks checked out as files are never
+	// subject to AutoCRLF.
+	DisableSymlinks bool
+	// ApplyAttributes applies the text and eol attributes of the
+	// .gitattributes files in the checked out commit, which go-git ignores.
+	// Text files with eol=lf or eol=crlf are checked out with those line
+	// endings, and those with text unset are exempt from AutoCRLF. Binary
+	// files are never converted.
+	ApplyAttributes bool
+	// MaxFiles, if positive, aborts the checkout with ErrTooManyFiles as
+	// soon as more than MaxFiles files and symlinks have been written to
+	// the worktree, to protect the host from repositories that would
+	// exhaust its inodes. The partial clone is removed, along with the
+	// files already checked out if Path was empty before the clone.
+	MaxFiles int
+	// TempDir is a directory in Storage that temporary object and pack
+	// files are written to during the clone, instead of the .git
+	// directory. Use it to download into a larger volume. It must exist and
+	// be writable, and everything written to it is removed afterwards.
+	TempDir string
+	// RequireExplicitRef makes single-branch clones fail with
+	// ErrRefRequired if the URL has no ref fragment, instead of cloning
+	// refs/heads/main.
+	RequireExplicitRef bool
+	// VerifyHead records the commit the remote advertises for the requested
+	// ref before cloning, and checks that it is the one checked out. A
+	// mismatch, e.g. from tampering or a stale cache, is logged. The
+	// advertised commit is available from ResolveCloneResult.
+	VerifyHead bool
+	// VerifyHeadStrict is like VerifyHead, but fails with ErrHeadMismatch
+	// on a mismatch.
+	VerifyHeadStrict bool
+	// VerifyObjects checks after a fresh clone that the HEAD commit and
+	// every object in its tree exist and match their hashes, and fails
+	// with ErrCorruptObjects otherwise, e.g. after a flaky transfer or from
+	// a bad cache. With ForceReclone, a corrupt clone is cloned once more.
+	VerifyObjects bool
+	// CachePath is the path in Storage to an existing clone of the
+	// repository, e.g. from a previous build. If set and Path has no
+	// repository, the cached .git directory is copied and only the
+	// requested ref is fetched, instead of cloning from scratch. A full
+	// clone is used if the cache cannot be updated.
+	CachePath string
+	// ArchiveURL, if set, is the URL of a gzipped tarball snapshot of the
+	// repository that is extracted instead of cloning when Path is empty,
+	// which is much faster when history is not needed. No .git directory
+	// is created. ArchiveAuto derives the URL for GitHub and GitLab.
+	// RepoAuth, CABundle, Insecure and ProxyOptions apply to the download.
+	ArchiveURL string
+	// Transport, if set, is used for all requests to the remote instead of
+	// the go-git client for the URL's scheme, e.g. to add tracing, request
+	// signing or a custom dialer. It is only used by the CloneRepo call it
+	// is passed to, so concurrent clones may use different transports.
+	// Insecure, CABundle and ProxyOptions are ignored, and must be
+	// configured on the Transport itself.
+	Transport transport.Transport
+	// MaxBandwidth, if positive, limits the rate at which the clone reads
+	// packfiles from the remote to this many bytes per second, whatever
+	// the protocol. Fetches into the clone once it is done are not limited.
+	MaxBandwidth int64
+	// Cloner performs the clone in CloneRepo. If nil, GoGitCloner is used
+	// and all other options are supported. Other implementations may
+	// support only some of them.
+	Cloner Cloner
+	// Logger is used for diagnostic output while cloning. This is optional.
+	Logger log.Func
+	// LogPrefix labels log lines by phase. If nil, every line is prefixed
+	// with "#1:".
+	LogPrefix log.Prefixer
+	// ProgressReporter is notified as the clone moves from connecting to
+	// cloning to checking out. This is optional.
+	ProgressReporter log.ProgressReporter
+	// Verbose enables additional diagnostics which may require extra
+	// round-trips to the remote, such as protocol negotiation details.
+	Verbose bool
+	// Retries is the number of times a clone that failed with a transient
+	// error, such as a network error or an HTTP 5xx response, is retried.
+	Retries int
+	// RetryBackoff is the delay before the first retry, doubling for each
+	// subsequent retry up to 30 seconds. Defaults to one second.
+	RetryBackoff time.Duration
+	// RetryNoJitter disables jitter. By default each delay is picked at
+	// random between zero and the backoff, to avoid many clients retrying
+	// in lockstep.
+	RetryNoJitter bool
+	// RetrySeed seeds the jitter for deterministic tests. If zero, the
+	// jitter is seeded from the current time.
+	RetrySeed int64
+	// Mirrors are fallback URLs that are tried in order, with the same
+	// auth, if cloning RepoURL fails for any reason other than an
+	// authentication or authorization failure.
+	Mirrors []string
+	// GiteaHosts are the hostnames of self-hosted Gitea or Forgejo
+	// servers, whose pull requests are fetched from refs/pull/<id>/head
+	// for a #pr/<id> fragment. Hosts named after either are detected
+	// without being listed.
+	GiteaHosts []string
+	// HostTypes sets the type of hosts, by hostname, whose type
+	// DetectHostType cannot infer, such as self-hosted servers on custom
+	// domains.
+	HostTypes map[string]HostType
+	// FallbackAuth are tried in order, with the same URL, if the remote
+	// rejects RepoAuth, e.g. because an SSH key was revoked.
+	FallbackAuth []transport.AuthMethod
+	// SSHFallbackAuth, if set, is the HTTP auth used to clone the
+	// equivalent https:// URL when cloning an SSH RepoURL fails to connect
+	// or authenticate, e.g. without SSH egress. The HTTPS URL is recorded
+	// as the origin remote.
+	SSHFallbackAuth githttp.AuthMethod
+	// FollowRedirectCredentials controls whether HTTP credentials are sent
+	// to a different host after the remote redirects the clone. By default
+	// they are only ever sent to the host in RepoURL.
+	FollowRedirectCredentials bool
+	// MaxRedirects is the maximum number of HTTP redirects to follow. If
+	// zero, the net/http default of 10 applies. A negative value refuses
+	// all redirects. Exceeding it, or being redirected in a loop, fails the
+	// clone with ErrTooManyRedirects.
+	MaxRedirects int
+	// HTTPAnonymousFirst makes HTTP clones try without RepoAuth first and
+	// only send it once the remote rejects a request with 401. This suits
+	// servers that advertise refs anonymously but require credentials to
+	// download packs.
+	HTTPAnonymousFirst bool
+	// TagFilter is a glob, as understood by path.Match, restricting the tags
+	// fetched during the clone to those whose short name matches. If empty,
+	// go-git's default tag behavior applies.
+	TagFilter string
+	// RequiredPaths are paths, relative to the repository root, that must
+	// exist after a fresh clone. Glob patterns as understood by path.Match
+	// are supported, in which case at least one path must match. If one is
+	// missing, the clone is removed and ErrMissingRequiredPath returned.
+	RequiredPaths []string
+	// ExcludePaths are paths, relative to the repository root, that are
+	// deleted from the worktree after a fresh clone to keep the build
+	// context small. Unlike sparse checkout, their objects are still
+	// fetched. Glob patterns as understood by path.Match are supported. The
+	// .git directory is never deleted.
+	ExcludePaths []string
+	// AlternateObjectDirs are object directories in Storage, e.g. of a
+	// shared read-only cache, that the clone reads objects from through
+	// Git alternates instead of storing its own copy. Commits that are
+	// already present in one of them are not downloaded, while new objects
+	// are written to the clone. They must outlive the clone.
+	AlternateObjectDirs []string
+	// MaxResolveWorkers, if positive, bounds the threads used to resolve
+	// the fetched pack. CLIGitCloner passes it to git as pack.threads.
+	// go-git resolves a pack on a single goroutine, so GoGitCloner ignores
+	// it.
+	MaxResolveWorkers int
+	// CheckoutWorkers, if above one, is the number of goroutines that
+	// write files to the worktree in parallel. Otherwise go-git checks it
+	// out serially.
+	CheckoutWorkers int
+	// MismatchPolicy controls what happens when a repository already exists
+	// at Path but its origin URL or checked out branch differs from the
+	// requested one. Defaults to MismatchIgnore.
+	MismatchPolicy MismatchPolicy
+	// ProtocolVersion forces the Git wire protocol version. go-git only
+	// speaks v0, so ProtocolV2 is honored by CLIGitCloner alone. Defaults
+	// to ProtocolAuto.
+	ProtocolVersion ProtocolVersion
+	// ForceReclone removes an existing repository at Path, and everything
+	// else in Path, so that it is cloned again. By default an existing
+	// repository is left untouched.
+	ForceReclone bool
+	// WriteCommitGraph writes a commit-graph file after a fresh clone to
+	// speed up history traversal such as git log and git describe. It is
+	// skipped for shallow clones.
+	WriteCommitGraph bool
+	// AdditionalRemotes are added to a fresh clone and their branches
+	// fetched into refs/remotes/<name>/ after it, e.g. for the upstream of
+	// a fork.
+	AdditionalRemotes []AdditionalRemote
+	// CheckoutRemoteRef, if set, is a remote-tracking branch such as
+	// "upstream/main" that is checked out, detached, once the additional
+	// remotes are fetched, instead of the ref in RepoURL.
+	CheckoutRemoteRef string
+	// SafeDirectoryConfig, if set, is a global or system gitconfig in
+	// Storage that Path is added to as a safe.directory after cloning, so
+	// that git run by other users does not refuse the repository as having
+	// dubious ownership. See AddSafeDirectory.
+	SafeDirectoryConfig string
+	// SafeDirectoryWildcard adds SafeDirectoryAny to SafeDirectoryConfig
+	// instead of Path, trusting every repository.
+	SafeDirectoryWildcard bool
+	// Repack, if set, repacks the objects of a fresh clone with tuned
+	// delta settings, for workspaces that are rebuilt and fetched into
+	// often. It is skipped for shallow clones.
+	Repack *RepackConfig
 }
 
+// logf logs msg to opts.Logger, prefixed with the label for phase p. It is
+// a no-op if no Logger is set.
+func (opts CloneRepoOptions) logf(p log.Phase, l log.Level, msg string, args ...any) {
+	if opts.Logger == nil {
+		return
+	}
+	opts.logger().Scope(p)(l, msg, args...)
+}
+
+// logger returns Logger labeled with LogPrefix.
+func (opts CloneRepoOptions) logger() log.Logger {
+	return log.Logger{Func: opts.Logger, Prefix: opts.LogPrefix}
+}
+
+// ErrRefRequired is returned by CloneRepo with RequireExplicitRef when the
+// URL has no ref fragment.
+var ErrRefRequired = errors.New("a ref is required with single-branch clones")
+
+// ErrMissingRequiredPath is returned by CloneRepo when a fresh clone lacks
+// one of RequiredPaths. The clone has been removed, as described for
+// discardClone, so the next attempt checks again instead of using it.
+var ErrMissingRequiredPath = errors.New("repository is missing required path")
+
+// ErrDiskFull is returned by CloneRepo when the disk fills up during the
+// clone. The partially cloned repository has been removed, so the next
+// attempt does not mistake it for an existing clone.
+var ErrDiskFull = errors.New("disk full")
+
 // CloneRepo will clone the repository at the given URL into the given path.
 // If a repository is already initialized at the given path, it will not
 // be cloned again.
 //
+// If the clone fails and mirrors are configured, each mirror is tried in
+// order. The URL that was ultimately cloned is recorded as the origin
+// remote of the repository.
+//
+// If opts.ArchiveURL is set and opts.Path is empty, a tarball snapshot is
+// extracted instead and no .git directory is created. A normal clone is
+// used if the archive cannot be downloaded.
+//
 // The bool returned states whether the repository was cloned or not.
+//
+// The clone is done by opts.Cloner, or GoGitCloner if it is nil.
 func CloneRepo(ctx context.Context, opts CloneRepoOptions) (bool, error) {
-	parsed, err := giturls.Parse(opts.RepoURL)
+	result, err := cloneRepoResult(ctx, opts)
+	return result.Cloned, err
+}
+
+// cloneRepoResult implements CloneRepo, returning the result of the
+// Cloner.
+func cloneRepoResult(ctx context.Context, opts CloneRepoOptions) (CloneRepoResult, error) {
+	opts.Logger = log.Correlated(opts.Logger, log.CorrelationID(ctx))
+	if err := validateAdditionalRemotes(opts); err != nil {
+		return CloneRepoResult{}, err
+	}
+	cloner := opts.Cloner
+	if cloner == nil {
+		cloner = GoGitCloner{}
+	}
+	result, err := cloner.Clone(ctx, opts)
+	if err == nil && result.Cloned && opts.VerifyObjects {
+		err = verifyObjects(opts.Storage, opts.Path)
+		if errors.Is(err, ErrCorruptObjects) && opts.ForceReclone {
+			opts.logf(log.PhaseCloning, log.LevelWarn, "♻️ %s, cloning again", err)
+			result, err = cloner.Clone(ctx, opts)
+			if err == nil && result.Cloned {
+				err = verifyObjects(opts.Storage, opts.Path)
+			}
+		}
+	}
+	if err == nil && result.Cloned && (len(opts.AdditionalRemotes) > 0 || opts.CheckoutRemoteRef != "") {
+		err = fetchAdditionalRemotes(ctx, opts)
+	}
+	if err == nil && result.Cloned && len(opts.SubmoduleURLRewrites) > 0 {
+		err = rewriteSubmoduleURLs(opts)
+	}
+	if err == nil && opts.SafeDirectoryConfig != "" {
+		dir := opts.Path
+		if opts.SafeDirectoryWildcard {
+			dir = SafeDirectoryAny
+		}
+		if err = AddSafeDirectory(opts.Storage, opts.SafeDirectoryConfig, dir); err == nil {
+			opts.logf(log.PhaseCloning, log.LevelInfo, "🛡️ Added %s to safe.directory in %s", dir, opts.SafeDirectoryConfig)
+		}
+	}
+	return result, err
+}
+
+// CloneRepoWithHandle is like CloneRepo, but also returns the repository
+// at opts.Path, opened on opts.Storage, for callers that go on to read its
+// config or walk its history. It is returned whether or not the repository
+// was cloned, and is nil if there is no .git directory, e.g. after an
+// archive was extracted or with PruneRemove. Like any go-git Repository,
+// it must not be used concurrently with other operations on the same
+// repository, such as another CloneRepo at opts.Path.
+func CloneRepoWithHandle(ctx context.Context, opts CloneRepoOptions) (*git.Repository, bool, error) {
+	result, err := cloneRepoResult(ctx, opts)
+	if err != nil {
+		return nil, result.Cloned, err
+	}
+	if result.Repository != nil || opts.Cloner == nil {
+		return result.Repository, result.Cloned, nil
+	}
+	// Other Cloners need not set the repository in their result.
+	repo, err := openRepo(opts.Storage, opts.Path)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil, result.Cloned, nil
+	}
+	if err != nil {
+		return nil, result.Cloned, err
+	}
+	return repo, result.Cloned, nil
+}
+
+// Cloner clones a repository as described by CloneRepoOptions. It may be
+// implemented to clone with something other than go-git, e.g. the git
+// CLI, and set as CloneRepoOptions.Cloner.
+type Cloner interface {
+	// Clone clones opts.RepoURL into opts.Path, or leaves an existing
+	// repository there as is, and returns the result.
+	Clone(ctx context.Context, opts CloneRepoOptions) (CloneRepoResult, error)
+}
+
+// GoGitCloner is the default Cloner, which clones with go-git.
+type GoGitCloner struct{}
+
+// Clone implements Cloner. For archives and empty repositories, which
+// have no commit checked out, only Cloned is set in the result.
+func (GoGitCloner) Clone(ctx context.Context, opts CloneRepoOptions) (CloneRepoResult, error) {
+	cloned, err := cloneRepoGoGit(ctx, opts)
+	if err != nil {
+		return CloneRepoResult{Cloned: cloned}, err
+	}
+	result, err := ResolveCloneResult(opts.Storage, opts.Path)
+	if errors.Is(err, git.ErrRepositoryNotExists) || errors.Is(err, plumbing.ErrReferenceNotFound) {
+		err = nil
+	}
+	result.Cloned = cloned
+	return result, err
+}
+
+// checkExplicitRef returns ErrRefRequired if opts.RequireExplicitRef
+// applies and opts.RepoURL has no ref.
+func checkExplicitRef(opts CloneRepoOptions) error {
+	if _, ref, _ := strings.Cut(opts.RepoURL, "#"); ref == "" && opts.SingleBranch && opts.RequireExplicitRef {
+		return fmt.Errorf("%w: add #<ref> to %s", ErrRefRequired, redactURL(opts.RepoURL))
+	}
+	return nil
+}
+
+// cloneRepoGoGit implements GoGitCloner. It returns whether the
+// repository was cloned.
+func cloneRepoGoGit(ctx context.Context, opts CloneRepoOptions) (bool, error) {
+	// Checked up front so that neither the archive nor a mirror is cloned
+	// at its default branch instead.
+	if err := checkExplicitRef(opts); err != nil {
+		return false, err
+	}
+	if opts.ArchiveURL != "" {
+		if cloned, err := cloneFromArchive(ctx, opts); cloned || err != nil {
+			return cloned, err
+		}
+	}
+	var rng *rand.Rand
+	if !opts.RetryNoJitter {
+		seed := opts.RetrySeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		rng = rand.New(rand.NewSource(seed))
+	}
+	cloned, err := cloneRepoWithRetry(ctx, opts, rng)
+	if err != nil && !cloned && len(opts.FallbackAuth) > 0 {
+		cloned, err = cloneWithFallbackAuth(ctx, opts, rng, err)
+	}
+	if err != nil && !cloned && opts.SSHFallbackAuth != nil {
+		cloned, err = cloneSSHOverHTTPS(ctx, opts, rng, err)
+	}
+	for _, mirror := range opts.Mirrors {
+		if err == nil || !shouldTryMirror(ctx, err) {
+			break
+		}
+		opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Failed to clone %s, trying mirror %s: %s", redactURL(opts.RepoURL), redactURL(mirror), err)
+		// Remove any partially fetched repository so that the next attempt
+		// does not mistake it for an existing clone.
+		if rmErr := util.RemoveAll(opts.Storage, filepath.Join(opts.Path, ".git")); rmErr != nil {
+			return false, fmt.Errorf("clean up failed clone: %w", rmErr)
+		}
+		mirrorOpts := opts
+		mirrorOpts.RepoURL = mirror
+		cloned, err = cloneRepoWithRetry(ctx, mirrorOpts, rng)
+		if err == nil {
+			opts.logf(log.PhaseCloning, log.LevelInfo, "🪞 Cloned repository from mirror %s", redactURL(mirror))
+		}
+	}
+	if err != nil && isDiskFull(err) {
+		return false, removeDiskFullClone(opts, err)
+	}
+	return cloned, err
+}
+
+// cloneWithFallbackAuth retries the clone of opts.RepoURL that failed
+// with err with each of opts.FallbackAuth in turn, for as long as the
+// remote rejects the credentials. Otherwise err is returned as is.
+func cloneWithFallbackAuth(ctx context.Context, opts CloneRepoOptions, rng *rand.Rand, err error) (bool, error) {
+	cloned := false
+	rejected := opts.RepoAuth
+	for _, auth := range opts.FallbackAuth {
+		if cloned || ctx.Err() != nil || !isAuthError(err) {
+			break
+		}
+		opts.logf(log.PhaseCloning, log.LevelWarn, "🔑 Authentication with %s was rejected, trying %s: %s", describeAuth(rejected), describeAuth(auth), err)
+		if rmErr := util.RemoveAll(opts.Storage, filepath.Join(opts.Path, ".git")); rmErr != nil {
+			return false, fmt.Errorf("clean up failed clone: %w", rmErr)
+		}
+		authOpts := opts
+		authOpts.RepoAuth = auth
+		cloned, err = cloneRepoWithRetry(ctx, authOpts, rng)
+		if err == nil {
+			opts.logf(log.PhaseCloning, log.LevelInfo, "🔑 Cloned repository with %s", describeAuth(auth))
+		}
+		rejected = auth
+	}
+	return cloned, err
+}
+
+// cloneSSHOverHTTPS retries the SSH clone of opts.RepoURL that failed
+// with err over HTTPS with opts.SSHFallbackAuth, if err means that the SSH
+// host could not be reached or refused the credentials. Otherwise err is
+// returned as is.
+func cloneSSHOverHTTPS(ctx context.Context, opts CloneRepoOptions, rng *rand.Rand, err error) (bool, error) {
+	httpsURL, ok := httpsURLForSSH(opts.RepoURL)
+	if !ok || ctx.Err() != nil || !isSSHConnectError(err) {
+		return false, err
+	}
+	opts.logf(log.PhaseCloning, log.LevelWarn, "🔁 Failed to clone %s over SSH, retrying over HTTPS at %s: %s", redactURL(opts.RepoURL), redactURL(httpsURL), err)
+	if rmErr := util.RemoveAll(opts.Storage, filepath.Join(opts.Path, ".git")); rmErr != nil {
+		return false, fmt.Errorf("clean up failed clone: %w", rmErr)
+	}
+	httpsOpts := opts
+	httpsOpts.RepoURL = httpsURL
+	httpsOpts.RepoAuth = opts.SSHFallbackAuth
+	cloned, httpsErr := cloneRepoWithRetry(ctx, httpsOpts, rng)
+	if httpsErr != nil {
+		return cloned, fmt.Errorf("%w (over SSH: %s)", httpsErr, err)
+	}
+	opts.logf(log.PhaseCloning, log.LevelInfo, "🔁 Cloned repository over HTTPS from %s", redactURL(httpsURL))
+	return cloned, nil
+}
+
+// httpsURLForSSH returns the https:// URL of the same repository as the
+// SSH URL repoURL, scp-like or not, on the default port and without the
+// user. It returns false if repoURL is not an SSH URL.
+func httpsURLForSSH(repoURL string) (string, bool) {
+	normalized, err := NormalizeGitURL(repoURL)
+	if err != nil {
+		return "", false
+	}
+	u, err := url.Parse(normalized)
+	if err != nil || u.Scheme != "ssh" || u.Hostname() == "" {
+		return "", false
+	}
+	u.Scheme = "https"
+	u.User = nil
+	u.Host = withPort(u.Hostname(), "")
+	return u.String(), true
+}
+
+// isSSHConnectError reports whether a failed SSH clone did not get as far
+// as talking to Git: the host could not be reached, the handshake failed
+// or the credentials were refused.
+func isSSHConnectError(err error) bool {
+	var netErr net.Error
+	return isAuthError(err) || errors.As(err, &netErr) || errors.Is(err, syscall.ECONNREFUSED) ||
+		strings.Contains(err.Error(), "ssh: handshake failed")
+}
+
+// isDiskFull reports whether err was caused by the disk filling up. go-git
+// does not always wrap errors, so the message is checked too.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || strings.Contains(err.Error(), syscall.ENOSPC.Error())
+}
+
+// removeDiskFullClone removes the .git directory left behind by a clone
+// that failed with err because the disk filled up, and returns an
+// ErrDiskFull wrapping err.
+func removeDiskFullClone(opts CloneRepoOptions, err error) error {
+	if rmErr := util.RemoveAll(opts.Storage, filepath.Join(opts.Path, ".git")); rmErr != nil {
+		return fmt.Errorf("%w: %w (clean up failed clone: %s)", ErrDiskFull, err, rmErr)
+	}
+	opts.logf(log.PhaseCloning, log.LevelWarn, "🧹 Ran out of disk space, removed the partial clone at %s", opts.Path)
+	return fmt.Errorf("%w: %w", ErrDiskFull, err)
+}
+
+// shouldTryMirror reports whether a failed clone should be retried against
+// a mirror. Authentication failures indicate a credential problem, a full
+// disk a local one, and too many files or a missing required path the
+// repository itself, that a mirror will not fix.
+func shouldTryMirror(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return !isAuthError(err) && !isDiskFull(err) && !errors.Is(err, ErrTooManyFiles) && !errors.Is(err, ErrMissingRequiredPath)
+}
+
+// unsupportedCapabilitiesMu guards transport.UnsupportedCapabilities while
+// it is overridden by withUnsupportedCapabilities.
+var unsupportedCapabilitiesMu sync.Mutex
+
+// defaultUnsupportedCapabilities is go-git's transport.UnsupportedCapabilities,
+// copied before any clone can override it.
+var defaultUnsupportedCapabilities = slices.Clone(transport.UnsupportedCapabilities)
+
+// withUnsupportedCapabilities runs fn with transport.UnsupportedCapabilities
+// set to caps, restoring the previous value once fn returns. Concurrent
+// callers are serialized so that each sees its own value.
+func withUnsupportedCapabilities(caps []capability.Capability, fn func() error) error {
+	unsupportedCapabilitiesMu.Lock()
+	defer unsupportedCapabilitiesMu.Unlock()
+	saved := transport.UnsupportedCapabilities
+	transport.UnsupportedCapabilities = caps
+	defer func() {
+		transport.UnsupportedCapabilities = saved
+	}()
+	return fn()
+}
+
+func isAuthError(err error) bool {
+	return errors.Is(err, transport.ErrAuthenticationRequired) ||
+		errors.Is(err, transport.ErrAuthorizationFailed) ||
+		strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// cloneGitConfig returns the config written to the cloned repository:
+// opts.GitConfig along with the URL rewrites and checkout settings.
+func cloneGitConfig(opts CloneRepoOptions) (map[string]string, error) {
+	gitConfig := make(map[string]string, len(opts.GitConfig)+len(opts.URLRewrites))
+	for prefix, replacement := range opts.URLRewrites {
+		gitConfig["url."+replacement+".insteadOf"] = prefix
+	}
+	for key, value := range opts.GitConfig {
+		gitConfig[key] = value
+	}
+	if opts.AutoCRLF != "" {
+		setGitConfig(gitConfig, "core.autocrlf", opts.AutoCRLF)
+	}
+	if opts.DisableSymlinks {
+		setGitConfig(gitConfig, "core.symlinks", "false")
+	}
+	for key := range gitConfig {
+		if _, _, _, err := parseGitConfigKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return gitConfig, nil
+}
+
+func cloneRepo(ctx context.Context, opts CloneRepoOptions) (bool, error) {
+	repoURL := RewriteGitURL(opts.RepoURL, opts.URLRewrites)
+	if repoURL != opts.RepoURL {
+		opts.logf(log.PhaseConnecting, log.LevelInfo, "🔀 Rewrote Git URL %s to %s", redactURL(opts.RepoURL), redactURL(repoURL))
+	}
+	normalized, err := NormalizeGitURL(repoURL)
+	if err != nil {
+		return false, err
+	}
+	gitConfig, err := cloneGitConfig(opts)
+	if err != nil {
+		return false, err
+	}
+	checkout, err := checkoutSettingsFromConfig(gitConfig)
+	if err != nil {
+		return false, err
+	}
+	checkout.attributes = opts.ApplyAttributes
+	if err := opts.PruneMode.Validate(); err != nil {
+		return false, err
+	}
+	if err := opts.MismatchPolicy.Validate(); err != nil {
+		return false, err
+	}
+	if err := opts.ProtocolVersion.Validate(); err != nil {
+		return false, err
+	}
+	if err := opts.validateHostTypes(); err != nil {
+		return false, err
+	}
+	if opts.ProtocolVersion == ProtocolV2 {
+		opts.logf(log.PhaseConnecting, log.LevelWarn, "⚠️ go-git does not support Git protocol v2, cloning %s over v0 instead", redactURL(opts.RepoURL))
+	}
+	if opts.TagFilter != "" {
+		if _, err := path.Match(opts.TagFilter, ""); err != nil {
+			return false, fmt.Errorf("invalid tag filter %q: %w", opts.TagFilter, err)
+		}
+	}
+	for _, p := range opts.RequiredPaths {
+		if _, err := path.Match(p, ""); err != nil {
+			return false, fmt.Errorf("invalid required path %q: %w", p, err)
+		}
+	}
+	for _, p := range opts.ExcludePaths {
+		if _, err := path.Match(p, ""); err != nil {
+			return false, fmt.Errorf("invalid exclude path %q: %w", p, err)
+		}
+	}
+	if err := checkAlternateObjectDirs(opts); err != nil {
+		return false, err
+	}
+	if opts.ResolveHostToIP != "" && net.ParseIP(opts.ResolveHostToIP) == nil {
+		return false, fmt.Errorf("invalid IP address %q to resolve the Git host to", opts.ResolveHostToIP)
+	}
+	var parsed *url.URL
+	if strings.HasPrefix(normalized, "gits://") {
+		// giturls does not know the scheme and would treat it as scp-like.
+		parsed, err = url.Parse(normalized)
+	} else {
+		parsed, err = giturls.Parse(normalized)
+	}
 	if err != nil {
 		return false, fmt.Errorf("parse url %q: %w", opts.RepoURL, err)
 	}
-	if parsed.Hostname() == "dev.azure.com" {
+	if parsed.Scheme == "ssh" && parsed.Port() == "" && opts.SSHPort > 0 {
+		parsed.Host = net.JoinHostPort(parsed.Hostname(), strconv.Itoa(opts.SSHPort))
+	}
+	// unsupportedCaps overrides transport.UnsupportedCapabilities for the
+	// duration of the clone, if set.
+	var unsupportedCaps []capability.Capability
+	if opts.hostType(parsed.Hostname()) == HostAzureDevOps {
 		// Azure DevOps requires capabilities multi_ack / multi_ack_detailed,
 		// which are not fully implemented and by default are included in
 		// transport.UnsupportedCapabilities.
@@ -67,98 +757,2475 @@ func CloneRepo(ctx context.Context, opts CloneRepoOptions) (bool, error) {
 		//
 		// New commits and pushes against a remote worked without any issues.
 		// See: https://github.com/go-git/go-git/issues/64
-		//
-		// This is knowingly not safe to call in parallel, but it seemed
-		// like the least-janky place to add a super janky hack.
-		transport.UnsupportedCapabilities = []capability.Capability{
+		unsupportedCaps = []capability.Capability{
 			capability.ThinPack,
 		}
 	}
 
-	err = opts.Storage.MkdirAll(opts.Path, 0o755)
+	err = opts.Storage.MkdirAll(opts.Path, 0o755)
+	if err != nil {
+		return false, fmt.Errorf("mkdir %q: %w", opts.Path, err)
+	}
+	requestedRef := parsed.Fragment
+	reference := requestedRef
+	pullRequest := pullRequestID(requestedRef)
+	commitRef := isCommitRef(requestedRef)
+	if pullRequest != "" || commitRef {
+		// The pull request is fetched on top of the default branch, and
+		// commits are looked up in all branches.
+		reference = ""
+	}
+	singleBranch := opts.SingleBranch && !commitRef
+	if reference == "" && singleBranch {
+		reference = "refs/heads/main"
+	}
+	parsed.RawFragment = ""
+	parsed.Fragment = ""
+	if opts.ForceReclone {
+		if err := removeExistingRepo(opts, parsed.String()); err != nil {
+			return false, err
+		}
+	} else if existing, err := openRepo(opts.Storage, opts.Path); err == nil {
+		if done, err := handleMismatch(ctx, existing, opts, parsed.String(), requestedRef); done || err != nil {
+			return false, err
+		}
+	}
+	fs, err := opts.Storage.Chroot(opts.Path)
+	if err != nil {
+		return false, fmt.Errorf("chroot %q: %w", opts.Path, err)
+	}
+	gitDir, err := fs.Chroot(".git")
+	if err != nil {
+		return false, fmt.Errorf("chroot .git: %w", err)
+	}
+	gitStorage := newStorage(gitDir, opts.Storage)
+	worktree := checkout.worktree(limitFiles(fs, opts.MaxFiles))
+	fsStorage := filesystem.NewStorage(fs, cache.NewObjectLRU(cache.DefaultMaxSize*10))
+	repo, err := git.Open(fsStorage, gitDir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		err = nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("open %q: %w", opts.RepoURL, err)
+	}
+	if repo != nil {
+		return false, nil
+	}
+	// Anything in opts.Path before the clone is kept if it is discarded.
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		return false, fmt.Errorf("read dir %q: %w", opts.Path, err)
+	}
+	wasEmpty := len(entries) == 0
+	if opts.TempDir != "" {
+		var cleanup func()
+		gitDir, cleanup, err = withTempDir(gitDir, opts)
+		if err != nil {
+			return false, err
+		}
+		defer cleanup()
+		gitStorage = newStorage(gitDir, opts.Storage)
+	}
+	if len(opts.AlternateObjectDirs) > 0 {
+		// Written before the fetch, so that go-git skips commits it finds
+		// in the alternates.
+		if err := writeAlternates(gitDir, opts.AlternateObjectDirs); err != nil {
+			return false, err
+		}
+	}
+
+	connectURL, opts := pinHost(parsed, opts)
+	ctx, auth := connectAuth(ctx, connectURL, opts)
+	_, sshTimeout := auth.(*sshAuthWithTimeout)
+
+	if opts.Verbose && opts.Logger != nil {
+		logProtocolInfo(ctx, opts.logger().Scope(log.PhaseConnecting), parsed.String(), auth, unsupportedCaps, opts)
+	}
+
+	log.ReportPhase(opts.ProgressReporter, log.PhaseConnecting)
+	progress := opts.Progress
+	var phases *phaseWriter
+	if opts.ProgressReporter != nil {
+		phases = &phaseWriter{w: progress, reporter: opts.ProgressReporter}
+		progress = phases
+	}
+
+	tags := git.InvalidTagMode
+	if opts.TagFilter != "" {
+		// Matching tags are fetched explicitly once the clone completes.
+		tags = git.NoTags
+	}
+
+	cloneURL := connectURL.String()
+	if parsed.Scheme == "ssh" && opts.Resolver != nil {
+		sshAuth, ok := auth.(gitssh.AuthMethod)
+		if !ok {
+			// Host keys could not be checked against the real host.
+			return false, errors.New("a custom DNS resolver requires SSH auth to be configured")
+		}
+		resolved, resolvedAuth, err := resolveSSHURL(ctx, parsed, sshAuth, opts.Resolver, opts.logger().Scope(log.PhaseConnecting))
+		if err != nil {
+			return false, err
+		}
+		cloneURL, auth = resolved.String(), resolvedAuth
+	}
+	if parsed.Scheme == "gits" {
+		tunnel, err := newGitTLSTunnel(ctx, parsed, opts)
+		if err != nil {
+			return false, err
+		}
+		defer tunnel.Close()
+		cloneURL = tunnel.URL(parsed)
+	}
+	escalation := escalationPolicy(ctx)
+	if opts.Transport != nil || opts.MaxBandwidth > 0 || sshTimeout || escalation != nil {
+		t := opts.Transport
+		if opts.MaxBandwidth > 0 {
+			t = newThrottledTransport(t, opts.MaxBandwidth)
+			opts.logf(log.PhaseConnecting, log.LevelInfo, "🐢 Limiting the clone to %s/s", formatBytes(opts.MaxBandwidth))
+		}
+		if sshTimeout {
+			t = &sshHandshakeTransport{Transport: t, timeout: opts.SSHDialTimeout}
+		}
+		if escalation != nil {
+			t = &authEscalationTransport{Transport: t, policy: escalation}
+		}
+		var uninstall func()
+		cloneURL, uninstall, err = installTransport(t, cloneURL, opts.Transport != nil)
+		if err != nil {
+			return false, err
+		}
+		defer uninstall()
+	}
+
+	var pullRequestRef plumbing.ReferenceName
+	if pullRequest != "" {
+		pullRequestRef, err = findPullRequestRef(ctx, cloneURL, parsed, pullRequest, auth, opts)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if commitRef {
+		refs, err := listRemoteRefs(ctx, cloneURL, auth, opts)
+		if err != nil && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			return false, err
+		}
+		// As with git, a branch or tag named like a SHA takes precedence
+		// over the commits it is a prefix of.
+		if name, _, err := advertisedHead(refs, plumbing.ReferenceName(requestedRef)); err == nil {
+			commitRef = false
+			reference = name.String()
+			singleBranch = opts.SingleBranch
+		}
+	}
+
+	var advertised plumbing.Hash
+	// A commit pins the content by itself.
+	if (opts.VerifyHead || opts.VerifyHeadStrict) && !commitRef {
+		name := plumbing.ReferenceName(reference)
+		if pullRequestRef != "" {
+			name = pullRequestRef
+		}
+		advertised, err = listAdvertisedHead(ctx, cloneURL, name, auth, opts)
+		if err != nil {
+			return false, fmt.Errorf("verify head: %w", err)
+		}
+	}
+
+	clone := func() error {
+		repo, err = git.CloneContext(ctx, gitStorage, worktree, &git.CloneOptions{
+			URL:             cloneURL,
+			Auth:            auth,
+			Progress:        progress,
+			ReferenceName:   plumbing.ReferenceName(reference),
+			InsecureSkipTLS: opts.Insecure,
+			Depth:           opts.Depth,
+			SingleBranch:    singleBranch,
+			CABundle:        opts.CABundle,
+			ProxyOptions:    opts.ProxyOptions,
+			Tags:            tags,
+			// The worktree is checked out below so that the checkout phase can
+			// be reported separately from the fetch.
+			NoCheckout: true,
+		})
+		return err
+	}
+	// Azure DevOps cannot serve incremental fetches, see above.
+	if opts.CachePath != "" && pullRequest == "" && unsupportedCaps == nil {
+		repo = cloneFromCache(ctx, worktree, cloneURL, parsed.String(), requestedRef, tags, auth, opts)
+	}
+	if repo == nil {
+		if unsupportedCaps != nil {
+			err = withUnsupportedCapabilities(unsupportedCaps, clone)
+		} else {
+			err = clone()
+		}
+		if errors.Is(err, git.ErrRepositoryAlreadyExists) {
+			return false, nil
+		}
+		if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+			// go-git has initialized the repository and added origin, so
+			// the first commit can simply be pushed from the worktree.
+			opts.logf(log.PhaseCloning, log.LevelInfo, "📭 Repository %s has no commits yet, leaving the worktree empty", redactURL(opts.RepoURL))
+			if cloneURL != parsed.String() {
+				if err := setOriginURL(repo, parsed.String()); err != nil {
+					return true, err
+				}
+			}
+			if len(gitConfig) > 0 {
+				if err := applyGitConfig(repo, gitConfig); err != nil {
+					return true, fmt.Errorf("set git config: %w", err)
+				}
+			}
+			return true, nil
+		}
+		if err != nil {
+			if sshTimeout && ctx.Err() == nil && isTimeout(err) {
+				return false, fmt.Errorf("failed to connect to SSH host within %s: %w", opts.SSHDialTimeout, err)
+			}
+			return false, fmt.Errorf("clone %q: %w", opts.RepoURL, err)
+		}
+	}
+	if pullRequestRef != "" {
+		if err := fetchPullRequest(ctx, repo, pullRequestRef, pullRequest, auth, opts); err != nil {
+			// Without the pull request, HEAD is still the default branch.
+			if rmErr := discardClone(opts, fs, wasEmpty); rmErr != nil {
+				return true, fmt.Errorf("%w (clean up failed clone: %s)", err, rmErr)
+			}
+			return false, err
+		}
+	}
+	if commitRef {
+		hash, err := resolveCommit(repo, requestedRef)
+		if err != nil {
+			// Leave no clone behind that the next run would take for one
+			// at the requested commit.
+			err = shallowRefError(requestedRef, opts.Depth, err)
+			if rmErr := discardClone(opts, fs, wasEmpty); rmErr != nil {
+				return true, fmt.Errorf("%w (clean up failed clone: %s)", err, rmErr)
+			}
+			return false, err
+		}
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, hash)); err != nil {
+			return true, fmt.Errorf("set HEAD: %w", err)
+		}
+	}
+	if phases != nil {
+		phases.cloning()
+	}
+	log.ReportPhase(opts.ProgressReporter, log.PhaseCheckingOut)
+	escapingLinks, err := checkHeadPaths(repo, opts)
+	if errors.Is(err, ErrUnsafePath) {
+		// Leave nothing behind that the next run takes for a clone.
+		if rmErr := util.RemoveAll(opts.Storage, filepath.Join(opts.Path, ".git")); rmErr != nil {
+			return true, fmt.Errorf("%w (clean up failed clone: %s)", err, rmErr)
+		}
+		return false, err
+	}
+	if err != nil {
+		return true, err
+	}
+	if cfs, ok := worktree.(*checkoutFS); ok && checkout.attributes {
+		if err := loadHeadAttributes(repo, cfs, opts); err != nil {
+			return true, err
+		}
+	}
+	if err := checkoutWorktree(repo, gitDir, opts); err != nil {
+		if errors.Is(err, ErrTooManyFiles) {
+			if rmErr := discardClone(opts, fs, wasEmpty); rmErr != nil {
+				return true, fmt.Errorf("%w (clean up failed clone: %s)", err, rmErr)
+			}
+			opts.logf(log.PhaseCheckingOut, log.LevelError, "🗃️ Aborted the checkout of %s: %s", redactURL(opts.RepoURL), err)
+			return false, err
+		}
+		return true, fmt.Errorf("checkout %q: %w", opts.RepoURL, err)
+	}
+	if err := removeEscapingSymlinks(fs, escapingLinks, opts); err != nil {
+		return true, err
+	}
+	if !advertised.IsZero() {
+		if err := verifyHead(repo, advertised, opts); err != nil {
+			return true, err
+		}
+		gitConfig[advertisedHeadKey] = advertised.String()
+	}
+	if err := checkRequiredPaths(fs, opts.RequiredPaths); err != nil {
+		if rmErr := discardClone(opts, fs, wasEmpty); rmErr != nil {
+			return true, fmt.Errorf("%w (clean up failed clone: %s)", err, rmErr)
+		}
+		return false, err
+	}
+	if err := removeExcludedPaths(fs, opts); err != nil {
+		return true, err
+	}
+	if opts.TagFilter != "" {
+		if err := fetchTags(ctx, repo, auth, opts); err != nil {
+			return true, err
+		}
+	}
+	if cloneURL != parsed.String() {
+		// Record the real remote rather than the local tunnel or private
+		// transport scheme, now that nothing else is fetched through it.
+		if err := setOriginURL(repo, parsed.String()); err != nil {
+			return true, err
+		}
+	}
+	if len(gitConfig) > 0 {
+		if err := applyGitConfig(repo, gitConfig); err != nil {
+			return true, fmt.Errorf("set git config: %w", err)
+		}
+	}
+	optimizeGitDir(opts)
+	return true, nil
+}
+
+// optimizeGitDir writes the commit-graph, repacks and prunes the .git
+// directory of a fresh clone as configured in opts. All are best-effort,
+// so failures are only logged.
+func optimizeGitDir(opts CloneRepoOptions) {
+	if opts.Repack != nil && opts.PruneMode != PruneRemove {
+		reclaimed, err := RepackGitDir(opts.Storage, opts.Path, *opts.Repack)
+		logRepack(opts, reclaimed, err)
+	}
+	if opts.WriteCommitGraph && opts.PruneMode != PruneRemove {
+		n, err := WriteCommitGraph(opts.Storage, opts.Path)
+		// Like pruning, the commit-graph is an optimization and failing to
+		// write it does not fail the clone.
+		switch {
+		case errors.Is(err, ErrCommitGraphShallow):
+			opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Skipping commit-graph: %s", err)
+		case err != nil:
+			opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Failed to write commit-graph: %s", err)
+		default:
+			opts.logf(log.PhaseCloning, log.LevelInfo, "📈 Wrote commit-graph for %d commits", n)
+		}
+	}
+	if opts.PruneMode != "" && opts.PruneMode != PruneNone {
+		reclaimed, err := PruneGitDir(opts.Storage, opts.Path, opts.PruneMode)
+		// Pruning is best-effort, the clone itself succeeded.
+		if err != nil {
+			opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Failed to prune .git directory: %s", err)
+		} else {
+			opts.logf(log.PhaseCloning, log.LevelInfo, "🧹 Pruned .git directory (%s), reclaimed %s", opts.PruneMode, formatBytes(reclaimed))
+		}
+	}
+}
+
+// logRepack logs the outcome of repacking a fresh clone. Like pruning,
+// repacking is an optimization and failing does not fail the clone.
+func logRepack(opts CloneRepoOptions, reclaimed int64, err error) {
+	switch {
+	case errors.Is(err, ErrRepackShallow):
+		opts.logf(log.PhaseCloning, log.LevelInfo, "📦 Skipping repack: %s", err)
+	case err != nil:
+		opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Failed to repack objects: %s", err)
+	default:
+		opts.logf(log.PhaseCloning, log.LevelInfo, "📦 Repacked objects, reclaimed %s", formatBytes(reclaimed))
+	}
+}
+
+// discardClone removes the clone at opts.Path, whose worktree is fs, so
+// that the next run does not take a clone that failed its checks for a
+// good one. If the directory was empty before the clone, all of it was
+// written by the clone and it is emptied again. Otherwise only the .git
+// directory is removed, since the checked out files cannot be told apart
+// from those that were already there.
+func discardClone(opts CloneRepoOptions, fs billy.Filesystem, wasEmpty bool) error {
+	if wasEmpty {
+		return emptyDir(fs)
+	}
+	return util.RemoveAll(opts.Storage, filepath.Join(opts.Path, ".git"))
+}
+
+// checkRequiredPaths returns an error naming the first of required that
+// has no match in the worktree fs.
+func checkRequiredPaths(fs billy.Filesystem, required []string) error {
+	for _, p := range required {
+		matches, err := util.Glob(fs, filepath.FromSlash(strings.TrimPrefix(p, "/")))
+		if err != nil {
+			return fmt.Errorf("match required path %q: %w", p, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("%w %q", ErrMissingRequiredPath, p)
+		}
+	}
+	return nil
+}
+
+// removeExcludedPaths deletes the paths in the worktree fs matching
+// opts.ExcludePaths, except for the .git directory.
+func removeExcludedPaths(fs billy.Filesystem, opts CloneRepoOptions) error {
+	for _, p := range opts.ExcludePaths {
+		matches, err := util.Glob(fs, filepath.FromSlash(strings.TrimPrefix(p, "/")))
+		if err != nil {
+			return fmt.Errorf("match exclude path %q: %w", p, err)
+		}
+		for _, match := range matches {
+			if match == ".git" || strings.HasPrefix(filepath.ToSlash(match), ".git/") {
+				continue
+			}
+			if err := util.RemoveAll(fs, match); err != nil {
+				return fmt.Errorf("remove excluded path %q: %w", match, err)
+			}
+			opts.logf(log.PhaseCheckingOut, log.LevelInfo, "✂️ Removed excluded path %s", filepath.ToSlash(match))
+		}
+	}
+	return nil
+}
+
+// fetchTags fetches the tags on origin matching opts.TagFilter. A refspec
+// is built for each matching tag so that no other tags are transferred.
+func fetchTags(ctx context.Context, repo *git.Repository, auth transport.AuthMethod, opts CloneRepoOptions) error {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return fmt.Errorf("get origin: %w", err)
+	}
+	refs, err := remote.ListContext(ctx, &git.ListOptions{
+		Auth:            auth,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+	})
+	if err != nil {
+		return fmt.Errorf("list remote refs: %w", err)
+	}
+	var refSpecs []config.RefSpec
+	for _, ref := range refs {
+		if !ref.Name().IsTag() {
+			continue
+		}
+		// The pattern was validated up front, so the error can be ignored.
+		if ok, _ := path.Match(opts.TagFilter, ref.Name().Short()); ok {
+			refSpecs = append(refSpecs, config.RefSpec(fmt.Sprintf("+%s:%s", ref.Name(), ref.Name())))
+		}
+	}
+	if len(refSpecs) == 0 {
+		return nil
+	}
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs:        refSpecs,
+		Auth:            auth,
+		Depth:           opts.Depth,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+		Tags:            git.NoTags,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("fetch tags matching %q: %w", opts.TagFilter, err)
+	}
+	return nil
+}
+
+// ErrPullRequestNotFound is returned by CloneRepo when the pull request
+// referenced by the URL fragment does not exist on the remote.
+var ErrPullRequestNotFound = errors.New("pull request not found")
+
+// pullRequestFragment matches URL fragments referencing a pull request,
+// e.g. "pr/123".
+var pullRequestFragment = regexp.MustCompile(`^pr/([0-9]+)$`)
+
+// pullRequestID returns the pull request number referenced by fragment, or
+// an empty string if it does not reference one.
+func pullRequestID(fragment string) string {
+	m := pullRequestFragment.FindStringSubmatch(fragment)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// pullRequestRefs returns the refs that pull request id may be published
+// under on u, a server of type hostType. Servers of unknown type are
+// checked for each known layout.
+func pullRequestRefs(u *url.URL, id string, hostType HostType) []plumbing.ReferenceName {
+	// Gitea and Forgejo use the same layout as GitHub.
+	github := plumbing.ReferenceName("refs/pull/" + id + "/head")
+	gitlab := plumbing.ReferenceName("refs/merge-requests/" + id + "/head")
+	bitbucket := plumbing.ReferenceName("refs/pull-requests/" + id + "/from")
+	if hostType == HostUnknown && strings.HasPrefix(u.Path, "/scm/") {
+		// Bitbucket Server serves repositories below /scm/.
+		hostType = HostBitbucket
+	}
+	switch hostType {
+	case HostGitHub, HostGitea:
+		return []plumbing.ReferenceName{github}
+	case HostGitLab:
+		return []plumbing.ReferenceName{gitlab}
+	case HostBitbucket:
+		return []plumbing.ReferenceName{bitbucket}
+	default:
+		return []plumbing.ReferenceName{github, gitlab, bitbucket}
+	}
+}
+
+// findPullRequestRef lists the refs at cloneURL and returns the one that
+// pull request id is published under.
+func findPullRequestRef(ctx context.Context, cloneURL string, parsed *url.URL, id string, auth transport.AuthMethod, opts CloneRepoOptions) (plumbing.ReferenceName, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{cloneURL},
+	})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{
+		Auth:            auth,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+	})
+	if err != nil {
+		return "", fmt.Errorf("list remote refs: %w", err)
+	}
+	for _, want := range pullRequestRefs(parsed, id, opts.hostType(parsed.Hostname())) {
+		for _, ref := range refs {
+			if ref.Name() == want {
+				return want, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: #%s at %s", ErrPullRequestNotFound, id, redactURL(parsed.String()))
+}
+
+// fetchPullRequest fetches ref into a local pr/<id> branch and points HEAD
+// at it, ready to be checked out.
+func fetchPullRequest(ctx context.Context, repo *git.Repository, ref plumbing.ReferenceName, id string, auth transport.AuthMethod, opts CloneRepoOptions) error {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return fmt.Errorf("get origin: %w", err)
+	}
+	branch := plumbing.NewBranchReferenceName("pr/" + id)
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs:        []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", ref, branch))},
+		Auth:            auth,
+		Depth:           opts.Depth,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+		Tags:            git.NoTags,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("fetch %q: %w", ref, err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch)); err != nil {
+		return fmt.Errorf("set HEAD to %q: %w", branch.Short(), err)
+	}
+	return nil
+}
+
+// ErrHeadMismatch is returned by CloneRepo with VerifyHeadStrict when the
+// checked out commit is not the one the remote advertised.
+var ErrHeadMismatch = errors.New("checked out commit does not match the one advertised by the remote")
+
+// advertisedHeadKey is the Git config key the advertised commit is
+// recorded under, for ResolveCloneResult.
+const advertisedHeadKey = "envbuilder.advertisedHead"
+
+// listAdvertisedHead returns the commit that the remote at cloneURL
+// advertises for ref, or for HEAD if ref is empty.
+func listAdvertisedHead(ctx context.Context, cloneURL string, ref plumbing.ReferenceName, auth transport.AuthMethod, opts CloneRepoOptions) (plumbing.Hash, error) {
+	refs, err := listRemoteRefs(ctx, cloneURL, auth, opts)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	_, hash, err := advertisedHead(refs, ref)
+	return hash, err
+}
+
+// listRemoteRefs returns the refs advertised by the remote at cloneURL,
+// with annotated tags peeled.
+func listRemoteRefs(ctx context.Context, cloneURL string, auth transport.AuthMethod, opts CloneRepoOptions) ([]*plumbing.Reference, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{cloneURL},
+	})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{
+		Auth:            auth,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+		PeelingOption:   git.AppendPeeled,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list remote refs: %w", err)
+	}
+	return refs, nil
+}
+
+// advertisedHead resolves ref, or HEAD if ref is empty, in the advertised
+// refs. Short names are expanded like Git does, and annotated tags are
+// peeled to the commit they point at. The full name of the ref that
+// matched is returned along with the commit.
+func advertisedHead(refs []*plumbing.Reference, ref plumbing.ReferenceName) (plumbing.ReferenceName, plumbing.Hash, error) {
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference, len(refs))
+	for _, r := range refs {
+		byName[r.Name()] = r
+	}
+	if ref == "" {
+		ref = plumbing.HEAD
+	}
+	for _, rule := range plumbing.RefRevParseRules {
+		name := plumbing.ReferenceName(fmt.Sprintf(rule, ref))
+		r, ok := byName[name]
+		// Follow symbolic references, such as HEAD, to the branch.
+		for i := 0; ok && r.Type() == plumbing.SymbolicReference && i < 10; i++ {
+			name = r.Target()
+			r, ok = byName[name]
+		}
+		if !ok || r.Type() != plumbing.HashReference {
+			continue
+		}
+		if peeled, ok := byName[name+"^{}"]; ok {
+			return name, peeled.Hash(), nil
+		}
+		return name, r.Hash(), nil
+	}
+	return "", plumbing.ZeroHash, fmt.Errorf("remote does not advertise %q", ref.String())
+}
+
+// verifyHead compares the checked out commit with the one the remote
+// advertised. A mismatch fails with ErrHeadMismatch if
+// opts.VerifyHeadStrict is set, and is logged otherwise.
+func verifyHead(repo *git.Repository, advertised plumbing.Hash, opts CloneRepoOptions) error {
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("get head: %w", err)
+	}
+	if head.Hash() == advertised {
+		opts.logf(log.PhaseCheckingOut, log.LevelInfo, "🔏 Checked out commit %s matches the one advertised by the remote", head.Hash())
+		return nil
+	}
+	if opts.VerifyHeadStrict {
+		return fmt.Errorf("%w: remote advertised %s, checked out %s", ErrHeadMismatch, advertised, head.Hash())
+	}
+	opts.logf(log.PhaseCheckingOut, log.LevelWarn, "⚠️ Checked out commit %s does not match %s advertised by the remote", head.Hash(), advertised)
+	return nil
+}
+
+// minShortHashLen is the length of the shortest hex ref that is treated as
+// an abbreviated commit SHA, git's default abbreviation. Shorter ones are
+// treated as branch names.
+const minShortHashLen = 7
+
+// isCommitRef reports whether ref looks like a full or abbreviated commit
+// SHA. A branch or tag may still have that name, which CloneRepo checks
+// for first.
+func isCommitRef(ref string) bool {
+	if len(ref) < minShortHashLen || len(ref) > 40 {
+		return false
+	}
+	for _, c := range ref {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrAmbiguousRef is returned when an abbreviated commit SHA matches more
+// than one commit.
+var ErrAmbiguousRef = errors.New("ambiguous commit SHA")
+
+// resolveCommit returns the commit in repo whose SHA is, or starts with,
+// ref. It fails with ErrRefNotFound if there is none and ErrAmbiguousRef
+// if there are several.
+func resolveCommit(repo *git.Repository, ref string) (plumbing.Hash, error) {
+	prefix := strings.ToLower(ref)
+	if plumbing.IsHash(prefix) {
+		hash := plumbing.NewHash(prefix)
+		if _, err := repo.CommitObject(hash); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("%w: commit %s", ErrRefNotFound, ref)
+		}
+		return hash, nil
+	}
+	commits, err := repo.CommitObjects()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("list commits: %w", err)
+	}
+	var matches []string
+	var hash plumbing.Hash
+	err = commits.ForEach(func(c *object.Commit) error {
+		if strings.HasPrefix(c.Hash.String(), prefix) {
+			matches = append(matches, c.Hash.String())
+			hash = c.Hash
+		}
+		return nil
+	})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("list commits: %w", err)
+	}
+	switch len(matches) {
+	case 0:
+		return plumbing.ZeroHash, fmt.Errorf("%w: commit %s", ErrRefNotFound, ref)
+	case 1:
+		return hash, nil
+	default:
+		slices.Sort(matches)
+		return plumbing.ZeroHash, fmt.Errorf("%w: %s matches %s", ErrAmbiguousRef, ref, strings.Join(matches, ", "))
+	}
+}
+
+// ErrRefNotFound is returned by CloneAndVerifyRefs when refs cannot be
+// found locally or on the remote, and by CloneRepo when the commit in the
+// URL fragment is in none of the fetched branches.
+var ErrRefNotFound = errors.New("ref not found")
+
+// ErrRefNotInShallow is returned by CloneRepo when the commit in the URL
+// fragment is not within the history fetched by a shallow clone. It also
+// matches ErrRefNotFound.
+var ErrRefNotInShallow = errors.New("ref not in shallow clone")
+
+// shallowRefError maps the failure to find ref in a clone of the given
+// depth to ErrRefNotInShallow, naming the depth so that it is clear the
+// ref may exist further back in the history.
+func shallowRefError(ref string, depth int, err error) error {
+	if depth <= 0 || !(errors.Is(err, ErrRefNotFound) || errors.Is(err, plumbing.ErrObjectNotFound)) {
+		return err
+	}
+	return fmt.Errorf("%w: %s is not within the last %d commits, increase the clone depth or clone the full history: %w", ErrRefNotInShallow, ref, depth, err)
+}
+
+// CloneAndVerifyRefs clones the repository like CloneRepo, or uses the
+// existing one, and resolves each of refs to a commit in it. Refs may be
+// short or full branch and tag names, other full ref names or commit
+// SHAs. Refs the clone does not include, e.g. other branches with
+// SingleBranch, are fetched from origin with the same auth, proxy and TLS
+// options. It returns the commit SHA of each ref, or an error wrapping
+// ErrRefNotFound naming every ref that does not exist.
+func CloneAndVerifyRefs(ctx context.Context, opts CloneRepoOptions, refs []string) (map[string]string, error) {
+	if _, err := CloneRepo(ctx, opts); err != nil {
+		return nil, err
+	}
+	repo, err := openRepo(opts.Storage, opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]string, len(refs))
+	var missing []string
+	for _, ref := range refs {
+		if hash, ok := resolveLocalRef(repo, ref); ok {
+			resolved[ref] = hash.String()
+		} else {
+			missing = append(missing, ref)
+		}
+	}
+	if len(missing) == 0 {
+		return resolved, nil
+	}
+	missing, err = fetchRefs(ctx, repo, missing, opts)
+	if err != nil {
+		return nil, err
+	}
+	var notFound []string
+	for _, ref := range refs {
+		if _, ok := resolved[ref]; ok || slices.Contains(missing, ref) {
+			if !ok {
+				notFound = append(notFound, ref)
+			}
+			continue
+		}
+		hash, ok := resolveLocalRef(repo, ref)
+		if !ok {
+			notFound = append(notFound, ref)
+			continue
+		}
+		resolved[ref] = hash.String()
+	}
+	if len(notFound) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRefNotFound, strings.Join(notFound, ", "))
+	}
+	return resolved, nil
+}
+
+// resolveLocalRef resolves ref to a commit in repo. Branches are also
+// looked up among the remote-tracking branches of origin.
+func resolveLocalRef(repo *git.Repository, ref string) (plumbing.Hash, bool) {
+	for _, rev := range []string{ref, "origin/" + strings.TrimPrefix(ref, "refs/heads/")} {
+		if hash, err := repo.ResolveRevision(plumbing.Revision(rev)); err == nil {
+			return *hash, true
+		}
+	}
+	return plumbing.ZeroHash, false
+}
+
+// fetchRefs fetches the refs that origin advertises among refs, and
+// returns the ones it does not.
+func fetchRefs(ctx context.Context, repo *git.Repository, refs []string, opts CloneRepoOptions) ([]string, error) {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return nil, fmt.Errorf("get origin: %w", err)
+	}
+	advertised, err := remote.ListContext(ctx, &git.ListOptions{
+		Auth:            opts.RepoAuth,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+		PeelingOption:   git.AppendPeeled,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list remote refs: %w", err)
+	}
+	var refSpecs []config.RefSpec
+	var missing []string
+	for _, ref := range refs {
+		name, _, err := advertisedHead(advertised, plumbing.ReferenceName(ref))
+		if err != nil {
+			missing = append(missing, ref)
+			continue
+		}
+		// Branches are fetched as remote-tracking branches, like a clone.
+		local := name
+		if name.IsBranch() {
+			local = plumbing.NewRemoteReferenceName("origin", name.Short())
+		}
+		refSpecs = append(refSpecs, config.RefSpec(fmt.Sprintf("+%s:%s", name, local)))
+	}
+	if len(refSpecs) == 0 {
+		return missing, nil
+	}
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs:        refSpecs,
+		Auth:            opts.RepoAuth,
+		Depth:           opts.Depth,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+		Tags:            git.NoTags,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("fetch refs: %w", err)
+	}
+	return missing, nil
+}
+
+// cloneFromCache seeds the repository in fs from the clone at
+// opts.CachePath and fetches ref from cloneURL, so that only the objects
+// missing from the cache are downloaded. HEAD is pointed at the fetched
+// commit, ready to be checked out. It returns nil, leaving no .git
+// directory behind, if the cache cannot be used.
+func cloneFromCache(ctx context.Context, fs billy.Filesystem, cloneURL, remoteURL, ref string, tags git.TagMode, auth transport.AuthMethod, opts CloneRepoOptions) *git.Repository {
+	cached, err := openRepo(opts.Storage, opts.CachePath)
+	if err != nil {
+		opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Ignoring cache %s: %s", opts.CachePath, err)
+		return nil
+	}
+	if urlChanged, reason := repoMismatch(cached, remoteURL, ""); urlChanged {
+		opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Ignoring cache %s: %s", opts.CachePath, reason)
+		return nil
+	}
+	repo, err := fetchIntoCacheCopy(ctx, fs, cloneURL, ref, tags, auth, opts)
+	if err != nil {
+		opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Failed to update cache %s, cloning instead: %s", opts.CachePath, err)
+		if err := util.RemoveAll(fs, ".git"); err != nil {
+			opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Failed to clean up copy of cache: %s", err)
+		}
+		return nil
+	}
+	opts.logf(log.PhaseCloning, log.LevelInfo, "♻️ Updated a copy of cache %s instead of cloning", opts.CachePath)
+	return repo
+}
+
+// fetchIntoCacheCopy copies the .git directory at opts.CachePath into fs,
+// fetches ref from cloneURL and points HEAD at it.
+func fetchIntoCacheCopy(ctx context.Context, fs billy.Filesystem, cloneURL, ref string, tags git.TagMode, auth transport.AuthMethod, opts CloneRepoOptions) (*git.Repository, error) {
+	// The index is left behind so that the checkout populates the empty
+	// worktree, as it does after a clone.
+	err := copyTree(opts.Storage, filepath.Join(opts.CachePath, ".git"), filepath.Join(opts.Path, ".git"), "", func(rel string) bool {
+		return rel == "index"
+	})
+	if err != nil {
+		return nil, fmt.Errorf("copy cache: %w", err)
+	}
+	gitDir, err := fs.Chroot(".git")
+	if err != nil {
+		return nil, fmt.Errorf("chroot .git: %w", err)
+	}
+	repo, err := git.Open(filesystem.NewStorage(gitDir, cache.NewObjectLRU(cache.DefaultMaxSize*10)), fs)
+	if err != nil {
+		return nil, fmt.Errorf("open copy of cache: %w", err)
+	}
+	if err := setOriginURL(repo, cloneURL); err != nil {
+		return nil, err
+	}
+
+	// head is the reference HEAD should point at, and target the one the
+	// fetched commit is resolved from.
+	var refSpec config.RefSpec
+	var head, target plumbing.ReferenceName
+	switch {
+	case ref == "":
+		refSpec = "+HEAD:refs/remotes/origin/HEAD"
+		target = "refs/remotes/origin/HEAD"
+		if h, err := repo.Storer.Reference(plumbing.HEAD); err == nil && h.Type() == plumbing.SymbolicReference {
+			head = h.Target()
+		}
+	case isCommitRef(ref):
+		// Commits cannot be fetched by hash, so fetch all branches in the
+		// hope that one contains it.
+		refSpec = "+refs/heads/*:refs/remotes/origin/*"
+	case strings.HasPrefix(ref, "refs/heads/"), !strings.HasPrefix(ref, "refs/"):
+		branch := strings.TrimPrefix(ref, "refs/heads/")
+		refSpec = config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", branch, branch))
+		target = plumbing.NewRemoteReferenceName("origin", branch)
+		head = plumbing.NewBranchReferenceName(branch)
+	default:
+		refSpec = config.RefSpec(fmt.Sprintf("+%s:%s", ref, ref))
+		target = plumbing.ReferenceName(ref)
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName:      "origin",
+		RefSpecs:        []config.RefSpec{refSpec},
+		Auth:            auth,
+		Depth:           opts.Depth,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+		Tags:            tags,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("fetch %q: %w", refSpec, err)
+	}
+	var hash *plumbing.Hash
+	if target == "" {
+		commit, err := resolveCommit(repo, ref)
+		if err != nil {
+			return nil, err
+		}
+		hash = &commit
+	} else if hash, err = repo.ResolveRevision(plumbing.Revision(target)); err != nil {
+		return nil, fmt.Errorf("resolve %q: %w", target, err)
+	}
+	if head == "" {
+		err = repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, *hash))
+	} else {
+		err = repo.Storer.SetReference(plumbing.NewHashReference(head, *hash))
+		if err == nil {
+			err = repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, head))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("set HEAD: %w", err)
+	}
+	return repo, nil
+}
+
+// copyTree recursively copies the directory rel below src to dst within
+// fs, skipping paths, relative to src, for which skip returns true.
+func copyTree(fs billy.Filesystem, src, dst, rel string, skip func(rel string) bool) error {
+	entries, err := fs.ReadDir(filepath.Join(src, rel))
+	if err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(filepath.Join(dst, rel), 0o755); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := path.Join(rel, e.Name())
+		if skip(name) {
+			continue
+		}
+		from, to := filepath.Join(src, name), filepath.Join(dst, name)
+		switch {
+		case e.IsDir():
+			if err := copyTree(fs, src, dst, name, skip); err != nil {
+				return err
+			}
+		case e.Mode()&os.ModeSymlink != 0:
+			target, err := fs.Readlink(from)
+			if err != nil {
+				return err
+			}
+			if err := fs.Symlink(target, to); err != nil {
+				return err
+			}
+		default:
+			if err := copyFile(fs, from, to, e.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func copyFile(fs billy.Filesystem, from, to string, perm os.FileMode) error {
+	in, err := fs.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.OpenFile(to, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// removeExistingRepo empties opts.Path if it contains a Git repository so
+// that it can be cloned again. Nothing is removed unless the .git directory
+// opens as a repository.
+func removeExistingRepo(opts CloneRepoOptions, cloneURL string) error {
+	if _, err := opts.Storage.Stat(filepath.Join(opts.Path, ".git")); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if filepath.Clean(opts.Path) == string(filepath.Separator) {
+		return errors.New("refusing to remove a repository at the filesystem root")
+	}
+	repo, err := openRepo(opts.Storage, opts.Path)
+	if err != nil {
+		return fmt.Errorf("refusing to remove %q, it is not a valid git repository: %w", opts.Path, err)
+	}
+	reason := "reclone was forced"
+	if remote, err := repo.Remote("origin"); err == nil && len(remote.Config().URLs) > 0 {
+		if origin := remote.Config().URLs[0]; origin != cloneURL {
+			reason = fmt.Sprintf("origin changed from %s", redactURL(origin))
+		}
+	}
+	entries, err := opts.Storage.ReadDir(opts.Path)
+	if err != nil {
+		return fmt.Errorf("read dir %q: %w", opts.Path, err)
+	}
+	for _, entry := range entries {
+		if err := util.RemoveAll(opts.Storage, filepath.Join(opts.Path, entry.Name())); err != nil {
+			return fmt.Errorf("remove existing repository: %w", err)
+		}
+	}
+	opts.logf(log.PhaseCloning, log.LevelWarn, "♻️ Removed existing repository at %s to clone it again (%s)", opts.Path, reason)
+	return nil
+}
+
+// setOriginURL points the origin remote of repo at u.
+func setOriginURL(repo *git.Repository, u string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	origin, ok := cfg.Remotes["origin"]
+	if !ok {
+		return errors.New("origin remote not found")
+	}
+	origin.URLs = []string{u}
+	if err := repo.SetConfig(cfg); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	return nil
+}
+
+// gitTLSTunnel forwards plain git:// connections from a local listener to
+// a git daemon behind a TLS terminator, like stunnel does. go-git cannot
+// speak the git protocol over TLS, so gits:// clones are pointed at the
+// listener instead.
+type gitTLSTunnel struct {
+	listener net.Listener
+	addr     string
+	config   *tls.Config
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// newGitTLSTunnel starts a tunnel to the host of the gits:// URL u. A TLS
+// handshake is performed up front so that certificate problems surface as
+// a clear error instead of an unexpected EOF from go-git.
+func newGitTLSTunnel(ctx context.Context, u *url.URL, opts CloneRepoOptions) (*gitTLSTunnel, error) {
+	host, port := u.Hostname(), u.Port()
+	if opts.ResolveHostToIP != "" {
+		host = opts.ResolveHostToIP
+	}
+	if port == "" {
+		port = "9418"
+	}
+	addr := net.JoinHostPort(host, port)
+	serverName := u.Hostname()
+	if opts.TLSServerName != "" {
+		serverName = opts.TLSServerName
+	}
+	cfg, err := gitTLSConfig(serverName, opts)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &tls.Dialer{Config: cfg}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s: %w", addr, err)
+	}
+	_ = conn.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listen for TLS tunnel: %w", err)
+	}
+	t := &gitTLSTunnel{listener: listener, addr: addr, config: cfg, conns: map[net.Conn]struct{}{}}
+	t.wg.Add(1)
+	go t.serve()
+	return t, nil
+}
+
+// URL returns u rewritten to a git:// URL for the local end of the tunnel.
+func (t *gitTLSTunnel) URL(u *url.URL) string {
+	local := *u
+	local.Scheme = "git"
+	local.User = nil
+	local.Host = t.listener.Addr().String()
+	return local.String()
+}
+
+// Close stops the listener and ends any sessions still in flight.
+func (t *gitTLSTunnel) Close() error {
+	err := t.listener.Close()
+	t.mu.Lock()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+	return err
+}
+
+func (t *gitTLSTunnel) serve() {
+	defer t.wg.Done()
+	for {
+		local, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		t.conns[local] = struct{}{}
+		t.mu.Unlock()
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.forward(local)
+		}()
+	}
+}
+
+func (t *gitTLSTunnel) forward(local net.Conn) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.conns, local)
+		t.mu.Unlock()
+		_ = local.Close()
+	}()
+	remote, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", t.addr, t.config)
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+	// Either side closing ends the session; the deferred closes unblock
+	// the other copy.
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func gitTLSConfig(serverName string, opts CloneRepoOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: opts.Insecure,
+	}
+	if len(opts.CABundle) > 0 {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("get system cert pool: %w", err)
+		}
+		if rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		rootCAs.AppendCertsFromPEM(opts.CABundle)
+		cfg.RootCAs = rootCAs
+	}
+	if len(opts.TLSClientCert) > 0 || len(opts.TLSClientKey) > 0 {
+		cert, err := tls.X509KeyPair(opts.TLSClientCert, opts.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// checkoutHead populates the worktree from HEAD, the same way
+// git.CloneContext does unless NoCheckout is set.
+func checkoutHead(repo *git.Repository) error {
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	return w.Reset(&git.ResetOptions{
+		Mode:   git.MergeReset,
+		Commit: head.Hash(),
+	})
+}
+
+// phaseWriter reports log.PhaseCloning on the first progress message from
+// the remote, which is the first sign that the connection succeeded.
+type phaseWriter struct {
+	w        io.Writer
+	reporter log.ProgressReporter
+	once     sync.Once
+}
+
+func (p *phaseWriter) Write(b []byte) (int, error) {
+	p.cloning()
+	if p.w == nil {
+		return len(b), nil
+	}
+	return p.w.Write(b)
+}
+
+// cloning reports log.PhaseCloning if it has not been reported yet. Remotes
+// are not required to send progress, so this is also called once the fetch
+// completes to keep the sequence of phases consistent.
+func (p *phaseWriter) cloning() {
+	p.once.Do(func() { p.reporter.Phase(log.PhaseCloning) })
+}
+
+// PruneMode controls how the .git directory is reduced after a clone.
+type PruneMode string
+
+const (
+	// PruneNone leaves the .git directory untouched.
+	PruneNone PruneMode = "none"
+	// PruneShallow repacks objects into a single pack and removes
+	// unreachable loose objects.
+	PruneShallow PruneMode = "shallow"
+	// PruneRemove deletes the .git directory entirely.
+	PruneRemove PruneMode = "remove"
+)
+
+// Validate returns an error if m is not a known prune mode. The empty
+// string is treated as PruneNone.
+func (m PruneMode) Validate() error {
+	switch m {
+	case "", PruneNone, PruneShallow, PruneRemove:
+		return nil
+	default:
+		return fmt.Errorf("invalid prune mode %q: must be one of none, shallow, remove", m)
+	}
+}
+
+// ProtocolVersion is the Git wire protocol version to clone with.
+type ProtocolVersion string
+
+const (
+	// ProtocolAuto uses the default of the clone implementation: v0 for
+	// go-git and v2 for the git CLI.
+	ProtocolAuto ProtocolVersion = "auto"
+	// ProtocolV0 forces the original protocol, for servers that mishandle
+	// v2.
+	ProtocolV0 ProtocolVersion = "v0"
+	// ProtocolV2 forces protocol v2, which lets the server filter refs
+	// and is faster against large hosts.
+	ProtocolV2 ProtocolVersion = "v2"
+)
+
+// Validate returns an error if v is not a known protocol version. The
+// empty string is treated as ProtocolAuto.
+func (v ProtocolVersion) Validate() error {
+	switch v {
+	case "", ProtocolAuto, ProtocolV0, ProtocolV2:
+		return nil
+	default:
+		return fmt.Errorf("invalid protocol version %q: must be one of auto, v0, v2", v)
+	}
+}
+
+// ErrGitDirRequired is returned by PruneGitDir when the .git directory
+// cannot be removed because the worktree still depends on it.
+var ErrGitDirRequired = errors.New(".git directory is still required")
+
+// PruneGitDir reduces the size of the .git directory of the repository at
+// path according to mode and returns the number of bytes reclaimed. The .git
+// directory is never removed if the repository uses submodules or Git LFS,
+// as later steps need it to materialize content.
+func PruneGitDir(storage billy.Filesystem, path string, mode PruneMode) (int64, error) {
+	if err := mode.Validate(); err != nil {
+		return 0, err
+	}
+	if mode == "" || mode == PruneNone {
+		return 0, nil
+	}
+	gitDir := filepath.Join(path, ".git")
+	before, err := dirSize(storage, gitDir)
+	if err != nil {
+		return 0, fmt.Errorf("measure %q: %w", gitDir, err)
+	}
+
+	if mode == PruneRemove {
+		if reason := gitDirRequiredReason(storage, path); reason != "" {
+			return 0, fmt.Errorf("%w: %s", ErrGitDirRequired, reason)
+		}
+		if err := util.RemoveAll(storage, gitDir); err != nil {
+			return 0, fmt.Errorf("remove %q: %w", gitDir, err)
+		}
+		return before, nil
+	}
+
+	repo, err := openRepo(storage, path)
+	if err != nil {
+		return 0, err
+	}
+	err = repo.Prune(git.PruneOptions{
+		OnlyObjectsOlderThan: time.Now(),
+		Handler:              repo.DeleteObject,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("prune objects: %w", err)
+	}
+	if err := repo.RepackObjects(&git.RepackConfig{}); err != nil {
+		return 0, fmt.Errorf("repack objects: %w", err)
+	}
+	after, err := dirSize(storage, gitDir)
+	if err != nil {
+		return 0, fmt.Errorf("measure %q: %w", gitDir, err)
+	}
+	return before - after, nil
+}
+
+// gitDirRequiredReason returns a non-empty reason if the worktree at path
+// still depends on its .git directory.
+func gitDirRequiredReason(storage billy.Filesystem, path string) string {
+	if _, err := storage.Stat(filepath.Join(path, ".gitmodules")); err == nil {
+		return "repository uses submodules"
+	}
+	if usesLFS(storage, path) {
+		return "repository uses Git LFS"
+	}
+	return ""
+}
+
+// usesLFS reports whether the worktree at path tracks files with Git LFS.
+func usesLFS(storage billy.Filesystem, path string) bool {
+	f, err := storage.Open(filepath.Join(path, ".gitattributes"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	return err == nil && strings.Contains(string(content), "filter=lfs")
+}
+
+func dirSize(storage billy.Filesystem, path string) (int64, error) {
+	var size int64
+	err := util.Walk(storage, path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// RewriteGitURL applies the longest matching prefix rewrite from rewrites to
+// rawURL, the same way git applies url.<base>.insteadOf. If no prefix
+// matches, rawURL is returned unchanged.
+func RewriteGitURL(rawURL string, rewrites map[string]string) string {
+	var match string
+	for prefix := range rewrites {
+		if strings.HasPrefix(rawURL, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	if match == "" {
+		return rawURL
+	}
+	return rewrites[match] + strings.TrimPrefix(rawURL, match)
+}
+
+// redactURL masks any password in rawURL so that it is safe to log.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+var (
+	gitConfigSectionRegex = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+	gitConfigKeyRegex     = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+)
+
+// parseGitConfigKey splits a key of the form section[.subsection].key into
+// its parts, validating them the same way git does.
+func parseGitConfigKey(key string) (section, subsection, name string, err error) {
+	first := strings.Index(key, ".")
+	last := strings.LastIndex(key, ".")
+	if first <= 0 || last == len(key)-1 {
+		return "", "", "", fmt.Errorf("invalid git config key %q: expected section.key", key)
+	}
+	section, name = key[:first], key[last+1:]
+	if first != last {
+		subsection = key[first+1 : last]
+	}
+	if !gitConfigSectionRegex.MatchString(section) {
+		return "", "", "", fmt.Errorf("invalid git config key %q: invalid section %q", key, section)
+	}
+	if !gitConfigKeyRegex.MatchString(name) {
+		return "", "", "", fmt.Errorf("invalid git config key %q: invalid key %q", key, name)
+	}
+	return section, subsection, name, nil
+}
+
+// setGitConfig sets key in values, replacing any existing value for it.
+// Git config keys are case-insensitive.
+func setGitConfig(values map[string]string, key, value string) {
+	for k := range values {
+		if strings.EqualFold(k, key) {
+			delete(values, k)
+		}
+	}
+	values[key] = value
+}
+
+// applyGitConfig writes the given key/value pairs to the repository config.
+// The raw config is round-tripped so that values for sections go-git models
+// natively (e.g. url.<base>.insteadOf) are not discarded when saving.
+func applyGitConfig(repo *git.Repository, values map[string]string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		section, subsection, name, err := parseGitConfigKey(k)
+		if err != nil {
+			return err
+		}
+		if subsection == "" {
+			cfg.Raw.Section(section).SetOption(name, values[k])
+		} else {
+			cfg.Raw.Section(section).Subsection(subsection).SetOption(name, values[k])
+		}
+	}
+	var buf bytes.Buffer
+	if err := format.NewEncoder(&buf).Encode(cfg.Raw); err != nil {
+		return fmt.Errorf("encode config: %w", err)
+	}
+	updated := config.NewConfig()
+	if err := updated.Unmarshal(buf.Bytes()); err != nil {
+		return fmt.Errorf("parse config: %w", err)
+	}
+	return repo.Storer.SetConfig(updated)
+}
+
+// logProtocolInfo logs the Git protocol version and the capabilities
+// advertised by the remote at url. This costs an additional reference
+// advertisement round-trip, so it should only be used when verbose.
+//
+// go-git never requests protocol v2 (it does not send the
+// Git-Protocol header), so a successful advertisement implies the
+// exchange is happening over protocol v0.
+//
+// unsupportedCaps are the capabilities the clone overrides
+// transport.UnsupportedCapabilities with, or nil for go-git's defaults.
+// The global is not read, since a concurrent clone may be overriding it.
+func logProtocolInfo(ctx context.Context, logf log.Func, url string, auth transport.AuthMethod, unsupportedCaps []capability.Capability, opts CloneRepoOptions) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		logf(log.LevelDebug, "failed to parse endpoint for protocol info: %s", err)
+		return
+	}
+	ep.InsecureSkipTLS = opts.Insecure
+	ep.CaBundle = opts.CABundle
+	ep.Proxy = opts.ProxyOptions
+	cli, err := client.NewClient(ep)
+	if err != nil {
+		logf(log.LevelDebug, "failed to create client for protocol info: %s", err)
+		return
+	}
+	sess, err := cli.NewUploadPackSession(ep, auth)
+	if err != nil {
+		logf(log.LevelDebug, "failed to open session for protocol info: %s", err)
+		return
+	}
+	defer sess.Close()
+	ar, err := sess.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		logf(log.LevelDebug, "failed to get advertised references: %s", err)
+		return
+	}
+	logf(log.LevelDebug, "🤝 Negotiated Git protocol v0 with %s, advertised capabilities: %s", ep.Host, ar.Capabilities.String())
+	if unsupportedCaps == nil {
+		unsupportedCaps = defaultUnsupportedCapabilities
+	}
+	if len(unsupportedCaps) > 0 {
+		unsupported := make([]string, 0, len(unsupportedCaps))
+		for _, c := range unsupportedCaps {
+			unsupported = append(unsupported, c.String())
+		}
+		logf(log.LevelDebug, "🤝 Capabilities not requested by the client: %s", strings.Join(unsupported, " "))
+	}
+}
+
+// connectAuth wraps opts.RepoAuth and ctx with the SSH, path credential,
+// redirect and DNS settings in opts for connecting to parsed.
+func connectAuth(ctx context.Context, parsed *url.URL, opts CloneRepoOptions) (context.Context, transport.AuthMethod) {
+	auth := opts.RepoAuth
+	if sshAuth, ok := auth.(gitssh.AuthMethod); ok && (len(opts.SSHCiphers) > 0 || len(opts.SSHKeyExchanges) > 0) {
+		auth = newSSHAuthWithAlgorithms(sshAuth, opts)
+	}
+	if sshAuth, ok := auth.(gitssh.AuthMethod); ok && opts.SSHDialTimeout > 0 {
+		auth = &sshAuthWithTimeout{AuthMethod: sshAuth, timeout: opts.SSHDialTimeout}
+	}
+
+	if parsed.Scheme == "http" || parsed.Scheme == "https" {
+		if len(opts.PathCredentials) > 0 {
+			fallback, _ := auth.(githttp.AuthMethod)
+			auth = &pathAuth{creds: opts.PathCredentials, fallback: fallback}
+		}
+		policy := &redirectPolicy{
+			host:              parsed.Host,
+			maxRedirects:      opts.MaxRedirects,
+			followCredentials: opts.FollowRedirectCredentials,
+			anonymousFirst:    opts.HTTPAnonymousFirst,
+			logger:            opts.logger().Scope(log.PhaseConnecting),
+		}
+		if httpAuth, ok := auth.(githttp.AuthMethod); ok {
+			policy.auth = httpAuth
+			auth = &httpAuthForHost{AuthMethod: httpAuth, policy: policy}
+		}
+		ctx = withRedirectPolicy(ctx, policy)
+		if opts.Resolver != nil {
+			ctx = withResolver(ctx, opts.Resolver, opts.logger().Scope(log.PhaseConnecting))
+		}
+	}
+	return ctx, auth
+}
+
+// sshAuthWithTimeout wraps an SSH auth method to set a dial timeout on the
+// client config it produces.
+type sshAuthWithTimeout struct {
+	gitssh.AuthMethod
+	timeout time.Duration
+}
+
+func (a *sshAuthWithTimeout) ClientConfig() (*gossh.ClientConfig, error) {
+	cfg, err := a.AuthMethod.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Timeout = a.timeout
+	return cfg, nil
+}
+
+// sshHandshakeTransport bounds the time taken to open upload-pack
+// sessions of Transport, or of the go-git client for the scheme of the
+// endpoint if it is nil. go-git applies the timeout of the SSH client
+// config to the TCP dial only, leaving the handshake unbounded.
+type sshHandshakeTransport struct {
+	transport.Transport
+	timeout time.Duration
+}
+
+func (t *sshHandshakeTransport) base(ep *transport.Endpoint) (transport.Transport, error) {
+	if t.Transport != nil {
+		return t.Transport, nil
+	}
+	return client.NewClient(ep)
+}
+
+func (t *sshHandshakeTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	base, err := t.base(ep)
+	if err != nil {
+		return nil, err
+	}
+	type result struct {
+		session transport.UploadPackSession
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		s, err := base.NewUploadPackSession(ep, auth)
+		done <- result{session: s, err: err}
+	}()
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.session, r.err
+	case <-timer.C:
+		// The connection cannot be closed from here, so the session is
+		// closed if the handshake ever completes.
+		go func() {
+			if r := <-done; r.err == nil {
+				_ = r.session.Close()
+			}
+		}()
+		return nil, fmt.Errorf("ssh handshake with %s: %w", ep.Host, context.DeadlineExceeded)
+	}
+}
+
+func (t *sshHandshakeTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	base, err := t.base(ep)
+	if err != nil {
+		return nil, err
+	}
+	return base.NewReceivePackSession(ep, auth)
+}
+
+// redirectPolicy controls how HTTP redirects are followed for a clone. It
+// travels in the request context because go-git shares one HTTP client
+// between all clones.
+type redirectPolicy struct {
+	// host is the host:port credentials are bound to.
+	host              string
+	maxRedirects      int
+	followCredentials bool
+	auth              githttp.AuthMethod
+	logger            log.Func
+	// anonymousFirst withholds auth until a request fails with 401, at
+	// which point escalated is set. See authEscalationTransport.
+	anonymousFirst bool
+	escalated      atomic.Bool
+}
+
+type redirectPolicyKey struct{}
+
+// init registers the go-git clients used by CloneRepo. go-git reads
+// client.Protocols without a lock, so it is only written here, before any
+// clone can run. Requests without a redirect policy behave as with the
+// go-git defaults.
+func init() {
+	c := githttp.NewClient(&http.Client{
+		Transport:     newHTTPTransport(),
+		CheckRedirect: checkRedirect,
+	})
+	client.InstallProtocol("http", c)
+	client.InstallProtocol("https", c)
+	client.InstallProtocol(privateScheme, privateTransports)
+}
+
+// withRedirectPolicy returns a context carrying policy, which the go-git
+// HTTP transports consult when following redirects.
+func withRedirectPolicy(ctx context.Context, policy *redirectPolicy) context.Context {
+	return context.WithValue(ctx, redirectPolicyKey{}, policy)
+}
+
+// ErrTooManyRedirects is returned by CloneRepo when the remote redirects
+// in a loop or more often than CloneRepoOptions.MaxRedirects allows. The
+// error includes the hosts redirected through.
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	policy, ok := req.Context().Value(redirectPolicyKey{}).(*redirectPolicy)
+	if !ok {
+		// Match the net/http default for requests without a policy.
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	for _, prev := range via {
+		if sameRedirectTarget(prev.URL, req.URL) {
+			return fmt.Errorf("%w: redirect loop through %s", ErrTooManyRedirects, redirectChain(req, via))
+		}
+	}
+	switch {
+	case policy.maxRedirects < 0:
+		return fmt.Errorf("refusing to follow redirect to %s", redactURL(req.URL.String()))
+	case policy.maxRedirects > 0 && len(via) > policy.maxRedirects:
+		return fmt.Errorf("%w: stopped after %d redirects through %s", ErrTooManyRedirects, policy.maxRedirects, redirectChain(req, via))
+	case policy.maxRedirects == 0 && len(via) >= 10:
+		return fmt.Errorf("%w: stopped after 10 redirects through %s", ErrTooManyRedirects, redirectChain(req, via))
+	}
+	if policy.logger != nil {
+		policy.logger(log.LevelInfo, "↪️ Following redirect to %s", redactURL(req.URL.String()))
+	}
+	if req.URL.Host == policy.host {
+		return nil
+	}
+	// net/http only drops credentials when the domain changes, so a
+	// redirect to another port would otherwise keep them.
+	req.Header.Del("Authorization")
+	if policy.followCredentials && policy.auth != nil {
+		policy.auth.SetAuth(req)
+	}
+	return nil
+}
+
+// sameRedirectTarget reports whether a and b request the same resource,
+// ignoring credentials.
+func sameRedirectTarget(a, b *url.URL) bool {
+	return a.Scheme == b.Scheme && strings.EqualFold(a.Host, b.Host) && a.Path == b.Path && a.RawQuery == b.RawQuery
+}
+
+// redirectChain returns the hosts that req was redirected through, e.g.
+// "a.example.com -> b.example.com -> a.example.com". Only hosts are
+// included, so that it never contains credentials.
+func redirectChain(req *http.Request, via []*http.Request) string {
+	hosts := make([]string, 0, len(via)+1)
+	for _, r := range via {
+		hosts = append(hosts, r.URL.Host)
+	}
+	return strings.Join(append(hosts, req.URL.Host), " -> ")
+}
+
+// httpAuthForHost wraps an HTTP auth method so that credentials are only
+// attached to requests for the policy's host, unless the policy allows
+// them to follow redirects. go-git sends subsequent requests straight to
+// the redirected host, so this is needed in addition to checkRedirect.
+type httpAuthForHost struct {
+	githttp.AuthMethod
+	policy *redirectPolicy
+}
+
+func (a *httpAuthForHost) SetAuth(r *http.Request) {
+	if r.URL.Host != a.policy.host && !a.policy.followCredentials {
+		return
+	}
+	if a.policy.anonymousFirst && !a.policy.escalated.Load() {
+		return
+	}
+	a.AuthMethod.SetAuth(r)
+}
+
+// authEscalationTransport opens sessions of Transport, or of the go-git
+// client for the scheme of the endpoint if it is nil, that retry requests
+// sent anonymously because of policy.anonymousFirst with credentials once
+// the remote rejects them with 401. Later requests carry the credentials
+// from the start. It wraps sessions rather than the HTTP client, because
+// go-git requires the client transport to be an *http.Transport to apply
+// CABundle, InsecureSkipTLS and ProxyOptions.
+type authEscalationTransport struct {
+	transport.Transport
+	policy *redirectPolicy
+}
+
+func (t *authEscalationTransport) base(ep *transport.Endpoint) (transport.Transport, error) {
+	if t.Transport != nil {
+		return t.Transport, nil
+	}
+	return client.NewClient(ep)
+}
+
+func (t *authEscalationTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	base, err := t.base(ep)
+	if err != nil {
+		return nil, err
+	}
+	s, err := base.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+	return &authEscalationSession{UploadPackSession: s, policy: t.policy}, nil
+}
+
+func (t *authEscalationTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	base, err := t.base(ep)
+	if err != nil {
+		return nil, err
+	}
+	return base.NewReceivePackSession(ep, auth)
+}
+
+// authEscalationSession retries requests rejected with 401 once
+// credentials are no longer withheld. go-git HTTP sessions apply auth to
+// every request, so the retry goes through the same session.
+type authEscalationSession struct {
+	transport.UploadPackSession
+	policy *redirectPolicy
+}
+
+func (s *authEscalationSession) AdvertisedReferences() (*packp.AdvRefs, error) {
+	ar, err := s.UploadPackSession.AdvertisedReferences()
+	if s.escalate(err, "refs") {
+		return s.UploadPackSession.AdvertisedReferences()
+	}
+	return ar, err
+}
+
+func (s *authEscalationSession) AdvertisedReferencesContext(ctx context.Context) (*packp.AdvRefs, error) {
+	ar, err := s.UploadPackSession.AdvertisedReferencesContext(ctx)
+	if s.escalate(err, "refs") {
+		return s.UploadPackSession.AdvertisedReferencesContext(ctx)
+	}
+	return ar, err
+}
+
+func (s *authEscalationSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	res, err := s.UploadPackSession.UploadPack(ctx, req)
+	if s.escalate(err, "packs") {
+		return s.UploadPackSession.UploadPack(ctx, req)
+	}
+	return res, err
+}
+
+// escalate reports whether a request that failed with err should be
+// retried with credentials, which is only the case the first time the
+// remote asks for them.
+func (s *authEscalationSession) escalate(err error, what string) bool {
+	if !errors.Is(err, transport.ErrAuthenticationRequired) || s.policy.escalated.Swap(true) {
+		return false
+	}
+	if s.policy.logger != nil {
+		s.policy.logger(log.LevelInfo, "🔐 %s requires authentication for %s, retrying with credentials", s.policy.host, what)
+	}
+	return true
+}
+
+// escalationPolicy returns the redirect policy in ctx if it withholds
+// credentials until the remote asks for them, or nil otherwise.
+func escalationPolicy(ctx context.Context) *redirectPolicy {
+	policy, ok := ctx.Value(redirectPolicyKey{}).(*redirectPolicy)
+	if !ok || !policy.anonymousFirst || policy.auth == nil {
+		return nil
+	}
+	return policy
+}
+
+// installAuthEscalation returns remoteURL rewritten to reach an
+// authEscalationTransport if the redirect policy in ctx withholds
+// credentials, along with a function that uninstalls it. Otherwise
+// remoteURL is returned as is.
+func installAuthEscalation(ctx context.Context, remoteURL string) (string, func(), error) {
+	policy := escalationPolicy(ctx)
+	if policy == nil {
+		return remoteURL, func() {}, nil
+	}
+	return installTransport(&authEscalationTransport{policy: policy}, remoteURL, false)
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// scpLikeURLRegex matches scp-like Git URLs such as git@host.tld:org/repo.git
+// and the bracketed form used to specify a port, [git@host.tld:2222]:repo.git.
+var scpLikeURLRegex = regexp.MustCompile(`^(?:([^@/\[\]]+)@)?(\[[^\]]+\]|[^:/\[\]]+):(.*)$`)
+
+// NormalizeGitURL converts scp-like Git URLs (e.g. git@host.tld:org/repo.git)
+// into their equivalent ssh:// form, preserving the user, host, port, path
+// and any #ref fragment. URLs that already have a scheme and local paths are
+// returned unchanged.
+func NormalizeGitURL(rawURL string) (string, error) {
+	if rawURL == "" {
+		return "", errors.New("git url is empty")
+	}
+	if strings.Contains(rawURL, "://") || strings.HasPrefix(rawURL, "/") || strings.HasPrefix(rawURL, ".") {
+		return rawURL, nil
+	}
+	m := scpLikeURLRegex.FindStringSubmatch(rawURL)
+	if m == nil {
+		return rawURL, nil
+	}
+	user, host, path := m[1], m[2], m[3]
+	var port string
+	if strings.HasPrefix(host, "[") {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		// The bracketed form may itself contain the user.
+		if u, h, ok := strings.Cut(host, "@"); ok && user == "" {
+			user, host = u, h
+		}
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		}
+	}
+	if host == "" {
+		return "", fmt.Errorf("parse scp-like url %q: missing host", rawURL)
+	}
+	path, fragment, _ := strings.Cut(path, "#")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	u := &url.URL{
+		Scheme:   "ssh",
+		Host:     host,
+		Path:     path,
+		Fragment: fragment,
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	}
+	if user != "" {
+		u.User = url.User(user)
+	}
+	return u.String(), nil
+}
+
+// ShallowCloneRepo will clone the repository at the given URL into the given path
+// with a depth of 1. If the destination folder exists and is not empty, the
+// clone will not be performed.
+//
+// The bool returned states whether the repository was cloned or not.
+func ShallowCloneRepo(ctx context.Context, opts CloneRepoOptions) error {
+	opts.Depth = 1
+	opts.SingleBranch = true
+
+	if opts.Path == "" {
+		return errors.New("path is required")
+	}
+
+	// Avoid clobbering the destination.
+	if _, err := opts.Storage.Stat(opts.Path); err == nil {
+		files, err := opts.Storage.ReadDir(opts.Path)
+		if err != nil {
+			return fmt.Errorf("read dir %q: %w", opts.Path, err)
+		}
+		if len(files) > 0 {
+			return fmt.Errorf("directory %q is not empty", opts.Path)
+		}
+	}
+
+	cloned, err := CloneRepo(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if !cloned {
+		return errors.New("repository already exists")
+	}
+
+	return nil
+}
+
+// CheckoutRef updates the worktree of the repository at repoPath to the
+// given ref without touching the network. The ref may be anything that
+// resolves to a commit locally, e.g. a branch, tag or commit hash. An error
+// is returned if the ref or its objects are not present in the local
+// repository.
+func CheckoutRef(ctx context.Context, storage billy.Filesystem, repoPath, ref string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	repo, err := openRepo(storage, repoPath)
+	if err != nil {
+		return err
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return fmt.Errorf("resolve ref %q: %w", ref, err)
+	}
+	if _, err := repo.CommitObject(*hash); err != nil {
+		return fmt.Errorf("commit %s for ref %q not found locally: %w", hash, ref, err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("get worktree: %w", err)
+	}
+	err = wt.Checkout(&git.CheckoutOptions{
+		Hash:  *hash,
+		Force: true,
+	})
+	if err != nil {
+		return fmt.Errorf("checkout %q: %w", ref, err)
+	}
+	return nil
+}
+
+// AddWorktree creates a linked worktree for ref at destPath from the
+// repository at repoPath, like `git worktree add --detach`. The new worktree
+// shares the object store, refs and config of the main repository and only
+// keeps its own HEAD and index under .git/worktrees/<name>.
+//
+// If ref cannot be resolved locally it is fetched from origin using auth,
+// which may be nil.
+func AddWorktree(ctx context.Context, storage billy.Filesystem, repoPath, ref, destPath string, auth transport.AuthMethod) error {
+	repo, err := openRepo(storage, repoPath)
+	if err != nil {
+		return err
+	}
+	hash, err := resolveOrFetch(ctx, repo, ref, auth)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(filepath.Clean(destPath))
+	commonDir := filepath.Join(repoPath, ".git")
+	wtGitDir := filepath.Join(commonDir, "worktrees", name)
+	if _, err := storage.Stat(wtGitDir); err == nil {
+		return fmt.Errorf("worktree %q already exists", name)
+	}
+	if files, err := storage.ReadDir(destPath); err == nil && len(files) > 0 {
+		return fmt.Errorf("directory %q is not empty", destPath)
+	}
+	for path, content := range map[string]string{
+		filepath.Join(wtGitDir, "commondir"): "../..\n",
+		filepath.Join(wtGitDir, "gitdir"):    filepath.Join(destPath, ".git") + "\n",
+		filepath.Join(destPath, ".git"):      "gitdir: " + wtGitDir + "\n",
+	} {
+		if err := util.WriteFile(storage, path, []byte(content), 0o644); err != nil {
+			return fmt.Errorf("write %q: %w", path, err)
+		}
+	}
+
+	dotGitFS, err := storage.Chroot(wtGitDir)
+	if err != nil {
+		return fmt.Errorf("chroot %q: %w", wtGitDir, err)
+	}
+	commonFS, err := storage.Chroot(commonDir)
+	if err != nil {
+		return fmt.Errorf("chroot %q: %w", commonDir, err)
+	}
+	wtFS, err := storage.Chroot(destPath)
+	if err != nil {
+		return fmt.Errorf("chroot %q: %w", destPath, err)
+	}
+	wtStorage := filesystem.NewStorage(dotgit.NewRepositoryFilesystem(dotGitFS, commonFS), cache.NewObjectLRU(cache.DefaultMaxSize*10))
+	if err := wtStorage.SetReference(plumbing.NewHashReference(plumbing.HEAD, *hash)); err != nil {
+		return fmt.Errorf("set worktree HEAD: %w", err)
+	}
+	wtRepo, err := git.Open(wtStorage, wtFS)
+	if err != nil {
+		return fmt.Errorf("open worktree %q: %w", destPath, err)
+	}
+	wt, err := wtRepo.Worktree()
+	if err != nil {
+		return fmt.Errorf("get worktree: %w", err)
+	}
+	err = wt.Reset(&git.ResetOptions{
+		Commit: *hash,
+		Mode:   git.HardReset,
+	})
+	if err != nil {
+		return fmt.Errorf("checkout %q: %w", ref, err)
+	}
+	return nil
+}
+
+// resolveOrFetch resolves ref in repo, fetching it from origin if it is
+// not available locally.
+func resolveOrFetch(ctx context.Context, repo *git.Repository, ref string, auth transport.AuthMethod) (*plumbing.Hash, error) {
+	if isCommitRef(ref) {
+		return resolveOrFetchCommit(ctx, repo, ref, auth)
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err == nil {
+		return hash, nil
+	}
+	refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", ref, ref))
+	resolved := ref
+	if !strings.HasPrefix(ref, "refs/") {
+		refSpec = config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", ref, ref))
+		resolved = "refs/remotes/origin/" + ref
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       auth,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("fetch %q: %w", ref, err)
+	}
+	hash, err = repo.ResolveRevision(plumbing.Revision(resolved))
+	if err != nil {
+		return nil, fmt.Errorf("resolve ref %q: %w", ref, err)
+	}
+	return hash, nil
+}
+
+// resolveOrFetchCommit resolves the full or abbreviated commit SHA ref,
+// fetching all branches from origin if it is not found locally.
+func resolveOrFetchCommit(ctx context.Context, repo *git.Repository, ref string, auth transport.AuthMethod) (*plumbing.Hash, error) {
+	hash, err := resolveCommit(repo, ref)
+	if err == nil {
+		return &hash, nil
+	}
+	if !errors.Is(err, ErrRefNotFound) {
+		return nil, err
+	}
+	// Commits cannot be fetched by hash, so fetch all branches in the hope
+	// that one contains it.
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+		Auth:       auth,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("fetch %q: %w", ref, err)
+	}
+	hash, err = resolveCommit(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &hash, nil
+}
+
+// GrowSparse expands the sparse checkout of the repository at repoPath to
+// also include the given directories and materializes the newly included
+// files. The current sparse checkout set is read from
+// .git/info/sparse-checkout; if the file does not exist the worktree is
+// not sparse and there is nothing to do.
+//
+// GrowSparse only grows a sparse checkout that already exists: CloneRepo
+// never makes one, so the repository must have been made sparse by other
+// means, e.g. git sparse-checkout. It also never fetches: the blobs of the
+// newly included files must already be in the object store, as they are
+// in any clone made by go-git, which does not support partial clones. On
+// a partial clone made with git clone --filter, the checkout fails with a
+// missing object error instead.
+func GrowSparse(ctx context.Context, storage billy.Filesystem, repoPath string, paths []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sparseFile := filepath.Join(repoPath, ".git", "info", "sparse-checkout")
+	current, err := readSparseCheckout(storage, sparseFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dirs := current
+	for _, p := range paths {
+		p = strings.Trim(filepath.ToSlash(filepath.Clean(p)), "/")
+		if p == "" || p == "." {
+			continue
+		}
+		if p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("sparse checkout path %q is outside of the repository", p)
+		}
+		if !slices.Contains(dirs, p) {
+			dirs = append(dirs, p)
+		}
+	}
+	if len(dirs) == len(current) {
+		return nil
+	}
+
+	repo, err := openRepo(storage, repoPath)
 	if err != nil {
-		return false, fmt.Errorf("mkdir %q: %w", opts.Path, err)
-	}
-	reference := parsed.Fragment
-	if reference == "" && opts.SingleBranch {
-		reference = "refs/heads/main"
+		return err
 	}
-	parsed.RawFragment = ""
-	parsed.Fragment = ""
-	fs, err := opts.Storage.Chroot(opts.Path)
+	head, err := repo.Head()
 	if err != nil {
-		return false, fmt.Errorf("chroot %q: %w", opts.Path, err)
+		return fmt.Errorf("get head: %w", err)
 	}
-	gitDir, err := fs.Chroot(".git")
+	checkoutOpts := &git.CheckoutOptions{
+		SparseCheckoutDirectories: dirs,
+	}
+	if head.Name().IsBranch() {
+		checkoutOpts.Branch = head.Name()
+	} else {
+		checkoutOpts.Hash = head.Hash()
+	}
+	wt, err := repo.Worktree()
 	if err != nil {
-		return false, fmt.Errorf("chroot .git: %w", err)
+		return fmt.Errorf("get worktree: %w", err)
 	}
-	gitStorage := filesystem.NewStorage(gitDir, cache.NewObjectLRU(cache.DefaultMaxSize*10))
-	fsStorage := filesystem.NewStorage(fs, cache.NewObjectLRU(cache.DefaultMaxSize*10))
-	repo, err := git.Open(fsStorage, gitDir)
-	if errors.Is(err, git.ErrRepositoryNotExists) {
-		err = nil
+	if err := wt.Checkout(checkoutOpts); err != nil {
+		return fmt.Errorf("sparse checkout: %w", err)
 	}
+
+	f, err := storage.OpenFile(sparseFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
 	if err != nil {
-		return false, fmt.Errorf("open %q: %w", opts.RepoURL, err)
+		return fmt.Errorf("open %q: %w", sparseFile, err)
 	}
-	if repo != nil {
-		return false, nil
+	defer f.Close()
+	if _, err := f.Write([]byte(strings.Join(dirs, "\n") + "\n")); err != nil {
+		return fmt.Errorf("write %q: %w", sparseFile, err)
 	}
+	return f.Close()
+}
 
-	_, err = git.CloneContext(ctx, gitStorage, fs, &git.CloneOptions{
-		URL:             parsed.String(),
-		Auth:            opts.RepoAuth,
-		Progress:        opts.Progress,
-		ReferenceName:   plumbing.ReferenceName(reference),
-		InsecureSkipTLS: opts.Insecure,
-		Depth:           opts.Depth,
-		SingleBranch:    opts.SingleBranch,
-		CABundle:        opts.CABundle,
-		ProxyOptions:    opts.ProxyOptions,
-	})
-	if errors.Is(err, git.ErrRepositoryAlreadyExists) {
-		return false, nil
+func readSparseCheckout(storage billy.Filesystem, path string) ([]string, error) {
+	f, err := storage.Open(path)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
 	if err != nil {
-		return false, fmt.Errorf("clone %q: %w", opts.RepoURL, err)
+		return nil, fmt.Errorf("read %q: %w", path, err)
 	}
-	return true, nil
+	var dirs []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.Trim(strings.TrimSpace(line), "/")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dirs = append(dirs, line)
+	}
+	return dirs, nil
 }
 
-// ShallowCloneRepo will clone the repository at the given URL into the given path
-// with a depth of 1. If the destination folder exists and is not empty, the
-// clone will not be performed.
+// DiscoverDevcontainers returns the paths, relative to root, of the
+// devcontainer.json files in the worktree at root. They are in the order
+// envbuilder considers them when none is configured:
+// .devcontainer/devcontainer.json, devcontainer.json, then
+// .devcontainer/<folder>/devcontainer.json sorted by folder.
 //
-// The bool returned states whether the repository was cloned or not.
-func ShallowCloneRepo(ctx context.Context, opts CloneRepoOptions) error {
-	opts.Depth = 1
-	opts.SingleBranch = true
+// Only materialized files are returned. If the worktree is a sparse
+// checkout, files outside the sparse checkout set are skipped even if they
+// are left over on disk.
+func DiscoverDevcontainers(fs billy.Filesystem, root string) ([]string, error) {
+	sparse, err := readSparseCheckout(fs, filepath.Join(root, ".git", "info", "sparse-checkout"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	candidates := []string{
+		".devcontainer/devcontainer.json",
+		"devcontainer.json",
+	}
+	entries, err := fs.ReadDir(filepath.Join(root, ".devcontainer"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read .devcontainer: %w", err)
+	}
+	var folders []string
+	for _, e := range entries {
+		if e.IsDir() {
+			folders = append(folders, e.Name())
+		}
+	}
+	slices.Sort(folders)
+	for _, f := range folders {
+		candidates = append(candidates, path.Join(".devcontainer", f, "devcontainer.json"))
+	}
+	var found []string
+	for _, c := range candidates {
+		// Like go-git, the sparse checkout set is matched by prefix.
+		if sparse != nil && !slices.ContainsFunc(sparse, func(dir string) bool {
+			return strings.HasPrefix(c, dir)
+		}) {
+			continue
+		}
+		info, err := fs.Stat(filepath.Join(root, filepath.FromSlash(c)))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stat %q: %w", c, err)
+		}
+		if info.Mode().IsRegular() {
+			found = append(found, c)
+		}
+	}
+	return found, nil
+}
 
-	if opts.Path == "" {
-		return errors.New("path is required")
+// ErrCommitGraphShallow is returned by WriteCommitGraph for shallow
+// repositories, whose history is incomplete. Git itself ignores
+// commit-graph files in shallow repositories.
+var ErrCommitGraphShallow = errors.New("commit-graph is not supported for shallow repositories")
+
+// WriteCommitGraph writes .git/objects/info/commit-graph for the repository
+// at path, covering every commit in the object store. It returns the number
+// of commits written.
+func WriteCommitGraph(storage billy.Filesystem, path string) (int, error) {
+	repo, err := openRepo(storage, path)
+	if err != nil {
+		return 0, err
+	}
+	shallow, err := repo.Storer.Shallow()
+	if err != nil {
+		return 0, fmt.Errorf("read shallow commits: %w", err)
+	}
+	if len(shallow) > 0 {
+		return 0, ErrCommitGraphShallow
 	}
 
-	// Avoid clobbering the destination.
-	if _, err := opts.Storage.Stat(opts.Path); err == nil {
-		files, err := opts.Storage.ReadDir(opts.Path)
+	commits := map[plumbing.Hash]*object.Commit{}
+	iter, err := repo.CommitObjects()
+	if err != nil {
+		return 0, fmt.Errorf("list commits: %w", err)
+	}
+	err = iter.ForEach(func(c *object.Commit) error {
+		commits[c.Hash] = c
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("list commits: %w", err)
+	}
+
+	// Generation numbers depend on the parents, so walk each commit's
+	// ancestry depth-first without recursion to cope with long histories.
+	data := make(map[plumbing.Hash]*commitgraph.CommitData, len(commits))
+	for _, c := range commits {
+		stack := []*object.Commit{c}
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if _, ok := data[top.Hash]; ok {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			pending := false
+			for _, p := range top.ParentHashes {
+				if _, ok := data[p]; ok {
+					continue
+				}
+				parent, ok := commits[p]
+				if !ok {
+					return 0, fmt.Errorf("commit %s: parent %s: %w", top.Hash, p, plumbing.ErrObjectNotFound)
+				}
+				stack = append(stack, parent)
+				pending = true
+			}
+			if pending {
+				continue
+			}
+			d := &commitgraph.CommitData{
+				TreeHash:     top.TreeHash,
+				ParentHashes: top.ParentHashes,
+				Generation:   1,
+				GenerationV2: uint64(top.Committer.When.Unix()),
+				When:         top.Committer.When,
+			}
+			for _, p := range top.ParentHashes {
+				d.Generation = max(d.Generation, data[p].Generation+1)
+				d.GenerationV2 = max(d.GenerationV2, data[p].GenerationV2+1)
+			}
+			data[top.Hash] = d
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	idx := commitgraph.NewMemoryIndex()
+	for hash, d := range data {
+		idx.Add(hash, d)
+	}
+	infoDir := filepath.Join(path, ".git", "objects", "info")
+	if err := storage.MkdirAll(infoDir, 0o755); err != nil {
+		return 0, fmt.Errorf("mkdir %q: %w", infoDir, err)
+	}
+	// Write to a temporary file first so that git never observes a
+	// partially written commit-graph.
+	f, err := storage.TempFile(infoDir, "commit-graph-")
+	if err != nil {
+		return 0, fmt.Errorf("create commit-graph: %w", err)
+	}
+	err = commitgraph.NewEncoder(f).Encode(idx)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = storage.Remove(f.Name())
+		return 0, fmt.Errorf("encode commit-graph: %w", err)
+	}
+	if err := storage.Rename(f.Name(), filepath.Join(infoDir, "commit-graph")); err != nil {
+		_ = storage.Remove(f.Name())
+		return 0, fmt.Errorf("rename commit-graph: %w", err)
+	}
+	return len(data), nil
+}
+
+// newStorage returns the object storage for the .git directory gitDir.
+// Absolute paths in its alternates are resolved in storage, which
+// AlternateObjectDirs refer to.
+func newStorage(gitDir, storage billy.Filesystem) *filesystem.Storage {
+	return filesystem.NewStorageWithOptions(gitDir, cache.NewObjectLRU(cache.DefaultMaxSize*10), filesystem.Options{
+		AlternatesFS: storage,
+	})
+}
+
+// checkAlternateObjectDirs returns an error if any of
+// opts.AlternateObjectDirs is not an existing directory in opts.Storage.
+func checkAlternateObjectDirs(opts CloneRepoOptions) error {
+	for _, dir := range opts.AlternateObjectDirs {
+		if !path.IsAbs(dir) {
+			return fmt.Errorf("alternate object directory %q must be absolute", dir)
+		}
+		fi, err := opts.Storage.Stat(dir)
 		if err != nil {
-			return fmt.Errorf("read dir %q: %w", opts.Path, err)
+			return fmt.Errorf("alternate object directory: %w", err)
 		}
-		if len(files) > 0 {
-			return fmt.Errorf("directory %q is not empty", opts.Path)
+		if !fi.IsDir() {
+			return fmt.Errorf("alternate object directory %q is not a directory", dir)
 		}
 	}
+	return nil
+}
+
+// writeAlternates writes dirs to the objects/info/alternates file of
+// gitDir.
+func writeAlternates(gitDir billy.Filesystem, dirs []string) error {
+	if err := gitDir.MkdirAll("objects/info", 0o755); err != nil {
+		return fmt.Errorf("create objects/info: %w", err)
+	}
+	var sb strings.Builder
+	for _, dir := range dirs {
+		sb.WriteString(path.Clean(dir) + "\n")
+	}
+	if err := util.WriteFile(gitDir, "objects/info/alternates", []byte(sb.String()), 0o644); err != nil {
+		return fmt.Errorf("write alternates: %w", err)
+	}
+	return nil
+}
 
-	cloned, err := CloneRepo(ctx, opts)
+// openRepo opens an existing repository at path in storage with its
+// worktree rooted at path.
+func openRepo(storage billy.Filesystem, path string) (*git.Repository, error) {
+	fs, err := storage.Chroot(path)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("chroot %q: %w", path, err)
 	}
-	if !cloned {
-		return errors.New("repository already exists")
+	gitDir, err := fs.Chroot(".git")
+	if err != nil {
+		return nil, fmt.Errorf("chroot .git: %w", err)
+	}
+	repo, err := git.Open(newStorage(gitDir, storage), fs)
+	if err != nil {
+		return nil, fmt.Errorf("open %q: %w", path, err)
+	}
+	return repo, nil
+}
+
+// agentKeyCallback wraps the signers callback of SSH agent auth so that
+// only the key matching fingerprint is offered. The fingerprint may be in
+// SHA256 or legacy MD5 form.
+func agentKeyCallback(signers func() ([]ssh.Signer, error), fingerprint string, logf log.Func) func() ([]ssh.Signer, error) {
+	var logOnce sync.Once
+	return func() ([]ssh.Signer, error) {
+		all, err := signers()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range all {
+			if !matchesFingerprint(s.PublicKey(), fingerprint) {
+				continue
+			}
+			logOnce.Do(func() {
+				logf(log.LevelInfo, "🔑 Using %s key %s from SSH agent!", s.PublicKey().Type(), ssh.FingerprintSHA256(s.PublicKey()))
+			})
+			return []ssh.Signer{s}, nil
+		}
+		return nil, fmt.Errorf("no key with fingerprint %s in SSH agent (%d keys)", fingerprint, len(all))
 	}
+}
 
-	return nil
+func matchesFingerprint(key ssh.PublicKey, fingerprint string) bool {
+	md5 := ssh.FingerprintLegacyMD5(key)
+	return fingerprint == ssh.FingerprintSHA256(key) || fingerprint == md5 || fingerprint == "MD5:"+md5
 }
 
 // ReadPrivateKey attempts to read an SSH private key from path
@@ -183,18 +3250,117 @@ func ReadPrivateKey(path string) (gossh.Signer, error) {
 // LogHostKeyCallback is a HostKeyCallback that just logs host keys
 // and does nothing else.
 func LogHostKeyCallback(logger log.Func) gossh.HostKeyCallback {
+	return ObserveHostKeyCallback(logger, nil)
+}
+
+// ObserveHostKeyCallback is like LogHostKeyCallback, but also passes each
+// host key to observe, if it is not nil.
+func ObserveHostKeyCallback(logger log.Func, observe func(host string, key gossh.PublicKey)) gossh.HostKeyCallback {
 	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
 		var sb strings.Builder
 		_ = knownhosts.WriteKnownHost(&sb, hostname, remote, key)
 		// skeema/knownhosts uses a fake public key to determine the host key
 		// algorithms. Ignore this one.
 		if s := sb.String(); !strings.Contains(s, "fake-public-key ZmFrZSBwdWJsaWMga2V5") {
-			logger(log.LevelInfo, "#1: 🔑 Got host key: %s", strings.TrimSpace(s))
+			logger(log.LevelInfo, "🔑 Got host key: %s", strings.TrimSpace(s))
+			if observe != nil {
+				observe(hostname, key)
+			}
 		}
 		return nil
 	}
 }
 
+// HostKeyMismatchError is returned by VerifyHostKey when the key presented
+// by a host is not trusted by the known_hosts file.
+type HostKeyMismatchError struct {
+	// Host is the host:port that was checked.
+	Host string
+	// Key is the key presented by the host.
+	Key gossh.PublicKey
+	// Observed is the SHA256 fingerprint of Key.
+	Observed string
+	// Expected are the SHA256 fingerprints of the keys known for Host.
+	// It is empty if the host is not present in the known_hosts file.
+	Expected []string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	if len(e.Expected) == 0 {
+		return fmt.Sprintf("host %s is not in known hosts: observed %s", e.Host, e.Observed)
+	}
+	return fmt.Sprintf("host key mismatch for %s: observed %s, expected %s", e.Host, e.Observed, strings.Join(e.Expected, ", "))
+}
+
+// errHostKeyObserved aborts the SSH handshake in VerifyHostKey once the host
+// key has been received.
+var errHostKeyObserved = errors.New("host key observed")
+
+// VerifyHostKey connects to host, which may include a port, and checks the
+// host key it presents against the known_hosts file at knownHostsPath.
+// A *HostKeyMismatchError is returned if the key is not trusted.
+func VerifyHostKey(knownHostsPath, host string) error {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, "22")
+	}
+	kh, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("load known hosts %q: %w", knownHostsPath, err)
+	}
+
+	// Asking for the known key types keeps a host with several keys from
+	// presenting one that is not known.
+	algorithms := kh.HostKeyAlgorithms(addr)
+	observed, remote, err := observeHostKey(addr, algorithms)
+	if observed == nil && len(algorithms) > 0 {
+		// The host has none of the known key types, so any key it
+		// presents is a mismatch.
+		observed, remote, err = observeHostKey(addr, nil)
+	}
+	if observed == nil {
+		return fmt.Errorf("get host key from %s: %w", addr, err)
+	}
+
+	err = kh(addr, remote, observed)
+	if err == nil {
+		return nil
+	}
+	var keyErr *xknownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return fmt.Errorf("check host key for %s: %w", addr, err)
+	}
+	mismatch := &HostKeyMismatchError{
+		Host:     addr,
+		Key:      observed,
+		Observed: gossh.FingerprintSHA256(observed),
+	}
+	for _, want := range keyErr.Want {
+		mismatch.Expected = append(mismatch.Expected, gossh.FingerprintSHA256(want.Key))
+	}
+	return mismatch
+}
+
+// observeHostKey returns the host key presented by addr for one of
+// algorithms, or any algorithm if it is empty, along with the address of
+// the host. The key is nil if the handshake failed before it was received.
+func observeHostKey(addr string, algorithms []string) (gossh.PublicKey, net.Addr, error) {
+	var (
+		observed gossh.PublicKey
+		remote   net.Addr
+	)
+	_, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User: "git",
+		HostKeyCallback: func(_ string, r net.Addr, key gossh.PublicKey) error {
+			observed, remote = key, r
+			return errHostKeyObserved
+		},
+		HostKeyAlgorithms: algorithms,
+		Timeout:           30 * time.Second,
+	})
+	return observed, remote, err
+}
+
 // SetupRepoAuth determines the desired AuthMethod based on options.GitURL:
 //
 // | Git URL format          | GIT_USERNAME | GIT_PASSWORD | Auth Method |
@@ -210,29 +3376,81 @@ func LogHostKeyCallback(logger log.Func) gossh.HostKeyCallback {
 //
 // If SSH_PRIVATE_KEY_PATH is set, an SSH private key will be read from
 // that path and the SSH auth method will be configured with that key.
+// Otherwise the SSH agent is used. SetupRepoAuthMethods also returns the
+// agent after the key, for CloneRepo to try if the key is rejected.
 //
-// If SSH_KNOWN_HOSTS is not set, the SSH auth method will be configured
-// to accept and log all host keys. Otherwise, host key checking will be
-// performed as usual.
+// If GIT_SSH_KNOWN_HOSTS_PATH (or the legacy SSH_KNOWN_HOSTS) is not set, the
+// SSH auth method will be configured to accept and log all host keys.
+// Otherwise, host keys will be checked against the given known_hosts file(s).
+//
+// If options.GitSecretFetcher is set, it is called first and the
+// credentials it returns are stored in GIT_USERNAME and GIT_PASSWORD.
 func SetupRepoAuth(options *options.Options) transport.AuthMethod {
-	if options.GitURL == "" {
-		options.Logger(log.LevelInfo, "#1: ❔ No Git URL supplied!")
+	auth, err := SetupRepoAuthE(options)
+	if err != nil {
+		authLogger(options)(log.LevelError, "❌ %s", err.Error())
 		return nil
 	}
-	if strings.HasPrefix(options.GitURL, "http://") || strings.HasPrefix(options.GitURL, "https://") {
+	return auth
+}
+
+// ErrNoSSHKey is returned by SetupRepoAuthE when no SSH key is configured
+// and falling back to the SSH agent is disabled.
+var ErrNoSSHKey = errors.New("no SSH key configured")
+
+// SetupRepoAuthE is like SetupRepoAuth, but returns an error instead of
+// falling back to the SSH agent when no SSH key could be read and
+// options.GitSSHDisableAgentFallback is set.
+func SetupRepoAuthE(options *options.Options) (transport.AuthMethod, error) {
+	if err := fetchCredentials(options); err != nil {
+		return nil, err
+	}
+	methods, err := repoAuthMethods(options, false)
+	if err != nil || len(methods) == 0 {
+		return nil, err
+	}
+	return methods[0], nil
+}
+
+// SetupRepoAuthMethods is like SetupRepoAuthE, but returns every usable
+// AuthMethod in the order they should be tried. For SSH this is the key
+// read from options.GitSSHPrivateKeyPath followed by the SSH agent, unless
+// options.GitSSHDisableAgentFallback is set.
+func SetupRepoAuthMethods(options *options.Options) ([]transport.AuthMethod, error) {
+	if err := fetchCredentials(options); err != nil {
+		return nil, err
+	}
+	return repoAuthMethods(options, true)
+}
+
+// repoAuthMethods returns the candidate AuthMethods for options.GitURL.
+// Unless all is set, it stops at the first one.
+func repoAuthMethods(options *options.Options, all bool) ([]transport.AuthMethod, error) {
+	logf := authLogger(options)
+	if options.GitURL == "" {
+		logf(log.LevelInfo, "❔ No Git URL supplied!")
+		return nil, nil
+	}
+	log.ReportPhase(options.ProgressReporter, log.PhaseResolvingAuth)
+	gitURL, err := NormalizeGitURL(options.GitURL)
+	if err != nil {
+		logf(log.LevelError, "❌ Failed to normalize Git URL: %s", err.Error())
+		gitURL = options.GitURL
+	}
+	if strings.HasPrefix(gitURL, "http://") || strings.HasPrefix(gitURL, "https://") {
 		// Special case: no auth
 		if options.GitUsername == "" && options.GitPassword == "" {
-			options.Logger(log.LevelInfo, "#1: 👤 Using no authentication!")
-			return nil
+			logf(log.LevelInfo, "👤 Using no authentication!")
+			return nil, nil
 		}
 		// Basic Auth
 		// NOTE: we previously inserted the credentials into the repo URL.
 		// This was removed in https://github.com/coder/envbuilder/pull/141
-		options.Logger(log.LevelInfo, "#1: 🔒 Using HTTP basic authentication!")
-		return &githttp.BasicAuth{
+		logf(log.LevelInfo, "🔒 Using HTTP basic authentication!")
+		return []transport.AuthMethod{&githttp.BasicAuth{
 			Username: options.GitUsername,
 			Password: options.GitPassword,
-		}
+		}}, nil
 	}
 
 	// Generally git clones over SSH use the 'git' user, but respect
@@ -242,51 +3460,93 @@ func SetupRepoAuth(options *options.Options) transport.AuthMethod {
 	}
 
 	// Assume SSH auth for all other formats.
-	options.Logger(log.LevelInfo, "#1: 🔑 Using SSH authentication!")
+	logf(log.LevelInfo, "🔑 Using SSH authentication!")
 
-	var signer ssh.Signer
+	var methods []transport.AuthMethod
 	if options.GitSSHPrivateKeyPath != "" {
 		s, err := ReadPrivateKey(options.GitSSHPrivateKeyPath)
 		if err != nil {
-			options.Logger(log.LevelError, "#1: ❌ Failed to read private key from %s: %s", options.GitSSHPrivateKeyPath, err.Error())
+			logf(log.LevelError, "❌ Failed to read private key from %s: %s", options.GitSSHPrivateKeyPath, err.Error())
 		} else {
-			options.Logger(log.LevelInfo, "#1: 🔑 Using %s key!", s.PublicKey().Type())
-			signer = s
+			logf(log.LevelInfo, "🔑 Using %s key!", s.PublicKey().Type())
+			hostKeyCallback, err := knownHostsCallback(options)
+			if err != nil {
+				logf(log.LevelError, "❌ Failed to load known hosts: %s", err.Error())
+				return nil, nil
+			}
+			methods = append(methods, &gitssh.PublicKeys{
+				User:   options.GitUsername,
+				Signer: s,
+				HostKeyCallbackHelper: gitssh.HostKeyCallbackHelper{
+					HostKeyCallback: hostKeyCallback,
+				},
+			})
+			if !all {
+				return methods, nil
+			}
 		}
 	}
 
-	// If no SSH key set, fall back to agent auth.
-	if signer == nil {
-		options.Logger(log.LevelError, "#1: 🔑 No SSH key found, falling back to agent!")
-		auth, err := gitssh.NewSSHAgentAuth(options.GitUsername)
-		if err != nil {
-			options.Logger(log.LevelError, "#1: ❌ Failed to connect to SSH agent: %s", err.Error())
-			return nil // nothing else we can do
+	// If no SSH key set, fall back to agent auth. With a key, the agent is
+	// only tried if the key is rejected.
+	if options.GitSSHDisableAgentFallback {
+		if len(methods) == 0 {
+			return nil, fmt.Errorf("%w and falling back to the SSH agent is disabled", ErrNoSSHKey)
 		}
-		if os.Getenv("SSH_KNOWN_HOSTS") == "" {
-			options.Logger(log.LevelWarn, "#1: 🔓 SSH_KNOWN_HOSTS not set, accepting all host keys!")
-			auth.HostKeyCallback = LogHostKeyCallback(options.Logger)
+		return methods, nil
+	}
+	if len(methods) == 0 {
+		logf(log.LevelError, "🔑 No SSH key found, falling back to agent!")
+	}
+	auth, err := gitssh.NewSSHAgentAuth(options.GitUsername)
+	if err != nil {
+		if len(methods) == 0 {
+			logf(log.LevelError, "❌ Failed to connect to SSH agent: %s", err.Error())
 		}
-		return auth
+		return methods, nil // nothing else we can do
 	}
-
-	auth := &gitssh.PublicKeys{
-		User:   options.GitUsername,
-		Signer: signer,
+	if options.GitSSHAgentKeyFingerprint != "" {
+		auth.Callback = agentKeyCallback(auth.Callback, options.GitSSHAgentKeyFingerprint, logf)
+	}
+	hostKeyCallback, err := knownHostsCallback(options)
+	if err != nil {
+		logf(log.LevelError, "❌ Failed to load known hosts: %s", err.Error())
+		return methods, nil
+	}
+	auth.HostKeyCallback = hostKeyCallback
+	if len(methods) > 0 {
+		logf(log.LevelInfo, "🔑 Falling back to the SSH agent if the key is rejected!")
 	}
+	return append(methods, auth), nil
+}
 
-	// Generally git clones over SSH use the 'git' user, but respect
-	// GIT_USERNAME if set.
-	if auth.User == "" {
-		auth.User = "git"
+// describeAuth returns a loggable description of auth, including the key
+// fingerprint for SSH keys.
+func describeAuth(auth transport.AuthMethod) string {
+	switch auth := auth.(type) {
+	case nil:
+		return "no authentication"
+	case *gitssh.PublicKeys:
+		key := auth.Signer.PublicKey()
+		return fmt.Sprintf("SSH %s key %s", key.Type(), gossh.FingerprintSHA256(key))
+	case *gitssh.PublicKeysCallback:
+		return "SSH agent"
+	case *githttp.BasicAuth:
+		return fmt.Sprintf("HTTP basic authentication as %q", auth.Username)
+	default:
+		return auth.Name()
 	}
+}
 
-	// Duplicated code due to Go's type system.
-	if os.Getenv("SSH_KNOWN_HOSTS") == "" {
-		options.Logger(log.LevelWarn, "#1: 🔓 SSH_KNOWN_HOSTS not set, accepting all host keys!")
-		auth.HostKeyCallback = LogHostKeyCallback(options.Logger)
+// knownHostsCallback returns a HostKeyCallback that checks host keys
+// against options.GitSSHKnownHostsPath. If no known hosts file is
+// configured, all host keys are accepted and logged.
+func knownHostsCallback(options *options.Options) (gossh.HostKeyCallback, error) {
+	if options.GitSSHKnownHostsPath == "" {
+		authLogger(options)(log.LevelWarn, "🔓 SSH known hosts not set, accepting all host keys!")
+		return ObserveHostKeyCallback(optionsLogger(options).Scope(log.PhaseConnecting), options.GitSSHHostKeyObserver), nil
 	}
-	return auth
+	return gitssh.NewKnownHostsCallback(filepath.SplitList(options.GitSSHKnownHostsPath)...)
 }
 
 func CloneOptionsFromOptions(options options.Options) (CloneRepoOptions, error) {
@@ -296,18 +3556,150 @@ func CloneOptionsFromOptions(options options.Options) (CloneRepoOptions, error)
 	}
 
 	cloneOpts := CloneRepoOptions{
-		Path:         options.WorkspaceFolder,
-		Storage:      options.Filesystem,
-		Insecure:     options.Insecure,
-		SingleBranch: options.GitCloneSingleBranch,
-		Depth:        int(options.GitCloneDepth),
-		CABundle:     caBundle,
+		Path:                      options.WorkspaceFolder,
+		Storage:                   options.Filesystem,
+		Insecure:                  options.Insecure,
+		SingleBranch:              options.GitCloneSingleBranch,
+		Depth:                     int(options.GitCloneDepth),
+		Retries:                   int(options.GitCloneRetries),
+		RetryBackoff:              options.GitCloneRetryBackoff,
+		RetryNoJitter:             options.GitCloneRetryNoJitter,
+		MaxBandwidth:              options.GitMaxBandwidthBytesPerSec,
+		CABundle:                  caBundle,
+		SSHDialTimeout:            options.GitSSHDialTimeout,
+		SSHPort:                   int(options.GitSSHPort),
+		SSHCiphers:                options.GitSSHCiphers,
+		SSHKeyExchanges:           options.GitSSHKeyExchanges,
+		GitConfig:                 options.GitConfig,
+		URLRewrites:               options.GitURLRewrites,
+		SubmoduleURLRewrites:      options.GitSubmoduleURLRewrites,
+		Mirrors:                   options.GitMirrors,
+		TagFilter:                 options.GitTagFilter,
+		GiteaHosts:                options.GitGiteaHosts,
+		HostTypes:                 hostTypes(options.GitHostTypeOverrides),
+		CheckoutRemoteRef:         options.GitCheckoutRemoteRef,
+		FollowRedirectCredentials: options.GitFollowRedirectCredentials,
+		MaxRedirects:              int(options.GitMaxRedirects),
+		HTTPAnonymousFirst:        options.GitHTTPAnonymousFirst,
+		RequiredPaths:             options.RequiredPaths,
+		ExcludePaths:              options.GitExcludePaths,
+		AlternateObjectDirs:       options.GitAlternateObjectDirs,
+		PruneMode:                 PruneMode(options.GitPruneAfterClone),
+		ProtocolVersion:           ProtocolVersion(options.GitProtocolVersion),
+		MaxResolveWorkers:         int(options.GitMaxResolveWorkers),
+		CheckoutWorkers:           int(options.GitCheckoutWorkers),
+		WriteCommitGraph:          options.GitWriteCommitGraph,
+		ForceReclone:              options.GitForceReclone,
+		MismatchPolicy:            MismatchPolicy(options.GitMismatchPolicy),
+		ArchiveURL:                options.GitArchiveURL,
+		ResolveHostToIP:           options.GitResolveHostToIP,
+		TLSServerName:             options.GitTLSServerName,
+		CachePath:                 options.GitCachePath,
+		TempDir:                   options.GitTempDir,
+		RequireExplicitRef:        options.GitRequireExplicitRef,
+		VerifyHead:                options.GitVerifyHead,
+		VerifyHeadStrict:          options.GitVerifyHeadStrict,
+		VerifyObjects:             options.GitVerifyObjects,
+		AutoCRLF:                  options.GitAutoCRLF,
+		DisableSymlinks:           options.GitDisableSymlinks,
+		ApplyAttributes:           options.GitApplyAttributes,
+		MaxFiles:                  int(options.GitMaxFileCount),
+		Transport:                 options.GitTransport,
+		Logger:                    options.Logger,
+		LogPrefix:                 log.PrefixerFor(options.LogPrefixStyle),
+		ProgressReporter:          options.ProgressReporter,
+		Verbose:                   options.Verbose,
+	}
+	if options.GitCloner == "cli" {
+		cloneOpts.Cloner = CLIGitCloner{}
+	}
+
+	if options.GitTLSClientCertPath != "" || options.GitTLSClientKeyPath != "" {
+		cloneOpts.TLSClientCert, err = os.ReadFile(options.GitTLSClientCertPath)
+		if err != nil {
+			return CloneRepoOptions{}, fmt.Errorf("read TLS client certificate: %w", err)
+		}
+		cloneOpts.TLSClientKey, err = os.ReadFile(options.GitTLSClientKeyPath)
+		if err != nil {
+			return CloneRepoOptions{}, fmt.Errorf("read TLS client key: %w", err)
+		}
 	}
 
-	cloneOpts.RepoAuth = SetupRepoAuth(&options)
+	if err := readCredentialFiles(&options); err != nil {
+		return CloneRepoOptions{}, err
+	}
+	if err := fetchCredentials(&options); err != nil {
+		return CloneRepoOptions{}, err
+	}
+	// repoAuthMethods defaults the username for SSH, so it is called
+	// directly rather than through SetupRepoAuthMethods, which would fetch
+	// the credentials again.
+	httpUsername := options.GitUsername
+	authMethods, err := repoAuthMethods(&options, true)
+	if err != nil {
+		return CloneRepoOptions{}, err
+	}
+	if len(options.GitAdditionalRemotes) > 0 {
+		remoteOptions := options
+		remoteOptions.GitUsername = httpUsername
+		cloneOpts.AdditionalRemotes, err = additionalRemotes(remoteOptions)
+		if err != nil {
+			return CloneRepoOptions{}, err
+		}
+	}
+	if len(authMethods) > 0 {
+		cloneOpts.RepoAuth, cloneOpts.FallbackAuth = authMethods[0], authMethods[1:]
+	}
+	if _, isSSH := cloneOpts.RepoAuth.(gitssh.AuthMethod); isSSH && options.GitSSHToHTTPSFallback {
+		if options.GitPassword == "" {
+			authLogger(&options)(log.LevelWarn, "⚠️ Not falling back to HTTPS if SSH fails: no HTTP credentials are set")
+		} else {
+			cloneOpts.SSHFallbackAuth = &githttp.BasicAuth{
+				Username: httpUsername,
+				Password: options.GitPassword,
+			}
+		}
+	}
 	if options.GitHTTPProxyURL != "" {
 		cloneOpts.ProxyOptions = transport.ProxyOptions{
-			URL: options.GitHTTPProxyURL,
+			URL:      options.GitHTTPProxyURL,
+			Username: options.GitHTTPProxyUsername,
+			Password: options.GitHTTPProxyPassword,
+		}
+		authLogger(&options)(log.LevelInfo, "🌐 Using HTTP proxy %s", redactProxyURL(cloneOpts.ProxyOptions))
+	}
+	if options.GitSafeDirectory {
+		cloneOpts.SafeDirectoryConfig = options.GitSafeDirectoryConfig
+		if cloneOpts.SafeDirectoryConfig == "" {
+			cloneOpts.SafeDirectoryConfig = DefaultSafeDirectoryConfig
+		}
+		cloneOpts.SafeDirectoryWildcard = options.GitSafeDirectoryWildcard
+	}
+	if options.GitRepackAfterClone {
+		cloneOpts.Repack = &RepackConfig{
+			Window:       int(options.GitRepackWindow),
+			Depth:        int(options.GitRepackDepth),
+			WriteBitmaps: options.GitRepackWriteBitmaps,
+		}
+	}
+	if len(options.GitDNSServers) > 0 {
+		resolver, err := NewResolver(options.GitDNSServers)
+		if err != nil {
+			return CloneRepoOptions{}, err
+		}
+		cloneOpts.Resolver = resolver
+	}
+	if len(options.GitHostAliases) > 0 {
+		resolver, err := NewHostAliasResolver(options.GitHostAliases, cloneOpts.Resolver)
+		if err != nil {
+			return CloneRepoOptions{}, err
+		}
+		cloneOpts.Resolver = resolver
+	}
+	if len(options.GitPathCredentials) > 0 {
+		cloneOpts.PathCredentials, err = ParsePathCredentials(options.GitPathCredentials)
+		if err != nil {
+			return CloneRepoOptions{}, err
 		}
 	}
 	cloneOpts.RepoURL = options.GitURL
@@ -315,6 +3707,74 @@ func CloneOptionsFromOptions(options options.Options) (CloneRepoOptions, error)
 	return cloneOpts, nil
 }
 
+// readCredentialFiles reads options.GitUsernameFile and
+// options.GitPasswordFile, if set, into options.GitUsername and
+// options.GitPassword. The files take precedence over the inline values.
+func readCredentialFiles(options *options.Options) error {
+	logf := authLogger(options)
+	creds := []struct {
+		name string
+		path string
+		dst  *string
+	}{
+		{"username", options.GitUsernameFile, &options.GitUsername},
+		{"password", options.GitPasswordFile, &options.GitPassword},
+	}
+	for _, c := range creds {
+		if c.path == "" {
+			continue
+		}
+		b, err := os.ReadFile(c.path)
+		if err != nil {
+			return fmt.Errorf("read Git %s file: %w", c.name, err)
+		}
+		*c.dst = strings.TrimRight(string(b), "\r\n")
+		logf(log.LevelInfo, "🔒 Using Git %s from %s", c.name, c.path)
+	}
+	return nil
+}
+
+// secretFetchTimeout bounds options.GitSecretFetcher.
+const secretFetchTimeout = 30 * time.Second
+
+// fetchCredentials calls options.GitSecretFetcher, if set and there is a
+// Git URL, and stores the credentials in options.GitUsername and
+// options.GitPassword.
+func fetchCredentials(options *options.Options) error {
+	if options.GitSecretFetcher == nil || options.GitURL == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+	defer cancel()
+	username, password, err := options.GitSecretFetcher(ctx)
+	if err != nil {
+		return fmt.Errorf("fetch Git credentials: %w", err)
+	}
+	options.GitUsername, options.GitPassword = username, password
+	authLogger(options)(log.LevelInfo, "🔒 Using Git credentials from the secret fetcher")
+	return nil
+}
+
+// authLogger returns options.Logger prefixed for the authentication phase.
+func authLogger(options *options.Options) log.Func {
+	return optionsLogger(options).Scope(log.PhaseResolvingAuth)
+}
+
+// optionsLogger returns options.Logger labeled in options.LogPrefixStyle.
+func optionsLogger(options *options.Options) log.Logger {
+	return log.Logger{Func: options.Logger, Prefix: log.PrefixerFor(options.LogPrefixStyle)}
+}
+
+// redactProxyURL returns the proxy URL, including any credentials from
+// opts, with the password masked so that it is safe to log.
+func redactProxyURL(opts transport.ProxyOptions) string {
+	u, err := opts.FullURL()
+	if err != nil {
+		return "<invalid proxy URL>"
+	}
+	return u.Redacted()
+}
+
 type progressWriter struct {
 	io.WriteCloser
 	r    io.ReadCloser
@@ -0,0 +1,313 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coder/envbuilder/testutil/gittest"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithUnsupportedCapabilities(t *testing.T) {
+	// Not parallel: this mutates transport.UnsupportedCapabilities.
+	saved := append([]capability.Capability(nil), transport.UnsupportedCapabilities...)
+
+	t.Run("Restores", func(t *testing.T) {
+		caps := []capability.Capability{capability.ThinPack}
+		err := withUnsupportedCapabilities(caps, func() error {
+			require.Equal(t, caps, transport.UnsupportedCapabilities)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, saved, transport.UnsupportedCapabilities)
+	})
+
+	t.Run("RestoresOnError", func(t *testing.T) {
+		want := errors.New("clone failed")
+		err := withUnsupportedCapabilities(nil, func() error {
+			require.Empty(t, transport.UnsupportedCapabilities)
+			return want
+		})
+		require.ErrorIs(t, err, want)
+		require.Equal(t, saved, transport.UnsupportedCapabilities)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for _, c := range []capability.Capability{capability.ThinPack, capability.OFSDelta, capability.Sideband} {
+			caps := []capability.Capability{c}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_ = withUnsupportedCapabilities(caps, func() error {
+					// No other caller may change the value while fn runs.
+					for i := 0; i < 100; i++ {
+						if len(transport.UnsupportedCapabilities) != 1 || transport.UnsupportedCapabilities[0] != caps[0] {
+							t.Errorf("capabilities changed while overridden: %v", transport.UnsupportedCapabilities)
+							return nil
+						}
+					}
+					return nil
+				})
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, saved, transport.UnsupportedCapabilities)
+	})
+}
+
+func TestAdvertisedHead(t *testing.T) {
+	t.Parallel()
+
+	const (
+		mainSHA  = "1111111111111111111111111111111111111111"
+		tagSHA   = "2222222222222222222222222222222222222222"
+		peeled   = "3333333333333333333333333333333333333333"
+		lightSHA = "4444444444444444444444444444444444444444"
+	)
+	refs := []*plumbing.Reference{
+		plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/main"),
+		plumbing.NewReferenceFromStrings("refs/heads/main", mainSHA),
+		plumbing.NewReferenceFromStrings("refs/tags/v1", tagSHA),
+		plumbing.NewReferenceFromStrings("refs/tags/v1^{}", peeled),
+		plumbing.NewReferenceFromStrings("refs/tags/v2", lightSHA),
+	}
+	for _, tc := range []struct {
+		ref  plumbing.ReferenceName
+		want string
+	}{
+		{ref: "", want: mainSHA},
+		{ref: "main", want: mainSHA},
+		{ref: "refs/heads/main", want: mainSHA},
+		{ref: "v1", want: peeled},
+		{ref: "refs/tags/v2", want: lightSHA},
+	} {
+		_, got, err := advertisedHead(refs, tc.ref)
+		require.NoError(t, err, tc.ref)
+		require.Equal(t, tc.want, got.String(), tc.ref)
+	}
+
+	_, _, err := advertisedHead(refs, "missing")
+	require.ErrorContains(t, err, `remote does not advertise "missing"`)
+}
+
+func TestAskpass(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ap, err := startAskpass(dir, "user", "tok'en")
+	require.NoError(t, err)
+
+	ask := func(prompt string) string {
+		t.Helper()
+		out, err := exec.Command(ap.script, prompt).Output()
+		require.NoError(t, err)
+		return string(out)
+	}
+	// git asks again when retrying, so each answer can be read repeatedly.
+	for i := 0; i < 2; i++ {
+		require.Equal(t, "user\n", ask("Username for 'https://example.com': "))
+		require.Equal(t, "tok'en\n", ask("Password for 'https://user@example.com': "))
+	}
+	script, err := os.ReadFile(ap.script)
+	require.NoError(t, err)
+	require.NotContains(t, string(script), "tok")
+
+	ap.Close()
+	// Nothing is served once closed.
+	f, err := os.OpenFile(filepath.Join(dir, "password"), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	n, _ := f.Read(make([]byte, 16))
+	require.Zero(t, n)
+}
+
+func TestResolveCommit(t *testing.T) {
+	t.Parallel()
+
+	// With more commits than hex digits, some first digit is shared.
+	commits := make([]gittest.CommitFunc, 20)
+	for i := range commits {
+		commits[i] = gittest.Commit(t, "README.md", fmt.Sprintf("commit %d", i), fmt.Sprintf("Commit %d", i))
+	}
+	repo := gittest.NewRepo(t, memfs.New(), commits...)
+	head, err := repo.Head()
+	require.NoError(t, err)
+	byDigit := map[byte]int{}
+	iter, err := repo.CommitObjects()
+	require.NoError(t, err)
+	require.NoError(t, iter.ForEach(func(c *object.Commit) error {
+		byDigit[c.Hash.String()[0]]++
+		return nil
+	}))
+	var shared string
+	for digit, n := range byDigit {
+		if n > 1 {
+			shared = string(digit)
+		}
+	}
+	require.NotEmpty(t, shared)
+
+	hash, err := resolveCommit(repo, head.Hash().String()[:7])
+	require.NoError(t, err)
+	require.Equal(t, head.Hash(), hash)
+	hash, err = resolveCommit(repo, head.Hash().String())
+	require.NoError(t, err)
+	require.Equal(t, head.Hash(), hash)
+	_, err = resolveCommit(repo, shared)
+	require.ErrorIs(t, err, ErrAmbiguousRef)
+	_, err = resolveCommit(repo, strings.Repeat("0", 40))
+	require.ErrorIs(t, err, ErrRefNotFound)
+}
+
+func TestIsCommitRef(t *testing.T) {
+	t.Parallel()
+
+	for ref, want := range map[string]bool{
+		"abc1234": true,
+		"ABC1234": true,
+		"0123456789abcdef0123456789abcdef01234567": true,
+		"abc123":             false,
+		"main":               false,
+		"abc123g":            false,
+		"refs/heads/abc1234": false,
+		"0123456789abcdef0123456789abcdef012345678": false,
+	} {
+		require.Equal(t, want, isCommitRef(ref), ref)
+	}
+}
+
+func TestShallowRefError(t *testing.T) {
+	t.Parallel()
+
+	repo := gittest.NewRepo(t, memfs.New(), gittest.Commit(t, "README.md", "Hello, world!", "Wow!"))
+	_, notFound := resolveCommit(repo, "0000000")
+	require.ErrorIs(t, notFound, ErrRefNotFound)
+
+	err := shallowRefError("0000000", 5, notFound)
+	require.ErrorIs(t, err, ErrRefNotInShallow)
+	require.ErrorIs(t, err, ErrRefNotFound)
+	require.ErrorContains(t, err, "0000000 is not within the last 5 commits")
+
+	// Without a depth the commit does not exist at all.
+	require.Equal(t, notFound, shallowRefError("0000000", 0, notFound))
+	// Other failures are left alone.
+	other := errors.New("boom")
+	require.Equal(t, other, shallowRefError("0000000", 5, other))
+}
+
+// swappedObjects returns obj for every object requested.
+type swappedObjects struct {
+	*memory.Storage
+	obj plumbing.EncodedObject
+}
+
+func (s swappedObjects) EncodedObject(plumbing.ObjectType, plumbing.Hash) (plumbing.EncodedObject, error) {
+	return s.obj, nil
+}
+
+func TestVerifyObject(t *testing.T) {
+	t.Parallel()
+
+	s := memory.NewStorage()
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Hello, world!"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	hash, err := s.SetEncodedObject(obj)
+	require.NoError(t, err)
+
+	_, err = verifyObject(s, plumbing.BlobObject, hash)
+	require.NoError(t, err)
+
+	missing := plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")
+	_, err = verifyObject(s, plumbing.BlobObject, missing)
+	require.ErrorIs(t, err, ErrCorruptObjects)
+	require.ErrorContains(t, err, "blob "+missing.String()+" is missing")
+
+	// The storage returns other content than was asked for.
+	_, err = verifyObject(swappedObjects{Storage: s, obj: obj}, plumbing.BlobObject, missing)
+	require.ErrorIs(t, err, ErrCorruptObjects)
+	require.ErrorContains(t, err, "hashes to "+hash.String())
+}
+
+func TestPullRequestRefs(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		url   string
+		gitea []string
+		types map[string]HostType
+		want  []plumbing.ReferenceName
+	}{
+		{url: "https://github.com/coder/envbuilder", want: []plumbing.ReferenceName{"refs/pull/1/head"}},
+		{url: "https://gitlab.com/coder/envbuilder", want: []plumbing.ReferenceName{"refs/merge-requests/1/head"}},
+		{url: "https://git.example.com/scm/coder/envbuilder.git", want: []plumbing.ReferenceName{"refs/pull-requests/1/from"}},
+		{url: "https://gitea.example.com/coder/envbuilder", want: []plumbing.ReferenceName{"refs/pull/1/head"}},
+		{url: "https://codeberg.org/coder/envbuilder", want: []plumbing.ReferenceName{"refs/pull/1/head"}},
+		{url: "https://git.example.com/coder/envbuilder", gitea: []string{"GIT.example.com"}, want: []plumbing.ReferenceName{"refs/pull/1/head"}},
+		// A listed host wins over its name.
+		{url: "https://gitlab.example.com/coder/envbuilder", gitea: []string{"gitlab.example.com"}, want: []plumbing.ReferenceName{"refs/pull/1/head"}},
+		{url: "https://git.example.com/coder/envbuilder", types: map[string]HostType{"git.example.com": HostGitLab}, want: []plumbing.ReferenceName{"refs/merge-requests/1/head"}},
+		// An override wins over the Gitea hosts.
+		{url: "https://git.example.com/coder/envbuilder", gitea: []string{"git.example.com"}, types: map[string]HostType{"git.example.com": HostBitbucket}, want: []plumbing.ReferenceName{"refs/pull-requests/1/from"}},
+		{url: "https://git.example.com/coder/envbuilder", want: []plumbing.ReferenceName{"refs/pull/1/head", "refs/merge-requests/1/head", "refs/pull-requests/1/from"}},
+	} {
+		u, err := url.Parse(tc.url)
+		require.NoError(t, err)
+		opts := CloneRepoOptions{GiteaHosts: tc.gitea, HostTypes: tc.types}
+		require.Equal(t, tc.want, pullRequestRefs(u, "1", opts.hostType(u.Hostname())), tc.url)
+	}
+}
+
+func TestHTTPSURLForSSH(t *testing.T) {
+	t.Parallel()
+
+	for repoURL, want := range map[string]string{
+		"git@github.com:coder/envbuilder.git":                 "https://github.com/coder/envbuilder.git",
+		"ssh://git@github.com:2222/coder/envbuilder.git#main": "https://github.com/coder/envbuilder.git#main",
+		"ssh://[::1]/repo.git":                                "https://[::1]/repo.git",
+		"https://github.com/coder/envbuilder.git":             "",
+		"/srv/repo.git":                                       "",
+	} {
+		got, ok := httpsURLForSSH(repoURL)
+		require.Equal(t, want != "", ok, repoURL)
+		require.Equal(t, want, got, repoURL)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	b := newTokenBucket(1000)
+	start := time.Now()
+	// A second's worth is available up front.
+	require.NoError(t, b.wait(context.Background(), 1000))
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+	// Going into debt waits for it to be repaid.
+	require.NoError(t, b.wait(context.Background(), 500))
+	require.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, b.wait(ctx, 1000), context.Canceled)
+}
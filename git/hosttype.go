@@ -0,0 +1,97 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HostType identifies the software serving a Git host, for behavior that
+// depends on it, such as where pull requests are published.
+type HostType string
+
+const (
+	// HostUnknown is a host that could not be identified. Behavior that
+	// depends on the host type tries each known layout.
+	HostUnknown HostType = "unknown"
+	// HostGitHub is GitHub or GitHub Enterprise.
+	HostGitHub HostType = "github"
+	// HostGitLab is GitLab.
+	HostGitLab HostType = "gitlab"
+	// HostBitbucket is Bitbucket Cloud or Bitbucket Server.
+	HostBitbucket HostType = "bitbucket"
+	// HostGitea is Gitea or Forgejo.
+	HostGitea HostType = "gitea"
+	// HostAzureDevOps is Azure DevOps.
+	HostAzureDevOps HostType = "azure-devops"
+)
+
+// Validate returns an error if t is not a known host type. The empty
+// string is treated as HostUnknown.
+func (t HostType) Validate() error {
+	switch t {
+	case "", HostUnknown, HostGitHub, HostGitLab, HostBitbucket, HostGitea, HostAzureDevOps:
+		return nil
+	default:
+		return fmt.Errorf("invalid host type %q: must be one of unknown, github, gitlab, bitbucket, gitea, azure-devops", t)
+	}
+}
+
+// DetectHostType infers the type of host from its name: dev.azure.com is
+// Azure DevOps, codeberg.org is Gitea, and other hosts are identified by
+// the product they are named after. Self-hosted servers on custom domains
+// are HostUnknown, and can be set with CloneRepoOptions.HostTypes.
+func DetectHostType(host string) HostType {
+	host = strings.ToLower(host)
+	switch {
+	case host == "dev.azure.com":
+		return HostAzureDevOps
+	case host == "codeberg.org", strings.Contains(host, "gitea"), strings.Contains(host, "forgejo"):
+		return HostGitea
+	case strings.Contains(host, "github"):
+		return HostGitHub
+	case strings.Contains(host, "gitlab"):
+		return HostGitLab
+	case strings.Contains(host, "bitbucket"):
+		return HostBitbucket
+	default:
+		return HostUnknown
+	}
+}
+
+// hostType returns the type of host: the one set in HostTypes, HostGitea
+// if it is one of GiteaHosts, or the one DetectHostType infers.
+func (opts CloneRepoOptions) hostType(host string) HostType {
+	for h, t := range opts.HostTypes {
+		if strings.EqualFold(host, h) && t != "" {
+			return t
+		}
+	}
+	for _, h := range opts.GiteaHosts {
+		if strings.EqualFold(host, h) {
+			return HostGitea
+		}
+	}
+	return DetectHostType(host)
+}
+
+// validateHostTypes returns an error if a type in HostTypes is unknown.
+func (opts CloneRepoOptions) validateHostTypes() error {
+	for host, t := range opts.HostTypes {
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("host %s: %w", host, err)
+		}
+	}
+	return nil
+}
+
+// hostTypes converts the host type overrides of the options.
+func hostTypes(overrides map[string]string) map[string]HostType {
+	if overrides == nil {
+		return nil
+	}
+	types := make(map[string]HostType, len(overrides))
+	for host, t := range overrides {
+		types[host] = HostType(strings.ToLower(t))
+	}
+	return types
+}
@@ -0,0 +1,131 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	giturls "github.com/chainguard-dev/git-urls"
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+)
+
+// mirrorRefSpec fetches every ref of the remote to the same name, like
+// git clone --mirror.
+const mirrorRefSpec = config.RefSpec("+refs/*:refs/*")
+
+// mirrorLocks serializes WarmMirror calls for the same cache path.
+var mirrorLocks sync.Map
+
+// WarmMirror maintains a bare mirror of repoURL at cachePath in
+// opts.Storage, cloning it if cachePath has no repository yet and
+// fetching all refs otherwise, so that build farms can pre-seed caches.
+// The objects directory of the mirror, cachePath/objects, can be passed
+// to CloneRepo in AlternateObjectDirs. RepoAuth, CABundle, Insecure,
+// ProxyOptions and the SSH and HTTP connection settings in opts are used;
+// RepoURL and Path are ignored. It is safe to call concurrently; calls
+// for the same cachePath wait for each other.
+func WarmMirror(ctx context.Context, repoURL, cachePath string, opts CloneRepoOptions) error {
+	if !path.IsAbs(cachePath) {
+		return fmt.Errorf("mirror path %q must be absolute", cachePath)
+	}
+	cachePath = path.Clean(cachePath)
+	opts.Logger = log.Correlated(opts.Logger, log.CorrelationID(ctx))
+	mu, _ := mirrorLocks.LoadOrStore(cachePath, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	normalized, err := NormalizeGitURL(RewriteGitURL(repoURL, opts.URLRewrites))
+	if err != nil {
+		return err
+	}
+	parsed, err := giturls.Parse(normalized)
+	if err != nil {
+		return fmt.Errorf("parse url %q: %w", redactURL(repoURL), err)
+	}
+	if parsed.Scheme == "ssh" && parsed.Port() == "" && opts.SSHPort > 0 {
+		parsed.Host = net.JoinHostPort(parsed.Hostname(), strconv.Itoa(opts.SSHPort))
+	}
+	parsed.RawFragment = ""
+	parsed.Fragment = ""
+	remoteURL := parsed.String()
+
+	if err := opts.Storage.MkdirAll(cachePath, 0o755); err != nil {
+		return fmt.Errorf("mkdir %q: %w", cachePath, err)
+	}
+	dir, err := opts.Storage.Chroot(cachePath)
+	if err != nil {
+		return fmt.Errorf("chroot %q: %w", cachePath, err)
+	}
+	storage := newStorage(dir, opts.Storage)
+	repo, err := git.Open(storage, nil)
+	switch {
+	case errors.Is(err, git.ErrRepositoryNotExists):
+		repo, err = git.Init(storage, nil)
+		if err != nil {
+			return fmt.Errorf("init mirror %q: %w", cachePath, err)
+		}
+		_, err = repo.CreateRemote(&config.RemoteConfig{
+			Name:   git.DefaultRemoteName,
+			URLs:   []string{remoteURL},
+			Fetch:  []config.RefSpec{mirrorRefSpec},
+			Mirror: true,
+		})
+		if err != nil {
+			return fmt.Errorf("create remote: %w", err)
+		}
+		opts.logf(log.PhaseCloning, log.LevelInfo, "🪞 Creating mirror of %s at %s", redactURL(repoURL), cachePath)
+	case err != nil:
+		return fmt.Errorf("open mirror %q: %w", cachePath, err)
+	default:
+		if err := checkMirrorRemote(repo, remoteURL); err != nil {
+			return fmt.Errorf("mirror %q: %w", cachePath, err)
+		}
+		opts.logf(log.PhaseCloning, log.LevelInfo, "🪞 Updating mirror of %s at %s", redactURL(repoURL), cachePath)
+	}
+
+	ctx, auth := connectAuth(ctx, parsed, opts)
+	fetchURL, uninstall, err := installAuthEscalation(ctx, remoteURL)
+	if err != nil {
+		return err
+	}
+	defer uninstall()
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName:      git.DefaultRemoteName,
+		RemoteURL:       fetchURL,
+		RefSpecs:        []config.RefSpec{mirrorRefSpec},
+		Auth:            auth,
+		Progress:        opts.Progress,
+		Tags:            git.NoTags,
+		Force:           true,
+		Prune:           true,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("fetch %q: %w", redactURL(repoURL), err)
+	}
+	return nil
+}
+
+// checkMirrorRemote returns an error if the origin of the mirror repo is
+// not remoteURL, so that a cache path is never shared by two
+// repositories.
+func checkMirrorRemote(repo *git.Repository, remoteURL string) error {
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return fmt.Errorf("get remote: %w", err)
+	}
+	urls := remote.Config().URLs
+	if len(urls) == 0 || strings.TrimSuffix(urls[0], "/") != strings.TrimSuffix(remoteURL, "/") {
+		return fmt.Errorf("is a mirror of %s, not %s", redactURL(strings.Join(urls, ", ")), redactURL(remoteURL))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// MismatchPolicy controls how CloneRepo handles an existing repository
+// whose origin URL or checked out branch differs from the requested one.
+type MismatchPolicy string
+
+const (
+	// MismatchIgnore logs a warning and keeps the existing repository.
+	MismatchIgnore MismatchPolicy = "ignore"
+	// MismatchError fails with ErrRepoMismatch.
+	MismatchError MismatchPolicy = "error"
+	// MismatchCheckout fetches and checks out the requested ref. A changed
+	// origin URL cannot be reconciled this way and is recloned instead.
+	MismatchCheckout MismatchPolicy = "checkout"
+	// MismatchReclone removes the existing repository and clones again.
+	MismatchReclone MismatchPolicy = "reclone"
+)
+
+// Validate returns an error if p is not a known mismatch policy. The empty
+// string is treated as MismatchIgnore.
+func (p MismatchPolicy) Validate() error {
+	switch p {
+	case "", MismatchIgnore, MismatchError, MismatchCheckout, MismatchReclone:
+		return nil
+	default:
+		return fmt.Errorf("invalid mismatch policy %q: must be one of ignore, error, checkout, reclone", p)
+	}
+}
+
+// ErrRepoMismatch is returned by CloneRepo with MismatchError when the
+// existing repository does not match the requested URL or ref.
+var ErrRepoMismatch = errors.New("existing repository does not match the requested one")
+
+// handleMismatch applies opts.MismatchPolicy to the existing repository.
+// It reports whether CloneRepo is done, i.e. the existing repository should
+// be used as is. If it returns false without an error, the existing
+// repository was removed and should be cloned again.
+func handleMismatch(ctx context.Context, repo *git.Repository, opts CloneRepoOptions, cloneURL, ref string) (bool, error) {
+	urlChanged, reason := repoMismatch(repo, cloneURL, ref)
+	if reason == "" {
+		return true, nil
+	}
+	policy := opts.MismatchPolicy
+	if policy == MismatchCheckout && urlChanged {
+		policy = MismatchReclone
+	}
+	switch policy {
+	case MismatchError:
+		return true, fmt.Errorf("%w: %s", ErrRepoMismatch, reason)
+	case MismatchReclone:
+		return false, removeExistingRepo(opts, cloneURL)
+	case MismatchCheckout:
+		opts.logf(log.PhaseCheckingOut, log.LevelInfo, "🔀 Existing repository does not match (%s), checking out %s", reason, ref)
+		return true, checkoutBranchOrRef(ctx, repo, ref, opts.RepoAuth)
+	default:
+		opts.logf(log.PhaseCheckingOut, log.LevelWarn, "⚠️ Existing repository does not match (%s), using it anyway", reason)
+		return true, nil
+	}
+}
+
+// repoMismatch compares the origin URL and HEAD of repo to the requested
+// ones and describes any difference. If ref is empty only the URL is
+// compared, since the remote's default branch is not known locally.
+func repoMismatch(repo *git.Repository, cloneURL, ref string) (urlChanged bool, reason string) {
+	if remote, err := repo.Remote("origin"); err == nil && len(remote.Config().URLs) > 0 {
+		origin := remote.Config().URLs[0]
+		if normalizeRemoteURL(origin) != normalizeRemoteURL(cloneURL) {
+			return true, fmt.Sprintf("origin is %s, requested %s", redactURL(origin), redactURL(cloneURL))
+		}
+	}
+	if ref == "" {
+		return false, ""
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return false, fmt.Sprintf("cannot read HEAD: %s", err)
+	}
+	switch {
+	case isCommitRef(ref):
+		if !strings.HasPrefix(head.Hash().String(), strings.ToLower(ref)) {
+			return false, fmt.Sprintf("HEAD is at %s, requested %s", head.Hash(), ref)
+		}
+	case strings.HasPrefix(ref, "refs/tags/"):
+		hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+		if err != nil || *hash != head.Hash() {
+			return false, fmt.Sprintf("HEAD is not at tag %s", plumbing.ReferenceName(ref).Short())
+		}
+	default:
+		branch := plumbing.NewBranchReferenceName(strings.TrimPrefix(ref, "refs/heads/"))
+		if head.Name() != branch {
+			return false, fmt.Sprintf("%s is checked out, requested %s", head.Name().Short(), branch.Short())
+		}
+	}
+	return false, ""
+}
+
+func normalizeRemoteURL(u string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(u, "/"), ".git")
+}
+
+// checkoutBranchOrRef fetches ref if needed and checks it out. Branches are
+// checked out as a local branch so that HEAD matches on the next run;
+// anything else leaves HEAD detached.
+func checkoutBranchOrRef(ctx context.Context, repo *git.Repository, ref string, auth transport.AuthMethod) error {
+	hash, err := resolveOrFetch(ctx, repo, ref, auth)
+	if err != nil {
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("get worktree: %w", err)
+	}
+	opts := &git.CheckoutOptions{Hash: *hash, Force: true}
+	if !isCommitRef(ref) && !strings.HasPrefix(ref, "refs/tags/") {
+		branch := plumbing.NewBranchReferenceName(strings.TrimPrefix(ref, "refs/heads/"))
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, *hash)); err != nil {
+			return fmt.Errorf("create branch %q: %w", branch.Short(), err)
+		}
+		opts = &git.CheckoutOptions{Branch: branch, Force: true}
+	}
+	if err := wt.Checkout(opts); err != nil {
+		return fmt.Errorf("checkout %q: %w", ref, err)
+	}
+	return nil
+}
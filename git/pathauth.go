@@ -0,0 +1,78 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// ParsePathCredentials parses a map of URL path prefixes to credentials,
+// each given as username:password, for CloneRepoOptions.PathCredentials.
+// Errors name the prefix but never the credentials.
+func ParsePathCredentials(creds map[string]string) (map[string]*githttp.BasicAuth, error) {
+	parsed := make(map[string]*githttp.BasicAuth, len(creds))
+	for prefix, cred := range creds {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid path prefix %q: must start with /", prefix)
+		}
+		username, password, ok := strings.Cut(cred, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid credentials for path prefix %s: must be username:password", prefix)
+		}
+		parsed[prefix] = &githttp.BasicAuth{Username: username, Password: password}
+	}
+	return parsed, nil
+}
+
+// pathAuth picks the credentials for each HTTP request by the longest
+// prefix of its URL path in creds. Requests to other paths get fallback,
+// or no credentials if it is nil. go-git calls SetAuth for every request,
+// so this applies to the initial request and to the fetch alike.
+type pathAuth struct {
+	creds    map[string]*githttp.BasicAuth
+	fallback githttp.AuthMethod
+}
+
+func (a *pathAuth) SetAuth(r *http.Request) {
+	if auth := a.match(r.URL.Path); auth != nil {
+		auth.SetAuth(r)
+		return
+	}
+	if a.fallback != nil {
+		a.fallback.SetAuth(r)
+	}
+}
+
+// match returns the credentials for the longest prefix of p, matching
+// whole path segments, or nil if there is none.
+func (a *pathAuth) match(p string) *githttp.BasicAuth {
+	var best string
+	var auth *githttp.BasicAuth
+	for prefix, creds := range a.creds {
+		trimmed := strings.TrimSuffix(prefix, "/")
+		if p != trimmed && !strings.HasPrefix(p, trimmed+"/") {
+			continue
+		}
+		if auth == nil || len(prefix) > len(best) {
+			best, auth = prefix, creds
+		}
+	}
+	return auth
+}
+
+func (a *pathAuth) Name() string {
+	return "http-path-auth"
+}
+
+// String lists the path prefixes, and never the credentials.
+func (a *pathAuth) String() string {
+	prefixes := make([]string, 0, len(a.creds))
+	for prefix := range a.creds {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return fmt.Sprintf("%s - %s", a.Name(), strings.Join(prefixes, ", "))
+}
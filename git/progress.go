@@ -0,0 +1,163 @@
+package git
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultProgressInterval is how often BatchedProgressWriter flushes
+	// progress lines when no interval is given.
+	defaultProgressInterval = time.Second
+	// progressBatchSize is the number of lines BatchedProgressWriter
+	// buffers before Write blocks until they have been flushed.
+	progressBatchSize = 64
+)
+
+// progressLineRE matches percentage updates such as
+// "Receiving objects:  45% (450/1000)" and captures the stage.
+var progressLineRE = regexp.MustCompile(`^([^:]+):\s+\d+%`)
+
+// BatchedProgressWriter returns a writer for CloneRepoOptions.Progress
+// that passes sideband progress to write at most once per interval,
+// rather than on every update like ProgressWriter does. Percentage
+// updates that are superseded before a flush are dropped, so only the
+// latest one of each stage is written, and other lines are kept in
+// order. When write cannot keep up, e.g. because the log pipeline is
+// slow, Write blocks, which in turn slows down the clone instead of
+// buffering without bound. Close flushes the remaining lines.
+func BatchedProgressWriter(write func(line string), interval time.Duration) io.WriteCloser {
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	w := &batchedProgressWriter{
+		write:    write,
+		interval: interval,
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		stages:   map[string]int{},
+		last:     map[string]string{},
+	}
+	w.space = sync.NewCond(&w.mu)
+	go w.run()
+	return w
+}
+
+type batchedProgressWriter struct {
+	write    func(line string)
+	interval time.Duration
+	flush    chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+
+	mu      sync.Mutex
+	space   *sync.Cond
+	closed  bool
+	partial string
+	pending []string
+	// stages maps each stage to the index of its progress line in pending.
+	stages map[string]int
+	// last is the last progress line written for each stage.
+	last map[string]string
+}
+
+func (w *batchedProgressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	lines := strings.Split(strings.ReplaceAll(w.partial+string(p), "\r", "\n"), "\n")
+	w.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		w.add(line)
+	}
+	return len(p), nil
+}
+
+// add queues line, replacing an earlier progress line of the same stage.
+// It waits for a flush while the queue is full. w.mu must be held.
+func (w *batchedProgressWriter) add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	var stage string
+	if m := progressLineRE.FindStringSubmatch(line); m != nil {
+		stage = m[1]
+	}
+	for {
+		if i, ok := w.stages[stage]; ok && stage != "" {
+			w.pending[i] = line
+			return
+		}
+		if len(w.pending) < progressBatchSize || w.closed {
+			break
+		}
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+		w.space.Wait()
+	}
+	if stage != "" {
+		if w.last[stage] == line {
+			return
+		}
+		w.stages[stage] = len(w.pending)
+	}
+	w.pending = append(w.pending, line)
+}
+
+func (w *batchedProgressWriter) run() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.flush:
+		case <-w.done:
+			w.flushPending()
+			return
+		}
+		w.flushPending()
+	}
+}
+
+// flushPending writes the queued lines. Writers are unblocked before the
+// lines are written, so at most two batches are held at a time.
+func (w *batchedProgressWriter) flushPending() {
+	w.mu.Lock()
+	lines := w.pending
+	w.pending = nil
+	for stage, i := range w.stages {
+		w.last[stage] = lines[i]
+		delete(w.stages, stage)
+	}
+	w.space.Broadcast()
+	w.mu.Unlock()
+	for _, line := range lines {
+		w.write(line)
+	}
+}
+
+func (w *batchedProgressWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.add(w.partial)
+	w.partial = ""
+	w.closed = true
+	w.space.Broadcast()
+	w.mu.Unlock()
+	close(w.done)
+	<-w.stopped
+	return nil
+}
@@ -0,0 +1,72 @@
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// Provenance records exactly what was cloned, for SLSA-style provenance.
+// It is written as JSON by WriteProvenance:
+//
+//	{
+//	  "repo_url": "https://github.com/coder/envbuilder",
+//	  "ref": "refs/heads/main",
+//	  "commit": "0123456789abcdef0123456789abcdef01234567",
+//	  "submodules": {"third_party/lib": "89abcdef0123456789abcdef0123456789abcdef"},
+//	  "cloned_at": "2024-07-04T13:04:43Z"
+//	}
+type Provenance struct {
+	// RepoURL is the URL that was cloned, without the ref and with any
+	// password redacted.
+	RepoURL string `json:"repo_url"`
+	// Ref is the ref requested in the URL fragment, or empty for the
+	// default branch.
+	Ref string `json:"ref"`
+	// Commit is the SHA of the checked out commit.
+	Commit string `json:"commit"`
+	// Submodules maps each submodule path to its commit SHA. It is omitted
+	// if there are none.
+	Submodules map[string]string `json:"submodules,omitempty"`
+	// ClonedAt is when the provenance was recorded, right after the clone,
+	// in UTC.
+	ClonedAt time.Time `json:"cloned_at"`
+}
+
+// NewProvenance returns the provenance of the clone of repoURL described
+// by result.
+func NewProvenance(repoURL string, result CloneRepoResult) Provenance {
+	cloneURL, ref, _ := strings.Cut(repoURL, "#")
+	return Provenance{
+		RepoURL:    redactURL(cloneURL),
+		Ref:        ref,
+		Commit:     result.Commit,
+		Submodules: result.Submodules,
+		ClonedAt:   time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// WriteProvenance writes the provenance of the repository cloned from
+// opts.RepoURL to opts.Path as JSON to path in opts.Storage, creating
+// its directory if needed.
+func WriteProvenance(opts CloneRepoOptions, path string) error {
+	result, err := ResolveCloneResult(opts.Storage, opts.Path)
+	if err != nil {
+		return fmt.Errorf("resolve clone result: %w", err)
+	}
+	data, err := json.MarshalIndent(NewProvenance(opts.RepoURL, result), "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal provenance: %w", err)
+	}
+	if err := opts.Storage.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create provenance directory: %w", err)
+	}
+	if err := util.WriteFile(opts.Storage, path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write provenance: %w", err)
+	}
+	return nil
+}
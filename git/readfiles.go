@@ -0,0 +1,244 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	giturls "github.com/chainguard-dev/git-urls"
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// ErrFileNotFound is returned by ReadFilesAtRef for each path that is not
+// a file at the ref.
+var ErrFileNotFound = errors.New("file not found")
+
+// ReadFilesAtRef returns the contents of the files at paths, relative to
+// the root of the repository, at the ref in the fragment of opts.RepoURL,
+// or the default branch if there is none. Nothing is written to
+// opts.Storage: the objects are fetched into memory and only the
+// requested blobs are read, so it suits tools that need a handful of
+// files, such as devcontainer.json, before or instead of a checkout.
+//
+// Branches and tags are fetched with a depth of 1. Commit SHAs can only
+// be found in the full history of the branches, which is fetched instead.
+// go-git cannot request a blobless clone, so the blobs of the fetched
+// commit are downloaded, but never materialized.
+//
+// Paths that are missing, or are directories, are omitted from the
+// returned map, and the error joins one wrapping ErrFileNotFound per
+// path, so that the files that were found can still be used.
+func ReadFilesAtRef(ctx context.Context, opts CloneRepoOptions, paths []string) (map[string][]byte, error) {
+	opts.Logger = log.Correlated(opts.Logger, log.CorrelationID(ctx))
+	opts.logf(log.PhaseCloning, log.LevelInfo, "📄 Reading %d files from %s", len(paths), redactURL(opts.RepoURL))
+	tree, err := treeAtRef(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte, len(paths))
+	var errs []error
+	for _, p := range paths {
+		content, err := readTreeFile(tree, p)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p, err))
+			continue
+		}
+		files[p] = content
+	}
+	return files, errors.Join(errs...)
+}
+
+// MissingPathsAtRef returns the patterns that match no file or directory
+// at the ref in the fragment of opts.RepoURL, like RequiredPaths after a
+// clone. Patterns are relative to the root of the repository, and may be
+// globs as understood by path.Match. The tree is fetched the same way as
+// by ReadFilesAtRef, so that a clone can be skipped if it would fail.
+func MissingPathsAtRef(ctx context.Context, opts CloneRepoOptions, patterns []string) ([]string, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", p, err)
+		}
+	}
+	tree, err := treeAtRef(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, _, err := walker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("walk tree: %w", err)
+		}
+		names = append(names, name)
+	}
+	var missing []string
+	for _, p := range patterns {
+		pattern := strings.TrimPrefix(path.Clean("/"+p), "/")
+		if !slices.ContainsFunc(names, func(name string) bool {
+			matched, _ := path.Match(pattern, name)
+			return matched
+		}) {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+// treeAtRef fetches the ref in the fragment of opts.RepoURL, or the
+// default branch if there is none, into memory and returns its tree.
+func treeAtRef(ctx context.Context, opts CloneRepoOptions) (*object.Tree, error) {
+	normalized, err := NormalizeGitURL(RewriteGitURL(opts.RepoURL, opts.URLRewrites))
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := giturls.Parse(normalized)
+	if err != nil {
+		return nil, fmt.Errorf("parse url %q: %w", redactURL(opts.RepoURL), err)
+	}
+	ref := parsed.Fragment
+	parsed.RawFragment = ""
+	parsed.Fragment = ""
+	ctx, auth := connectAuth(ctx, parsed, opts)
+	remoteURL, uninstall, err := installAuthEscalation(ctx, parsed.String())
+	if err != nil {
+		return nil, err
+	}
+	defer uninstall()
+
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("init repository: %w", err)
+	}
+	remote, err := repo.CreateRemote(&config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{remoteURL},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create remote: %w", err)
+	}
+	hash, err := fetchRefInMemory(ctx, repo, remote, ref, auth, opts)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("get commit %s: %w", hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree of %s: %w", hash, err)
+	}
+	return tree, nil
+}
+
+// fetchRefInMemory fetches ref, or the default branch if it is empty,
+// from remote into repo and returns the commit it points at.
+func fetchRefInMemory(ctx context.Context, repo *git.Repository, remote *git.Remote, ref string, auth transport.AuthMethod, opts CloneRepoOptions) (plumbing.Hash, error) {
+	fetchOpts := &git.FetchOptions{
+		Auth:            auth,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+		Progress:        opts.Progress,
+		Tags:            git.NoTags,
+	}
+	if isCommitRef(ref) {
+		fetchOpts.RefSpecs = []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"}
+		if err := remote.FetchContext(ctx, fetchOpts); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return plumbing.ZeroHash, fmt.Errorf("fetch branches: %w", err)
+		}
+		return resolveCommit(repo, ref)
+	}
+	refs, caps, err := advertisedRefs(ctx, remote.Config().URLs[0], auth, opts)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("list remote refs: %w", err)
+	}
+	name, hash, err := advertisedHead(refs, plumbing.ReferenceName(ref))
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("%w: %w", ErrRefNotFound, err)
+	}
+	fetchOpts.RefSpecs = []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", name, name))}
+	// go-git asks for a shallow fetch even if the remote cannot serve one.
+	if caps.Supports(capability.Shallow) {
+		fetchOpts.Depth = 1
+	}
+	if err := remote.FetchContext(ctx, fetchOpts); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return plumbing.ZeroHash, fmt.Errorf("fetch %q: %w", name, err)
+	}
+	return hash, nil
+}
+
+// advertisedRefs returns the refs advertised by the remote at remoteURL,
+// with annotated tags peeled as by git.AppendPeeled, along with the
+// capabilities of the remote.
+func advertisedRefs(ctx context.Context, remoteURL string, auth transport.AuthMethod, opts CloneRepoOptions) ([]*plumbing.Reference, *capability.List, error) {
+	ep, err := transport.NewEndpoint(remoteURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	ep.InsecureSkipTLS = opts.Insecure
+	ep.CaBundle = opts.CABundle
+	ep.Proxy = opts.ProxyOptions
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return nil, nil, err
+	}
+	sess, err := c.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer sess.Close()
+	ar, err := sess.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	all, err := ar.AllReferences()
+	if err != nil {
+		return nil, nil, err
+	}
+	refs := make([]*plumbing.Reference, 0, len(all)+len(ar.Peeled))
+	for _, r := range all {
+		refs = append(refs, r)
+	}
+	for name, hash := range ar.Peeled {
+		refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(name+"^{}"), hash))
+	}
+	return refs, ar.Capabilities, nil
+}
+
+// readTreeFile returns the contents of the file at p in tree, or
+// ErrFileNotFound if there is no file there.
+func readTreeFile(tree *object.Tree, p string) ([]byte, error) {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	entry, err := tree.FindEntry(name)
+	if err != nil || !entry.Mode.IsFile() {
+		return nil, ErrFileNotFound
+	}
+	file, err := tree.TreeEntryFile(entry)
+	if err != nil {
+		return nil, fmt.Errorf("get blob: %w", err)
+	}
+	r, err := file.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("read blob: %w", err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
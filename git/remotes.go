@@ -0,0 +1,180 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	giturls "github.com/chainguard-dev/git-urls"
+	"github.com/coder/envbuilder/log"
+	"github.com/coder/envbuilder/options"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// AdditionalRemote is a remote that is added to a fresh clone and fetched
+// after it, e.g. the upstream of a fork.
+type AdditionalRemote struct {
+	// Name is the name of the remote. It must not be origin.
+	Name string
+	// URL is the URL of the remote. URLRewrites apply to it.
+	URL string
+	// Auth is used to fetch from the remote. It may be nil.
+	Auth transport.AuthMethod
+}
+
+// remoteNameRE matches the remote names that are accepted, which are
+// valid in refs/remotes/<name>/.
+var remoteNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateAdditionalRemotes returns an error if a remote in opts has an
+// invalid or duplicate name or no URL, or if CheckoutRemoteRef does not
+// name a branch of one of the remotes.
+func validateAdditionalRemotes(opts CloneRepoOptions) error {
+	names := []string{"origin"}
+	for _, r := range opts.AdditionalRemotes {
+		switch {
+		case !remoteNameRE.MatchString(r.Name) || strings.HasSuffix(r.Name, ".lock"):
+			return fmt.Errorf("invalid remote name %q", r.Name)
+		case slices.Contains(names, r.Name):
+			return fmt.Errorf("duplicate remote %q", r.Name)
+		case r.URL == "":
+			return fmt.Errorf("remote %q has no URL", r.Name)
+		}
+		names = append(names, r.Name)
+	}
+	if opts.CheckoutRemoteRef != "" {
+		name, branch, _ := strings.Cut(opts.CheckoutRemoteRef, "/")
+		if branch == "" || !slices.Contains(names, name) {
+			return fmt.Errorf("invalid remote ref %q: must be a remote name and a branch, e.g. upstream/main", opts.CheckoutRemoteRef)
+		}
+	}
+	return nil
+}
+
+// fetchAdditionalRemotes adds opts.AdditionalRemotes to the fresh clone at
+// opts.Path, fetches their branches into refs/remotes/<name>/, and checks
+// out opts.CheckoutRemoteRef if it is set.
+func fetchAdditionalRemotes(ctx context.Context, opts CloneRepoOptions) error {
+	repo, err := openRepo(opts.Storage, opts.Path)
+	if err != nil {
+		return err
+	}
+	for _, r := range opts.AdditionalRemotes {
+		if err := fetchAdditionalRemote(ctx, repo, r, opts); err != nil {
+			return fmt.Errorf("fetch remote %q: %w", r.Name, err)
+		}
+	}
+	if opts.CheckoutRemoteRef == "" {
+		return nil
+	}
+	opts.logf(log.PhaseCheckingOut, log.LevelInfo, "🔀 Checking out %s", opts.CheckoutRemoteRef)
+	return CheckoutRef(ctx, opts.Storage, opts.Path, "refs/remotes/"+opts.CheckoutRemoteRef)
+}
+
+// fetchAdditionalRemote adds r to repo, or updates its URL, and fetches
+// its branches with the connection settings of opts.
+func fetchAdditionalRemote(ctx context.Context, repo *git.Repository, r AdditionalRemote, opts CloneRepoOptions) error {
+	remoteURL, err := NormalizeGitURL(RewriteGitURL(r.URL, opts.URLRewrites))
+	if err != nil {
+		return err
+	}
+	parsed, err := giturls.Parse(remoteURL)
+	if err != nil {
+		return fmt.Errorf("parse url %q: %w", redactURL(r.URL), err)
+	}
+	// All branches are fetched, so a ref in the fragment is ignored.
+	remoteURL, _, _ = strings.Cut(remoteURL, "#")
+	if err := repo.DeleteRemote(r.Name); err != nil && !errors.Is(err, git.ErrRemoteNotFound) {
+		return err
+	}
+	remote, err := repo.CreateRemote(&config.RemoteConfig{
+		Name:  r.Name,
+		URLs:  []string{remoteURL},
+		Fetch: []config.RefSpec{config.RefSpec(fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", r.Name))},
+	})
+	if err != nil {
+		return err
+	}
+	opts.logf(log.PhaseCloning, log.LevelInfo, "🔗 Fetching remote %s from %s", r.Name, redactURL(remoteURL))
+	remoteOpts := opts
+	remoteOpts.RepoAuth = r.Auth
+	ctx, auth := connectAuth(ctx, parsed, remoteOpts)
+	fetchURL, uninstall, err := installAuthEscalation(ctx, remoteURL)
+	if err != nil {
+		return err
+	}
+	defer uninstall()
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RemoteURL:       fetchURL,
+		Auth:            auth,
+		Depth:           opts.Depth,
+		InsecureSkipTLS: opts.Insecure,
+		CABundle:        opts.CABundle,
+		ProxyOptions:    opts.ProxyOptions,
+		Progress:        opts.Progress,
+		Tags:            git.NoTags,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return err
+	}
+	return nil
+}
+
+// additionalRemotes resolves the auth of each of the additional remotes
+// in options, as for options.GitURL. HTTP credentials are only sent to
+// the host of options.GitURL, so remotes on other hosts are fetched
+// anonymously over HTTP.
+func additionalRemotes(options options.Options) ([]AdditionalRemote, error) {
+	names := make([]string, 0, len(options.GitAdditionalRemotes))
+	for name := range options.GitAdditionalRemotes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	logf := authLogger(&options)
+	remotes := make([]AdditionalRemote, 0, len(names))
+	for _, name := range names {
+		remoteURL := options.GitAdditionalRemotes[name]
+		remoteOpts := options
+		remoteOpts.GitURL = remoteURL
+		remoteOpts.Logger = func(log.Level, string, ...any) {}
+		remoteOpts.ProgressReporter = nil
+		// The fetched credentials are already in options, and must not be
+		// fetched again for remotes on other hosts.
+		remoteOpts.GitSecretFetcher = nil
+		if isHTTPURL(remoteURL) && urlHost(remoteURL) != urlHost(options.GitURL) {
+			remoteOpts.GitUsername, remoteOpts.GitPassword = "", ""
+		}
+		auth, err := SetupRepoAuthE(&remoteOpts)
+		if err != nil {
+			return nil, fmt.Errorf("remote %q: %w", name, err)
+		}
+		if auth == nil {
+			logf(log.LevelInfo, "🔗 Fetching remote %s without authentication", name)
+		} else {
+			logf(log.LevelInfo, "🔗 Fetching remote %s with %s", name, describeAuth(auth))
+		}
+		remotes = append(remotes, AdditionalRemote{Name: name, URL: remoteURL, Auth: auth})
+	}
+	return remotes, nil
+}
+
+// isHTTPURL reports whether rawURL is an HTTP or HTTPS URL.
+func isHTTPURL(rawURL string) bool {
+	return strings.HasPrefix(rawURL, "http://") || strings.HasPrefix(rawURL, "https://")
+}
+
+// urlHost returns the lowercased host of rawURL, or "" if it cannot be
+// parsed.
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
@@ -0,0 +1,101 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+)
+
+// Defaults for RepackConfig, the same as git's.
+const (
+	defaultRepackWindow = 10
+	defaultRepackDepth  = 50
+)
+
+// ErrRepackShallow is returned by RepackGitDir for shallow repositories,
+// whose few objects leave little to gain from delta compression.
+var ErrRepackShallow = errors.New("repacking is not supported for shallow repositories")
+
+// RepackConfig tunes the repack of a fresh clone. Larger windows and
+// deeper delta chains produce smaller packs, so that later fetches into
+// the clone have less to read, at the cost of a slower repack.
+type RepackConfig struct {
+	// Window is the number of objects compared with each other to find
+	// deltas. Defaults to 10.
+	Window int
+	// Depth is the maximum length of delta chains. go-git never builds
+	// chains longer than 50, so it only bounds repacks by the git CLI,
+	// including later ones in the workspace. Defaults to 50.
+	Depth int
+	// WriteBitmaps writes a reachability bitmap index, which speeds up
+	// serving fetches from the clone. go-git cannot write bitmaps, so
+	// only the git CLI honors it, including later repacks in the
+	// workspace.
+	WriteBitmaps bool
+}
+
+// gitConfig returns the pack settings of c as git config, for later
+// repacks in the workspace to keep them.
+func (c RepackConfig) gitConfig() map[string]string {
+	window, depth := c.Window, c.Depth
+	if window <= 0 {
+		window = defaultRepackWindow
+	}
+	if depth <= 0 {
+		depth = defaultRepackDepth
+	}
+	values := map[string]string{
+		"pack.window": strconv.Itoa(window),
+		"pack.depth":  strconv.Itoa(depth),
+	}
+	if c.WriteBitmaps {
+		values["repack.writeBitmaps"] = "true"
+	}
+	return values
+}
+
+// RepackGitDir records the pack settings of cfg in the config of the
+// repository at path and repacks all of its objects into a single pack
+// with them. It returns the number of bytes the .git directory shrank by.
+func RepackGitDir(storage billy.Filesystem, path string, cfg RepackConfig) (int64, error) {
+	return repackGitDir(storage, path, cfg, func(repo *git.Repository) error {
+		// go-git repacks with the window in the config.
+		return repo.RepackObjects(&git.RepackConfig{})
+	})
+}
+
+// repackGitDir is RepackGitDir with repack doing the repacking once the
+// config is written.
+func repackGitDir(storage billy.Filesystem, path string, cfg RepackConfig, repack func(*git.Repository) error) (int64, error) {
+	repo, err := openRepo(storage, path)
+	if err != nil {
+		return 0, err
+	}
+	shallow, err := repo.Storer.Shallow()
+	if err != nil {
+		return 0, fmt.Errorf("read shallow commits: %w", err)
+	}
+	if len(shallow) > 0 {
+		return 0, ErrRepackShallow
+	}
+	gitDir := filepath.Join(path, ".git")
+	before, err := dirSize(storage, gitDir)
+	if err != nil {
+		return 0, fmt.Errorf("measure %q: %w", gitDir, err)
+	}
+	if err := applyGitConfig(repo, cfg.gitConfig()); err != nil {
+		return 0, fmt.Errorf("set pack config: %w", err)
+	}
+	if err := repack(repo); err != nil {
+		return 0, fmt.Errorf("repack objects: %w", err)
+	}
+	after, err := dirSize(storage, gitDir)
+	if err != nil {
+		return 0, fmt.Errorf("measure %q: %w", gitDir, err)
+	}
+	return before - after, nil
+}
@@ -0,0 +1,262 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/envbuilder/log"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Resolver looks up the addresses of a host. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// NewResolver returns a resolver that sends DNS queries to servers, each
+// given as host or host:port, instead of those in /etc/resolv.conf.
+// Queries are spread over the servers in turn, so that a retried query
+// goes to the next server.
+func NewResolver(servers []string) (*net.Resolver, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no DNS servers given")
+	}
+	addrs := make([]string, 0, len(servers))
+	for _, s := range servers {
+		s = strings.TrimSpace(s)
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+		}
+		host, _, err := net.SplitHostPort(s)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid DNS server %q", s)
+		}
+		addrs = append(addrs, s)
+	}
+	var next atomic.Uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			addr := addrs[int(next.Add(1)-1)%len(addrs)]
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// NewHostAliasResolver returns a resolver that resolves the host names in
+// aliases to their IP address, like entries in /etc/hosts, and every other
+// host with next, or the system resolver if next is nil.
+func NewHostAliasResolver(aliases map[string]string, next Resolver) (Resolver, error) {
+	hosts := make(map[string]string, len(aliases))
+	for host, ip := range aliases {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid IP address %q for host alias %s", ip, host)
+		}
+		hosts[strings.ToLower(strings.TrimSuffix(host, "."))] = ip
+	}
+	if next == nil {
+		next = net.DefaultResolver
+	}
+	return &aliasResolver{hosts: hosts, next: next}, nil
+}
+
+// aliasResolver resolves the host names in hosts without a lookup.
+type aliasResolver struct {
+	hosts map[string]string
+	next  Resolver
+}
+
+func (r *aliasResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ip, ok := r.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+		return []string{ip}, nil
+	}
+	return r.next.LookupHost(ctx, host)
+}
+
+// lookupHost resolves host with r and logs the result at debug level.
+// IP addresses are returned as is.
+func lookupHost(ctx context.Context, r Resolver, host string, logf log.Func) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("resolve %s: no addresses", host)
+	}
+	if logf != nil {
+		logf(log.LevelDebug, "🔎 Resolved %s to %s", host, strings.Join(addrs, ", "))
+	}
+	return addrs, nil
+}
+
+// dnsPolicy is the resolver used for HTTP requests of a clone. Like
+// redirectPolicy, it travels in the request context because go-git shares
+// one HTTP client between all clones.
+type dnsPolicy struct {
+	resolver Resolver
+	logger   log.Func
+}
+
+type dnsPolicyKey struct{}
+
+func withResolver(ctx context.Context, r Resolver, logger log.Func) context.Context {
+	return context.WithValue(ctx, dnsPolicyKey{}, &dnsPolicy{resolver: r, logger: logger})
+}
+
+// newHTTPTransport returns the transport of the go-git HTTP client. It
+// dials through the resolver in the request context, if there is one.
+func newHTTPTransport() *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		policy, ok := ctx.Value(dnsPolicyKey{}).(*dnsPolicy)
+		if !ok {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := lookupHost(ctx, policy.resolver, host, policy.logger)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, a := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+	return tr
+}
+
+// resolveSSHURL resolves the host of the ssh:// URL u with r and returns u
+// pointing at the first address, and auth wrapped so that host keys are
+// still checked against the original host.
+func resolveSSHURL(ctx context.Context, u *url.URL, auth gitssh.AuthMethod, r Resolver, logf log.Func) (*url.URL, gitssh.AuthMethod, error) {
+	addrs, err := lookupHost(ctx, r, u.Hostname(), logf)
+	if err != nil {
+		return nil, nil, err
+	}
+	port := u.Port()
+	hostPort := net.JoinHostPort(u.Hostname(), port)
+	if port == "" {
+		hostPort = net.JoinHostPort(u.Hostname(), "22")
+	}
+	resolved := *u
+	switch {
+	case port != "":
+		resolved.Host = net.JoinHostPort(addrs[0], port)
+	case strings.Contains(addrs[0], ":"):
+		resolved.Host = "[" + addrs[0] + "]"
+	default:
+		resolved.Host = addrs[0]
+	}
+	return &resolved, &sshAuthForHost{AuthMethod: auth, hostPort: hostPort}, nil
+}
+
+// sshAuthForHost checks host keys against hostPort rather than the address
+// that was dialed.
+type sshAuthForHost struct {
+	gitssh.AuthMethod
+	hostPort string
+}
+
+func (a *sshAuthForHost) ClientConfig() (*gossh.ClientConfig, error) {
+	cfg, err := a.AuthMethod.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	callback := cfg.HostKeyCallback
+	if callback == nil {
+		// The same default go-git uses.
+		callback, err = gitssh.NewKnownHostsCallback()
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.HostKeyCallback = func(_ string, remote net.Addr, key gossh.PublicKey) error {
+		return callback(a.hostPort, remote, key)
+	}
+	return cfg, nil
+}
+
+// pinnedResolver resolves host to addr, an IP address or another host
+// name, and every other host with next.
+type pinnedResolver struct {
+	host string
+	addr string
+	next Resolver
+}
+
+func (r *pinnedResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if !strings.EqualFold(host, r.host) {
+		return r.next.LookupHost(ctx, host)
+	}
+	if net.ParseIP(r.addr) != nil {
+		return []string{r.addr}, nil
+	}
+	return r.next.LookupHost(ctx, r.addr)
+}
+
+// pinHost applies opts.ResolveHostToIP and opts.TLSServerName to u. It
+// returns the URL to connect to, and opts with a Resolver that pins its
+// host. For https:// URLs the TLS server name replaces the host, so that
+// it is sent in the handshake and Host header and verified against the
+// certificate, while the pinned IP or the original host is dialed.
+// gits:// URLs are pinned by the TLS tunnel instead, and git:// URLs
+// simply point at the IP.
+func pinHost(u *url.URL, opts CloneRepoOptions) (*url.URL, CloneRepoOptions) {
+	serverName := ""
+	if u.Scheme == "https" {
+		serverName = opts.TLSServerName
+	}
+	if (opts.ResolveHostToIP == "" && serverName == "") || u.Scheme == "gits" {
+		return u, opts
+	}
+	pinned := *u
+	if u.Scheme == "git" {
+		pinned.Host = withPort(opts.ResolveHostToIP, u.Port())
+		return &pinned, opts
+	}
+	addr := u.Hostname()
+	if opts.ResolveHostToIP != "" {
+		addr = opts.ResolveHostToIP
+	}
+	if serverName != "" {
+		pinned.Host = withPort(serverName, u.Port())
+	}
+	next := opts.Resolver
+	if next == nil {
+		next = net.DefaultResolver
+	}
+	opts.Resolver = &pinnedResolver{host: pinned.Hostname(), addr: addr, next: next}
+	return &pinned, opts
+}
+
+// withPort returns host with port, if there is one, in URL host form.
+func withPort(host, port string) string {
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
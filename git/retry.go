@@ -0,0 +1,88 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// maxRetryBackoff caps the exponential backoff between clone attempts.
+const maxRetryBackoff = 30 * time.Second
+
+// cloneRepoWithRetry clones opts.RepoURL, retrying transient failures up to
+// opts.Retries times with exponential backoff. If rng is not nil, full
+// jitter is applied: each delay is picked uniformly between zero and the
+// exponential backoff, so that a fleet of workspaces hitting the same
+// failure does not retry in lockstep.
+func cloneRepoWithRetry(ctx context.Context, opts CloneRepoOptions, rng *rand.Rand) (bool, error) {
+	base := opts.RetryBackoff
+	if base <= 0 {
+		base = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		cloned, err := cloneRepo(ctx, opts)
+		if err == nil || cloned || attempt >= opts.Retries || ctx.Err() != nil || !isTransient(err) {
+			return cloned, err
+		}
+		delay := retryDelay(base, attempt, rng)
+		opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Clone attempt %d of %d failed, retrying in %s: %s", attempt+1, opts.Retries+1, delay.Round(time.Millisecond), err)
+		if rmErr := util.RemoveAll(opts.Storage, filepath.Join(opts.Path, ".git")); rmErr != nil {
+			return false, fmt.Errorf("clean up failed clone: %w", rmErr)
+		}
+		select {
+		case <-ctx.Done():
+			return false, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryDelay returns the delay before retry number attempt, counting from
+// zero.
+func retryDelay(base time.Duration, attempt int, rng *rand.Rand) time.Duration {
+	delay := maxRetryBackoff
+	if attempt < 30 && base<<attempt < maxRetryBackoff {
+		delay = base << attempt
+	}
+	if rng != nil {
+		delay = time.Duration(rng.Int63n(int64(delay) + 1))
+	}
+	return delay
+}
+
+// isTransient reports whether a clone error is likely to go away on its
+// own: network errors, truncated responses and HTTP 5xx responses.
+func isTransient(err error) bool {
+	// net/http reports redirect failures as a *url.Error, which is a
+	// net.Error, but following the same redirects again will not help.
+	if errors.Is(err, ErrTooManyRedirects) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var unexpected *plumbing.UnexpectedError
+	if errors.As(err, &unexpected) {
+		var httpErr *githttp.Err
+		if errors.As(unexpected.Err, &httpErr) && httpErr.StatusCode() >= http.StatusInternalServerError {
+			return true
+		}
+	}
+	return false
+}
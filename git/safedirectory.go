@@ -0,0 +1,70 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+// DefaultSafeDirectoryConfig is the gitconfig that safe directories are
+// added to by default: the system config, which git reads for every user.
+const DefaultSafeDirectoryConfig = "/etc/gitconfig"
+
+// SafeDirectoryAny is the safe.directory value that trusts every
+// repository regardless of its owner.
+const SafeDirectoryAny = "*"
+
+// AddSafeDirectory adds dir to safe.directory in the gitconfig at
+// configPath in fs, creating it if it does not exist, so that git does
+// not refuse to use the repository at dir as having dubious ownership
+// when run by a user other than its owner. git ignores safe.directory in
+// a repository's own config, so configPath must be a global or system
+// config. Nothing is written if dir or SafeDirectoryAny is already
+// listed. The entry is appended, so the rest of the file is kept as is.
+func AddSafeDirectory(fs billy.Filesystem, configPath, dir string) error {
+	var content []byte
+	f, err := fs.Open(configPath)
+	switch {
+	case err == nil:
+		content, err = io.ReadAll(f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", configPath, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("open %s: %w", configPath, err)
+	}
+	cfg := format.New()
+	if err := format.NewDecoder(bytes.NewReader(content)).Decode(cfg); err != nil {
+		return fmt.Errorf("parse %s: %w", configPath, err)
+	}
+	for _, safe := range cfg.Section("safe").OptionAll("directory") {
+		if safe == dir || safe == SafeDirectoryAny {
+			return nil
+		}
+	}
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		content = append(content, '\n')
+	}
+	content = append(content, fmt.Sprintf("[safe]\n\tdirectory = %s\n", quoteConfigValue(dir))...)
+	if err := fs.MkdirAll(filepath.Dir(configPath), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(configPath), err)
+	}
+	if err := util.WriteFile(fs, configPath, content, 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", configPath, err)
+	}
+	return nil
+}
+
+// quoteConfigValue returns v as a double-quoted gitconfig value.
+func quoteConfigValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
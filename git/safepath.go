@@ -0,0 +1,139 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ErrUnsafePath is returned by CloneRepo when the checked out commit has
+// a path that would be written outside the worktree or into .git. The
+// fetched repository is removed again.
+var ErrUnsafePath = errors.New("unsafe path in repository")
+
+// maxSymlinkTarget is the longest symlink target that is read to check
+// where it points. Anything longer is not a valid path anyway.
+const maxSymlinkTarget = 4096
+
+// checkHeadPaths checks the paths in the commit at HEAD before it is
+// checked out. It fails with ErrUnsafePath if any path escapes the
+// worktree or writes into .git, and returns the symlinks that point
+// outside the worktree, which must be removed once checked out.
+func checkHeadPaths(repo *git.Repository, opts CloneRepoOptions) ([]string, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head: %w", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("get commit %s: %w", head.Hash(), err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+	var links []string
+	if err := checkTreePaths(repo, tree, "", &links); err != nil {
+		if errors.Is(err, ErrUnsafePath) {
+			opts.logf(log.PhaseCheckingOut, log.LevelError, "🛡️ Refusing to check out %s: %s", redactURL(opts.RepoURL), err)
+		}
+		return nil, err
+	}
+	return links, nil
+}
+
+// checkTreePaths checks the entries of tree, which is checked out at dir,
+// and appends symlinks pointing outside the worktree to links.
+func checkTreePaths(repo *git.Repository, tree *object.Tree, dir string, links *[]string) error {
+	for _, entry := range tree.Entries {
+		if !safePathName(entry.Name) {
+			return fmt.Errorf("%w: %q in %q", ErrUnsafePath, entry.Name, "/"+dir)
+		}
+		name := path.Join(dir, entry.Name)
+		switch entry.Mode {
+		case filemode.Dir:
+			sub, err := repo.TreeObject(entry.Hash)
+			if err != nil {
+				return fmt.Errorf("get tree %s: %w", name, err)
+			}
+			if err := checkTreePaths(repo, sub, name, links); err != nil {
+				return err
+			}
+		case filemode.Symlink:
+			target, err := symlinkTarget(repo, entry)
+			if err != nil {
+				return fmt.Errorf("read symlink %s: %w", name, err)
+			}
+			if symlinkEscapes(name, target) {
+				*links = append(*links, name)
+			}
+		}
+	}
+	return nil
+}
+
+// safePathName reports whether a tree entry name refers to a file within
+// its directory. Like git, it rejects .git in any case.
+func safePathName(name string) bool {
+	switch {
+	case name == "", name == ".", name == "..":
+		return false
+	case strings.ContainsAny(name, `/\`):
+		return false
+	case strings.EqualFold(name, ".git"):
+		return false
+	}
+	return true
+}
+
+func symlinkTarget(repo *git.Repository, entry object.TreeEntry) (string, error) {
+	blob, err := repo.BlobObject(entry.Hash)
+	if err != nil {
+		return "", err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	target, err := io.ReadAll(io.LimitReader(r, maxSymlinkTarget+1))
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// symlinkEscapes reports whether the symlink name, relative to the
+// worktree, points outside of it.
+func symlinkEscapes(name, target string) bool {
+	if len(target) > maxSymlinkTarget || path.IsAbs(target) || strings.HasPrefix(target, `\`) {
+		return true
+	}
+	resolved := path.Join(path.Dir(name), target)
+	return resolved == ".." || strings.HasPrefix(resolved, "../")
+}
+
+// removeEscapingSymlinks removes the symlinks returned by checkHeadPaths
+// from the worktree fs, so that nothing that follows them later, such as
+// the build, reads or writes outside of it.
+func removeEscapingSymlinks(fs billy.Filesystem, links []string, opts CloneRepoOptions) error {
+	for _, link := range links {
+		if _, err := fs.Lstat(link); err != nil {
+			// Not checked out, e.g. excluded by a sparse checkout.
+			continue
+		}
+		if err := fs.Remove(link); err != nil {
+			return fmt.Errorf("remove symlink %s: %w", link, err)
+		}
+		opts.logf(log.PhaseCheckingOut, log.LevelWarn, "🛡️ Removed symlink %s, it points outside the repository", link)
+	}
+	return nil
+}
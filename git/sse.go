@@ -0,0 +1,187 @@
+package git
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coder/envbuilder/log"
+)
+
+// progressPercentRE matches go-git progress lines such as
+// "Receiving objects:  45% (450/1000)".
+var progressPercentRE = regexp.MustCompile(`^([^:]+):\s+(\d+)% \((\d+)/(\d+)\)`)
+
+// SSEPhaseEvent is the data of a "phase" event, sent when the clone
+// enters a new phase.
+type SSEPhaseEvent struct {
+	Phase log.Phase `json:"phase"`
+}
+
+// SSEProgressEvent is the data of a "progress" event, sent for each
+// percentage update from the remote, e.g. while receiving objects.
+type SSEProgressEvent struct {
+	Stage   string `json:"stage"`
+	Percent int    `json:"percent"`
+	Current int    `json:"current"`
+	Total   int    `json:"total"`
+}
+
+// SSEMessageEvent is the data of a "message" event, sent for progress
+// output that is not a percentage update.
+type SSEMessageEvent struct {
+	Message string `json:"message"`
+}
+
+// SSEDoneEvent is the data of the final "done" event.
+type SSEDoneEvent struct {
+	Cloned bool   `json:"cloned"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SSEProgress streams the progress of a clone to an HTTP client as
+// Server-Sent Events. It is both a CloneRepoOptions.Progress writer and
+// a log.ProgressReporter. Use ServeCloneProgress to run a whole clone
+// this way.
+type SSEProgress struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	partial string
+	err     error
+}
+
+// NewSSEProgress starts a text/event-stream response on w. cancel is
+// called once the client has gone away, so that the clone can be
+// stopped; it may be nil.
+func NewSSEProgress(w http.ResponseWriter, cancel context.CancelFunc) (*SSEProgress, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("response writer does not support streaming")
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// Stop proxies such as nginx from buffering the stream.
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &SSEProgress{w: w, flusher: flusher, cancel: cancel}, nil
+}
+
+// Write parses go-git progress output into "progress" and "message"
+// events. It never fails, so that a disconnected client does not fail
+// the clone by itself.
+func (p *SSEProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lines := strings.Split(strings.ReplaceAll(p.partial+string(b), "\r", "\n"), "\n")
+	p.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		p.line(line)
+	}
+	return len(b), nil
+}
+
+// line sends the event for a line of progress output. p.mu must be held.
+func (p *SSEProgress) line(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	m := progressPercentRE.FindStringSubmatch(line)
+	if m == nil {
+		p.event("message", SSEMessageEvent{Message: line})
+		return
+	}
+	percent, _ := strconv.Atoi(m[2])
+	current, _ := strconv.Atoi(m[3])
+	total, _ := strconv.Atoi(m[4])
+	p.event("progress", SSEProgressEvent{Stage: m[1], Percent: percent, Current: current, Total: total})
+}
+
+// Phase implements log.ProgressReporter.
+func (p *SSEProgress) Phase(phase log.Phase) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.event("phase", SSEPhaseEvent{Phase: phase})
+}
+
+// Done sends any remaining progress output and the final "done" event
+// with the outcome of the clone.
+func (p *SSEProgress) Done(cloned bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.line(p.partial)
+	p.partial = ""
+	done := SSEDoneEvent{Cloned: cloned}
+	if err != nil {
+		done.Error = err.Error()
+	}
+	p.event("done", done)
+}
+
+// Err returns the error that stopped the stream, if the client went away.
+func (p *SSEProgress) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// event writes an event and flushes it to the client. p.mu must be held.
+func (p *SSEProgress) event(name string, data any) {
+	if p.err != nil {
+		return
+	}
+	b, err := json.Marshal(data)
+	if err == nil {
+		_, err = fmt.Fprintf(p.w, "event: %s\ndata: %s\n\n", name, b)
+	}
+	if err != nil {
+		p.err = fmt.Errorf("write %s event: %w", name, err)
+		if p.cancel != nil {
+			p.cancel()
+		}
+		return
+	}
+	p.flusher.Flush()
+}
+
+// ServeCloneProgress clones like CloneRepo while streaming its phases and
+// progress to the client of r as Server-Sent Events, ending with a "done"
+// event. The clone is cancelled if the client disconnects. Any Progress
+// and ProgressReporter in opts are still called.
+func ServeCloneProgress(w http.ResponseWriter, r *http.Request, opts CloneRepoOptions) (bool, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	p, err := NewSSEProgress(w, cancel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false, err
+	}
+	if opts.Progress != nil {
+		opts.Progress = io.MultiWriter(opts.Progress, p)
+	} else {
+		opts.Progress = p
+	}
+	if reporter := opts.ProgressReporter; reporter != nil {
+		opts.ProgressReporter = log.ProgressFunc(func(phase log.Phase) {
+			reporter.Phase(phase)
+			p.Phase(phase)
+		})
+	} else {
+		opts.ProgressReporter = p
+	}
+	cloned, err := CloneRepo(ctx, opts)
+	p.Done(cloned, err)
+	return cloned, err
+}
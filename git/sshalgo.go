@@ -0,0 +1,79 @@
+package git
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/coder/envbuilder/log"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// supportedSSHCiphers are the ciphers golang.org/x/crypto/ssh implements,
+// including those it does not offer by default.
+var supportedSSHCiphers = []string{
+	"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+	"chacha20-poly1305@openssh.com",
+	"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	"aes128-cbc", "3des-cbc",
+	"arcfour256", "arcfour128", "arcfour",
+}
+
+// supportedSSHKeyExchanges are the key exchange algorithms
+// golang.org/x/crypto/ssh implements for clients, including those it does
+// not offer by default.
+var supportedSSHKeyExchanges = []string{
+	"curve25519-sha256", "curve25519-sha256@libssh.org",
+	"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+	"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+	"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+}
+
+// sshAuthWithAlgorithms wraps an SSH auth method to restrict the ciphers
+// and key exchange algorithms of the client config it produces.
+type sshAuthWithAlgorithms struct {
+	gitssh.AuthMethod
+	ciphers      []string
+	keyExchanges []string
+}
+
+func newSSHAuthWithAlgorithms(auth gitssh.AuthMethod, opts CloneRepoOptions) *sshAuthWithAlgorithms {
+	return &sshAuthWithAlgorithms{
+		AuthMethod:   auth,
+		ciphers:      supportedSSHAlgorithms("cipher", opts.SSHCiphers, supportedSSHCiphers, opts),
+		keyExchanges: supportedSSHAlgorithms("key exchange", opts.SSHKeyExchanges, supportedSSHKeyExchanges, opts),
+	}
+}
+
+func (a *sshAuthWithAlgorithms) ClientConfig() (*gossh.ClientConfig, error) {
+	cfg, err := a.AuthMethod.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(a.ciphers) > 0 {
+		cfg.Ciphers = a.ciphers
+	}
+	if len(a.keyExchanges) > 0 {
+		cfg.KeyExchanges = a.keyExchanges
+	}
+	return cfg, nil
+}
+
+// supportedSSHAlgorithms returns the names in supported, keeping their
+// order and logging a warning for each one that is not. If none are
+// supported, it returns nil so that the defaults are used.
+func supportedSSHAlgorithms(kind string, names, supported []string, opts CloneRepoOptions) []string {
+	var valid []string
+	for _, name := range names {
+		if !slices.Contains(supported, name) {
+			opts.logf(log.PhaseConnecting, log.LevelWarn, "⚠️ Ignoring unsupported SSH %s %q, supported are: %s", kind, name, strings.Join(supported, ", "))
+			continue
+		}
+		valid = append(valid, name)
+	}
+	if len(names) > 0 && len(valid) == 0 {
+		opts.logf(log.PhaseConnecting, log.LevelWarn, "⚠️ No supported SSH %s configured, using the defaults", kind)
+	}
+	return valid
+}
@@ -0,0 +1,52 @@
+package git
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-git/v5"
+)
+
+// rewriteSubmoduleURLs applies opts.SubmoduleURLRewrites to the URL of
+// each submodule in the .gitmodules of the fresh clone at opts.Path, and
+// records the rewritten URLs in .git/config as submodule.<name>.url, the
+// same way git submodule init does, so that git submodule update fetches
+// them from the rewritten location. Submodules whose URL no prefix
+// matches, including relative URLs that follow the origin remote, are
+// left uninitialized.
+func rewriteSubmoduleURLs(opts CloneRepoOptions) error {
+	repo, err := openRepo(opts.Storage, opts.Path)
+	if err != nil {
+		return err
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("open worktree: %w", err)
+	}
+	submodules, err := wt.Submodules()
+	if err != nil {
+		return fmt.Errorf("read .gitmodules: %w", err)
+	}
+	slices.SortFunc(submodules, func(a, b *git.Submodule) int {
+		return strings.Compare(a.Config().Name, b.Config().Name)
+	})
+	values := make(map[string]string)
+	for _, s := range submodules {
+		cfg := s.Config()
+		rewritten := RewriteGitURL(cfg.URL, opts.SubmoduleURLRewrites)
+		if rewritten == cfg.URL {
+			continue
+		}
+		values["submodule."+cfg.Name+".url"] = rewritten
+		opts.logf(log.PhaseCloning, log.LevelInfo, "🔀 Rewrote submodule %s URL %s to %s", cfg.Name, redactURL(cfg.URL), redactURL(rewritten))
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	if err := applyGitConfig(repo, values); err != nil {
+		return fmt.Errorf("set submodule config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/coder/envbuilder/log"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// ErrTempDirFull is returned by CloneRepo when CloneRepoOptions.TempDir
+// runs out of space during the clone.
+var ErrTempDirFull = errors.New("git temp dir is full")
+
+// withTempDir creates a scratch directory in opts.TempDir and returns
+// gitDir wrapped so that go-git writes its temporary object and pack files
+// there. The returned cleanup function removes the scratch directory.
+func withTempDir(gitDir billy.Filesystem, opts CloneRepoOptions) (billy.Filesystem, func(), error) {
+	info, err := opts.Storage.Stat(opts.TempDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("git temp dir %q: %w", opts.TempDir, err)
+	}
+	if !info.IsDir() {
+		return nil, nil, fmt.Errorf("git temp dir %q is not a directory", opts.TempDir)
+	}
+	scratch, err := util.TempDir(opts.Storage, opts.TempDir, "envbuilder-clone-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("git temp dir %q is not writable: %w", opts.TempDir, err)
+	}
+	cleanup := func() {
+		if err := util.RemoveAll(opts.Storage, scratch); err != nil {
+			opts.logf(log.PhaseCloning, log.LevelWarn, "⚠️ Failed to remove git temp dir %s: %s", scratch, err)
+		}
+	}
+	temp, err := opts.Storage.Chroot(scratch)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("chroot %q: %w", scratch, err)
+	}
+	return &tempDirFS{
+		Filesystem: gitDir,
+		temp:       temp,
+		dir:        opts.TempDir,
+		files:      map[string]bool{},
+	}, cleanup, nil
+}
+
+// tempDirFS redirects the temporary files go-git writes loose objects and
+// pack files to into another filesystem. They are moved into the
+// repository when go-git renames them into place.
+type tempDirFS struct {
+	billy.Filesystem
+	temp billy.Filesystem
+	dir  string
+
+	mu    sync.Mutex
+	files map[string]bool
+}
+
+func (fs *tempDirFS) TempFile(_, prefix string) (billy.File, error) {
+	f, err := fs.temp.TempFile("", prefix)
+	if err != nil {
+		return nil, fs.wrapErr(err)
+	}
+	fs.mu.Lock()
+	fs.files[f.Name()] = true
+	fs.mu.Unlock()
+	return &tempFile{File: f, fs: fs}, nil
+}
+
+// isTemp reports whether name is a file created by TempFile.
+func (fs *tempDirFS) isTemp(name string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.files[name]
+}
+
+func (fs *tempDirFS) Open(name string) (billy.File, error) {
+	if fs.isTemp(name) {
+		return fs.temp.Open(name)
+	}
+	return fs.Filesystem.Open(name)
+}
+
+func (fs *tempDirFS) Remove(name string) error {
+	if !fs.isTemp(name) {
+		return fs.Filesystem.Remove(name)
+	}
+	fs.mu.Lock()
+	delete(fs.files, name)
+	fs.mu.Unlock()
+	return fs.temp.Remove(name)
+}
+
+// Rename copies temporary files into the repository, since the temp dir
+// is usually on another volume.
+func (fs *tempDirFS) Rename(from, to string) error {
+	if !fs.isTemp(from) {
+		return fs.Filesystem.Rename(from, to)
+	}
+	src, err := fs.temp.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := fs.Filesystem.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return err
+	}
+	dst, err := fs.Filesystem.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	closeErr := dst.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return fs.Remove(from)
+}
+
+// wrapErr marks errors caused by the temp dir running out of space.
+func (fs *tempDirFS) wrapErr(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %s: %w", ErrTempDirFull, fs.dir, err)
+	}
+	return err
+}
+
+// tempFile is a file in the temp dir.
+type tempFile struct {
+	billy.File
+	fs *tempDirFS
+}
+
+func (f *tempFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	return n, f.fs.wrapErr(err)
+}
+
+func (f *tempFile) Close() error {
+	return f.fs.wrapErr(f.File.Close())
+}
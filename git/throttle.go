@@ -0,0 +1,134 @@
+package git
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+)
+
+// throttledTransport limits the rate at which packfiles are read from
+// the upload-pack sessions of Transport, or of the go-git client for the
+// scheme of the endpoint if it is nil. The limit applies across every
+// session of the transport, whatever the protocol.
+type throttledTransport struct {
+	transport.Transport
+	bucket *tokenBucket
+}
+
+// newThrottledTransport returns t limited to bytesPerSec.
+func newThrottledTransport(t transport.Transport, bytesPerSec int64) *throttledTransport {
+	return &throttledTransport{Transport: t, bucket: newTokenBucket(bytesPerSec)}
+}
+
+func (t *throttledTransport) base(ep *transport.Endpoint) (transport.Transport, error) {
+	if t.Transport != nil {
+		return t.Transport, nil
+	}
+	return client.NewClient(ep)
+}
+
+func (t *throttledTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	base, err := t.base(ep)
+	if err != nil {
+		return nil, err
+	}
+	s, err := base.NewUploadPackSession(ep, auth)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledSession{UploadPackSession: s, bucket: t.bucket}, nil
+}
+
+func (t *throttledTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	base, err := t.base(ep)
+	if err != nil {
+		return nil, err
+	}
+	return base.NewReceivePackSession(ep, auth)
+}
+
+// throttledSession reads the packfile of its responses through bucket.
+type throttledSession struct {
+	transport.UploadPackSession
+	bucket *tokenBucket
+}
+
+func (s *throttledSession) UploadPack(ctx context.Context, req *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	res, err := s.UploadPackSession.UploadPack(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	// The response has already been decoded up to the packfile, so only
+	// the packfile is left to read through the bucket.
+	throttled := packp.NewUploadPackResponseWithPackfile(req, &throttledReader{ctx: ctx, r: res, bucket: s.bucket})
+	throttled.ShallowUpdate = res.ShallowUpdate
+	throttled.ServerResponse = res.ServerResponse
+	return throttled, nil
+}
+
+// throttledReader waits for a token per byte read from r.
+type throttledReader struct {
+	ctx    context.Context
+	r      io.ReadCloser
+	bucket *tokenBucket
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.bucket.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *throttledReader) Close() error {
+	return r.r.Close()
+}
+
+// tokenBucket is filled with rate tokens per second, up to one second's
+// worth. Taking more tokens than are available puts it into debt, which
+// the taker waits to be repaid, so reads of any size can be accounted.
+type tokenBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n tokens and blocks until the bucket is out of debt, or ctx
+// is done.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,121 @@
+package git
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// privateScheme is the scheme under which clones with a Transport,
+// MaxBandwidth, SSHDialTimeout or HTTPAnonymousFirst reach their
+// transport through privateTransports.
+const privateScheme = "envbuilder"
+
+var privateTransports = &transportMux{transports: map[string]*customTransport{}}
+
+// installTransport registers t with privateTransports and returns cloneURL
+// rewritten to reach it, along with a function that unregisters it again.
+// If custom is set, t is supplied by the caller and responsible for TLS
+// and proxy settings, which are dropped from its endpoints.
+func installTransport(t transport.Transport, cloneURL string, custom bool) (string, func(), error) {
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("parse url %q: %w", redactURL(cloneURL), err)
+	}
+	id := privateTransports.add(&customTransport{Transport: t, scheme: u.Scheme, keepSettings: !custom})
+	u.Scheme = privateScheme
+	u.Path = "/" + id + u.Path
+	if u.RawPath != "" {
+		u.RawPath = "/" + id + u.RawPath
+	}
+	return u.String(), func() { privateTransports.remove(id) }, nil
+}
+
+// transportMux dispatches endpoints of privateScheme to the transport
+// registered under the first element of their path. go-git reads
+// client.Protocols without a lock, so concurrent clones cannot each
+// install a scheme of their own.
+type transportMux struct {
+	mu         sync.Mutex
+	next       int
+	transports map[string]*customTransport
+}
+
+func (m *transportMux) add(t *customTransport) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next++
+	id := strconv.Itoa(m.next)
+	m.transports[id] = t
+	return id
+}
+
+func (m *transportMux) remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.transports, id)
+}
+
+// lookup returns the transport for ep and ep with its real path.
+func (m *transportMux) lookup(ep *transport.Endpoint) (*customTransport, *transport.Endpoint, error) {
+	id, path, _ := strings.Cut(strings.TrimPrefix(ep.Path, "/"), "/")
+	m.mu.Lock()
+	t, ok := m.transports[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("no transport registered for %s", ep)
+	}
+	out := *ep
+	out.Path = "/" + path
+	return t, &out, nil
+}
+
+func (m *transportMux) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	t, ep, err := m.lookup(ep)
+	if err != nil {
+		return nil, err
+	}
+	return t.NewUploadPackSession(ep, auth)
+}
+
+func (m *transportMux) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	t, ep, err := m.lookup(ep)
+	if err != nil {
+		return nil, err
+	}
+	return t.NewReceivePackSession(ep, auth)
+}
+
+// customTransport restores the real scheme of endpoints before handing
+// them to a caller-supplied transport, and drops the TLS and proxy
+// settings that the transport is responsible for unless keepSettings is
+// set.
+type customTransport struct {
+	transport.Transport
+	scheme       string
+	keepSettings bool
+}
+
+func (t *customTransport) endpoint(ep *transport.Endpoint) *transport.Endpoint {
+	out := *ep
+	out.Protocol = t.scheme
+	if t.keepSettings {
+		return &out
+	}
+	out.InsecureSkipTLS = false
+	out.CaBundle = nil
+	out.Proxy = transport.ProxyOptions{}
+	return &out
+}
+
+func (t *customTransport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	return t.Transport.NewUploadPackSession(t.endpoint(ep), auth)
+}
+
+func (t *customTransport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	return t.Transport.NewReceivePackSession(t.endpoint(ep), auth)
+}
@@ -0,0 +1,99 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// ErrCorruptObjects is returned by CloneRepo with VerifyObjects when an
+// object needed to check out HEAD is missing or does not match its hash.
+var ErrCorruptObjects = errors.New("repository objects are corrupt")
+
+// verifyObjects checks that the HEAD commit of the repository at path, and
+// every tree and blob reachable from its tree, exist and hash to their
+// IDs. It is a lightweight fsck: history and unreachable objects are not
+// checked. Empty repositories pass.
+func verifyObjects(storage billy.Filesystem, path string) error {
+	repo, err := openRepo(storage, path)
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get head: %w", err)
+	}
+	obj, err := verifyObject(repo.Storer, plumbing.CommitObject, head.Hash())
+	if err != nil {
+		return err
+	}
+	commit, err := object.DecodeCommit(repo.Storer, obj)
+	if err != nil {
+		return fmt.Errorf("%w: commit %s: %s", ErrCorruptObjects, head.Hash(), err)
+	}
+	trees := []plumbing.Hash{commit.TreeHash}
+	seen := map[plumbing.Hash]struct{}{}
+	for len(trees) > 0 {
+		hash := trees[len(trees)-1]
+		trees = trees[:len(trees)-1]
+		obj, err := verifyObject(repo.Storer, plumbing.TreeObject, hash)
+		if err != nil {
+			return err
+		}
+		tree, err := object.DecodeTree(repo.Storer, obj)
+		if err != nil {
+			return fmt.Errorf("%w: tree %s: %s", ErrCorruptObjects, hash, err)
+		}
+		for _, entry := range tree.Entries {
+			if _, ok := seen[entry.Hash]; ok {
+				continue
+			}
+			seen[entry.Hash] = struct{}{}
+			switch entry.Mode {
+			case filemode.Dir:
+				trees = append(trees, entry.Hash)
+			case filemode.Submodule:
+				// Submodule commits live in another repository.
+			default:
+				if _, err := verifyObject(repo.Storer, plumbing.BlobObject, entry.Hash); err != nil {
+					return fmt.Errorf("%w (%s)", err, entry.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// verifyObject reads the object of type typ with the given hash, and
+// checks that its content hashes to it.
+func verifyObject(s storer.EncodedObjectStorer, typ plumbing.ObjectType, hash plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.EncodedObject(typ, hash)
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return nil, fmt.Errorf("%w: %s %s is missing", ErrCorruptObjects, typ, hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: read %s %s: %s", ErrCorruptObjects, typ, hash, err)
+	}
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: read %s %s: %s", ErrCorruptObjects, typ, hash, err)
+	}
+	defer r.Close()
+	hasher := plumbing.NewHasher(obj.Type(), obj.Size())
+	if _, err := io.Copy(hasher, r); err != nil {
+		return nil, fmt.Errorf("%w: read %s %s: %s", ErrCorruptObjects, typ, hash, err)
+	}
+	if sum := hasher.Sum(); sum != hash {
+		return nil, fmt.Errorf("%w: %s %s hashes to %s", ErrCorruptObjects, typ, hash, sum)
+	}
+	return obj, nil
+}
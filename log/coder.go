@@ -2,10 +2,15 @@ package log
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cdr.dev/slog"
@@ -27,35 +32,258 @@ var (
 	minAgentAPIV2      = "v2.9"
 )
 
+var (
+	// ErrNotCoder is returned by Coder when the URL does not point at a
+	// Coder deployment.
+	ErrNotCoder = errors.New("not a coder deployment")
+	// ErrCoderUnauthorized is returned by Coder when the deployment rejects
+	// the agent token.
+	ErrCoderUnauthorized = errors.New("coder agent token unauthorized")
+)
+
 // Coder establishes a connection to the Coder instance located at
 // coderURL and authenticates using token. It then establishes a
 // dRPC connection to the Agent API and begins sending logs.
 // If the version of Coder does not support the Agent API, it will
 // fall back to using the PatchLogs endpoint.
-// The returned function is used to block until all logs are sent.
+// The returned function stops sending and blocks until the remaining logs
+// are sent or a grace period has passed. It may be called more than once.
+//
+// Before returning, the Agent API connection is pinged to confirm that
+// the log endpoint is reachable and the token is authorized. The
+// deprecated API has no such check. Messages about setting up the
+// connection, such as failed connection attempts, are buffered and sent
+// first once it is established. The caller's messages need no buffer,
+// since they can only be logged once the returned Func exists.
+//
+// If the Agent API connection drops, it is re-established and logs that
+// Coder has not acknowledged are sent again.
 func Coder(ctx context.Context, coderURL *url.URL, token string) (Func, func(), error) {
+	sendLogs, doneFunc, _, err := CoderWithStats(ctx, coderURL, token, CoderMetadata{})
+	return sendLogs, doneFunc, err
+}
+
+// CoderWithStats is like Coder, but also returns a function that reports
+// the throughput of the returned logger. It is safe to call at any time,
+// including after the logger is done.
+//
+// Every message is tagged with metadata, see CoderMetadata. Fields that
+// fail CoderMetadata.Validate are truncated or left out with a warning
+// rather than failing the call.
+func CoderWithStats(ctx context.Context, coderURL *url.URL, token string, metadata CoderMetadata) (Func, func(), func() CoderStats, error) {
 	// To troubleshoot issues, we need some way of logging.
 	metaLogger := slog.Make(sloghuman.Sink(os.Stderr))
 	defer metaLogger.Sync()
+	var setupLogs logBuffer
+	var stats coderStats
+	md, problems := metadata.sanitize()
+	for _, problem := range problems {
+		metaLogger.Warn(ctx, "Adjusted log metadata", slog.F("problem", problem))
+		setupLogs.add(LevelWarn, "⚠️ Adjusted log metadata: %s", problem)
+	}
 	client := initClient(coderURL, token)
 	bi, err := client.SDK.BuildInfo(ctx)
 	if err != nil {
-		return nil, nil, fmt.Errorf("get coder build version: %w", err)
+		return nil, nil, nil, fmt.Errorf("get coder build version: %w", classifyCoderError(err))
 	}
 	if semver.Compare(semver.MajorMinor(bi.Version), minAgentAPIV2) < 0 {
 		metaLogger.Warn(ctx, "Detected Coder version incompatible with AgentAPI v2, falling back to deprecated API", slog.F("coder_version", bi.Version))
-		sendLogs, flushLogs := sendLogsV1(ctx, client, metaLogger.Named("send_logs_v1"))
-		return sendLogs, flushLogs, nil
+		patchLogs := func(ctx context.Context, req agentsdk.PatchLogs) error {
+			return client.PatchLogs(ctx, req)
+		}
+		reauth := func(context.Context) error {
+			// Start over with a new client, and so a new session, for
+			// the same token.
+			client = initClient(coderURL, token)
+			return nil
+		}
+		l := metaLogger.Named("send_logs_v1")
+		sendLogs, flushLogs := sendLogsV1(ctx, classifyPatchLogs(stats.patchLogs(patchLogs), reauth, l), l)
+		return stats.count(md.tag(sendLogs)), stats.finish(flushLogs), stats.snapshot, nil
 	}
-	dac, err := initRPC(ctx, client, metaLogger.Named("init_rpc"))
+	dac, err := initRPC(ctx, client, metaLogger.Named("init_rpc"), &setupLogs)
 	if err != nil {
 		// Logged externally
-		return nil, nil, fmt.Errorf("init coder rpc client: %w", err)
+		return nil, nil, nil, fmt.Errorf("init coder rpc client: %w", classifyCoderError(err))
+	}
+	if err := pingRPC(ctx, dac); err != nil {
+		return nil, nil, nil, fmt.Errorf("ping coder log endpoint: %w", err)
 	}
 	ls := agentsdk.NewLogSender(metaLogger.Named("coder_log_sender"))
 	metaLogger.Warn(ctx, "Sending logs via AgentAPI v2", slog.F("coder_version", bi.Version))
-	sendLogs, doneFunc := sendLogsV2(ctx, dac, ls, metaLogger.Named("send_logs_v2"))
-	return sendLogs, doneFunc, nil
+	setupLogs.add(LevelDebug, "Sending logs to Coder %s via AgentAPI v2", bi.Version)
+	reconnect := func(ctx context.Context) (agentsdk.LogDest, error) {
+		// The old connection is broken, its errors are not interesting.
+		_ = dac.DRPCConn().Close()
+		c, err := initRPC(ctx, client, metaLogger.Named("init_rpc"), new(logBuffer))
+		if err != nil {
+			return nil, err
+		}
+		dac = c
+		return stats.logDest(c), nil
+	}
+	sendLogs, logsDone := sendLogsV2(ctx, stats.logDest(dac), reconnect, ls, metaLogger.Named("send_logs_v2"))
+	sendLogs = stats.count(md.tag(sendLogs))
+	setupLogs.flush(sendLogs)
+	doneFunc := func() {
+		logsDone()
+		// Nothing is sent anymore, so the connection can go too.
+		_ = dac.DRPCConn().Close()
+	}
+	return sendLogs, stats.finish(doneFunc), stats.snapshot, nil
+}
+
+// maxMetadataLen is the longest value of a CoderMetadata field.
+const maxMetadataLen = 128
+
+// CoderMetadata describes the workspace build that logs sent to Coder
+// belong to, so that they can be filtered by it. Coder logs have no fields
+// for it, so the non-empty fields are prepended to every message, e.g.
+// "[owner=alice template=docker build=3] Cloning...".
+type CoderMetadata struct {
+	// Owner is the name of the workspace owner.
+	Owner string
+	// Template is the name of the workspace template.
+	Template string
+	// BuildNumber is the number of the workspace build.
+	BuildNumber int64
+}
+
+// Validate returns an error if a field of m is too long or negative.
+func (m CoderMetadata) Validate() error {
+	if len(m.Owner) > maxMetadataLen {
+		return fmt.Errorf("log metadata owner is %d bytes, must be at most %d", len(m.Owner), maxMetadataLen)
+	}
+	if len(m.Template) > maxMetadataLen {
+		return fmt.Errorf("log metadata template is %d bytes, must be at most %d", len(m.Template), maxMetadataLen)
+	}
+	if m.BuildNumber < 0 {
+		return fmt.Errorf("log metadata build number %d must not be negative", m.BuildNumber)
+	}
+	return nil
+}
+
+// sanitize returns m with Owner and Template truncated to maxMetadataLen
+// bytes and a negative BuildNumber left out, along with a description of
+// each field that was changed.
+func (m CoderMetadata) sanitize() (CoderMetadata, []string) {
+	var problems []string
+	if len(m.Owner) > maxMetadataLen {
+		problems = append(problems, fmt.Sprintf("owner is %d bytes, truncated to %d", len(m.Owner), maxMetadataLen))
+		m.Owner = truncateUTF8(m.Owner, maxMetadataLen)
+	}
+	if len(m.Template) > maxMetadataLen {
+		problems = append(problems, fmt.Sprintf("template is %d bytes, truncated to %d", len(m.Template), maxMetadataLen))
+		m.Template = truncateUTF8(m.Template, maxMetadataLen)
+	}
+	if m.BuildNumber < 0 {
+		problems = append(problems, fmt.Sprintf("build number %d is negative, left out", m.BuildNumber))
+		m.BuildNumber = 0
+	}
+	return m, problems
+}
+
+// prefix returns the tag prepended to messages, or "" if m is empty.
+func (m CoderMetadata) prefix() string {
+	var fields []string
+	if m.Owner != "" {
+		fields = append(fields, "owner="+m.Owner)
+	}
+	if m.Template != "" {
+		fields = append(fields, "template="+m.Template)
+	}
+	if m.BuildNumber > 0 {
+		fields = append(fields, fmt.Sprintf("build=%d", m.BuildNumber))
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(fields, " ") + "]"
+}
+
+// tag returns f with the metadata prepended to every message.
+func (m CoderMetadata) tag(f Func) Func {
+	prefix := m.prefix()
+	if prefix == "" {
+		return f
+	}
+	return func(l Level, msg string, args ...any) {
+		f(l, "%s "+msg, append([]any{prefix}, args...)...)
+	}
+}
+
+// coderError annotates err with one of the sentinel errors above without
+// changing its message.
+type coderError struct {
+	kind error
+	err  error
+}
+
+func (e *coderError) Error() string {
+	return e.err.Error()
+}
+
+func (e *coderError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// classifyCoderError wraps err with ErrCoderUnauthorized or ErrNotCoder
+// where the response allows us to tell. Other errors are returned as is.
+func classifyCoderError(err error) error {
+	var sdkErr *codersdk.Error
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &sdkErr) && (sdkErr.StatusCode() == http.StatusUnauthorized || sdkErr.StatusCode() == http.StatusForbidden):
+		return &coderError{kind: ErrCoderUnauthorized, err: err}
+	case errors.As(err, &sdkErr) && (sdkErr.StatusCode() == http.StatusNotFound || strings.Contains(sdkErr.Message, "non-JSON response")):
+		return &coderError{kind: ErrNotCoder, err: err}
+	case errors.As(err, &syntaxErr):
+		return &coderError{kind: ErrNotCoder, err: err}
+	default:
+		return err
+	}
+}
+
+// pingRPC confirms that the Agent API is reachable and that the token is
+// authorized by making a cheap request over the established connection.
+func pingRPC(ctx context.Context, c proto.DRPCAgentClient20) error {
+	pingCtx, pingCancel := context.WithTimeout(ctx, rpcConnectTimeout)
+	defer pingCancel()
+	_, err := c.GetServiceBanner(pingCtx, &proto.GetServiceBannerRequest{})
+	return err
+}
+
+// logBuffer holds the messages about setting up the connection to Coder
+// until there is a connection to send them over.
+type logBuffer struct {
+	mu      sync.Mutex
+	entries []bufferedLog
+}
+
+type bufferedLog struct {
+	level Level
+	msg   string
+}
+
+func (b *logBuffer) add(l Level, msg string, args ...any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries = append(b.entries, bufferedLog{
+		level: l,
+		msg:   fmt.Sprintf(msg, args...),
+	})
+}
+
+// flush sends all buffered messages to f, in the order they were logged,
+// and empties the buffer.
+func (b *logBuffer) flush(f Func) {
+	b.mu.Lock()
+	entries := b.entries
+	b.entries = nil
+	b.mu.Unlock()
+	for _, e := range entries {
+		f(e.level, "%s", e.msg)
+	}
 }
 
 type coderLogSender interface {
@@ -71,7 +299,7 @@ func initClient(coderURL *url.URL, token string) *agentsdk.Client {
 	return client
 }
 
-func initRPC(ctx context.Context, client *agentsdk.Client, l slog.Logger) (proto.DRPCAgentClient20, error) {
+func initRPC(ctx context.Context, client *agentsdk.Client, l slog.Logger, setupLogs *logBuffer) (proto.DRPCAgentClient20, error) {
 	var c proto.DRPCAgentClient20
 	var err error
 	retryCtx, retryCancel := context.WithTimeout(context.Background(), rpcConnectTimeout)
@@ -83,6 +311,7 @@ func initRPC(ctx context.Context, client *agentsdk.Client, l slog.Logger) (proto
 		c, err = client.ConnectRPC20(ctx)
 		if err != nil {
 			l.Debug(ctx, "Failed to connect to Coder", slog.F("error", err), slog.F("attempt", attempts))
+			setupLogs.add(LevelDebug, "Failed to connect to Coder (attempt %d): %s", attempts, err)
 			continue
 		}
 		break
@@ -93,11 +322,47 @@ func initRPC(ctx context.Context, client *agentsdk.Client, l slog.Logger) (proto
 	return proto.NewDRPCAgentClient(c.DRPCConn()), nil
 }
 
+// maxV1Reauths is how many times in a row a batch rejected as
+// unauthorized is retried after reauthenticating before it is dropped.
+const maxV1Reauths = 3
+
+// classifyPatchLogs wraps patchLogs for agentsdk.LogsSender, which retries
+// every failure until it succeeds. Only failures that may succeed later
+// are passed on to be retried with backoff:
+//
+//   - 5xx responses and network errors are retried.
+//   - 401 responses call reauth and are retried, up to maxV1Reauths times.
+//   - Other 4xx responses will never succeed, so the batch is dropped
+//     with a warning.
+func classifyPatchLogs(patchLogs func(context.Context, agentsdk.PatchLogs) error, reauth func(context.Context) error, l slog.Logger) func(context.Context, agentsdk.PatchLogs) error {
+	// LogsSender sends one batch at a time, so this needs no lock.
+	reauths := 0
+	return func(ctx context.Context, req agentsdk.PatchLogs) error {
+		err := patchLogs(ctx, req)
+		// codersdk.Error is matched by its method, like LogsSender does.
+		var statusErr interface{ StatusCode() int }
+		if err == nil || !errors.As(err, &statusErr) || statusErr.StatusCode() >= http.StatusInternalServerError {
+			reauths = 0
+			return err
+		}
+		if statusErr.StatusCode() == http.StatusUnauthorized && reauth != nil && reauths < maxV1Reauths {
+			reauths++
+			if reauthErr := reauth(ctx); reauthErr != nil {
+				l.Warn(ctx, "failed to reauthenticate with Coder", slog.Error(reauthErr))
+			}
+			return err
+		}
+		reauths = 0
+		l.Warn(ctx, "Coder rejected logs, dropping them", slog.F("status", statusErr.StatusCode()), slog.F("logs_count", len(req.Logs)), slog.Error(err))
+		return nil
+	}
+}
+
 // sendLogsV1 uses the PatchLogs endpoint to send logs.
 // This is deprecated, but required for backward compatibility with older versions of Coder.
-func sendLogsV1(ctx context.Context, client *agentsdk.Client, l slog.Logger) (Func, func()) {
+func sendLogsV1(ctx context.Context, patchLogs func(context.Context, agentsdk.PatchLogs) error, l slog.Logger) (Func, func()) {
 	// nolint: staticcheck // required for backwards compatibility
-	sendLogs, flushLogs := agentsdk.LogsSender(agentsdk.ExternalLogSourceID, client.PatchLogs, slog.Logger{})
+	sendLogs, flushLogs := agentsdk.LogsSender(agentsdk.ExternalLogSourceID, patchLogs, slog.Logger{})
 	return func(lvl Level, msg string, args ...any) {
 			log := agentsdk.Log{
 				CreatedAt: time.Now(),
@@ -115,31 +380,58 @@ func sendLogsV1(ctx context.Context, client *agentsdk.Client, l slog.Logger) (Fu
 }
 
 // sendLogsV2 uses the v2 agent API to send logs. Only compatibile with coder versions >= 2.9.
-func sendLogsV2(ctx context.Context, dest agentsdk.LogDest, ls coderLogSender, l slog.Logger) (Func, func()) {
+//
+// If sending fails, e.g. because the connection dropped, reconnect is used
+// to get a new destination and sending resumes. The log sender only
+// discards logs once Coder has acknowledged the batch they were sent in,
+// so only unacknowledged logs are sent again. If reconnect is nil, sending
+// stops at the first failure.
+//
+// The returned done func stops sending, either when it is called or when
+// ctx is canceled, and waits up to logSendGracePeriod for the remaining
+// logs to be sent. Once it returns, no goroutines started here are left
+// running. It may be called more than once.
+func sendLogsV2(ctx context.Context, dest agentsdk.LogDest, reconnect func(context.Context) (agentsdk.LogDest, error), ls coderLogSender, l slog.Logger) (Func, func()) {
 	done := make(chan struct{})
 	uid := uuid.New()
+	loopCtx, stop := context.WithCancel(ctx)
 	go func() {
 		defer close(done)
-		if err := ls.SendLoop(ctx, dest); err != nil {
-			if !errors.Is(err, context.Canceled) {
+		for r := retry.New(100*time.Millisecond, logSendGracePeriod); r.Wait(loopCtx); {
+			err := ls.SendLoop(loopCtx, dest)
+			if err == nil || loopCtx.Err() != nil {
+				break
+			}
+			if reconnect == nil || errors.Is(err, agentsdk.LogLimitExceededError) {
 				l.Warn(ctx, "failed to send logs to Coder", slog.Error(err))
+				break
+			}
+			l.Warn(ctx, "failed to send logs to Coder, reconnecting", slog.Error(err))
+			newDest, err := reconnect(loopCtx)
+			if err != nil {
+				l.Warn(ctx, "failed to reconnect to Coder", slog.Error(err))
+				continue
 			}
+			dest = newDest
 		}
 
-		// Wait for up to 10 seconds for logs to finish sending.
+		// Wait for up to 10 seconds for logs to finish sending. The send
+		// loop is stopped as soon as the queue is empty, or if it fails.
 		sendCtx, sendCancel := context.WithTimeout(context.Background(), logSendGracePeriod)
 		defer sendCancel()
-		// Try once more to send any pending logs
-		if err := ls.SendLoop(sendCtx, dest); err != nil {
-			if !errors.Is(err, context.DeadlineExceeded) {
-				l.Warn(ctx, "failed to send remaining logs to Coder", slog.Error(err))
-			}
-		}
 		ls.Flush(uid)
-		if err := ls.WaitUntilEmpty(sendCtx); err != nil {
-			if !errors.Is(err, context.DeadlineExceeded) {
-				l.Warn(ctx, "log sender did not empty", slog.Error(err))
-			}
+		sendErr := make(chan error, 1)
+		go func() {
+			err := ls.SendLoop(sendCtx, dest)
+			sendCancel()
+			sendErr <- err
+		}()
+		emptyErr := ls.WaitUntilEmpty(sendCtx)
+		sendCancel()
+		if err := <-sendErr; err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			l.Warn(ctx, "failed to send remaining logs to Coder", slog.Error(err))
+		} else if errors.Is(emptyErr, context.DeadlineExceeded) {
+			l.Warn(ctx, "log sender did not empty", slog.Error(emptyErr))
 		}
 	}()
 
@@ -152,8 +444,106 @@ func sendLogsV2(ctx context.Context, dest agentsdk.LogDest, ls coderLogSender, l
 	}
 
 	doneFunc := func() {
+		stop()
 		<-done
 	}
 
 	return logFunc, doneFunc
 }
+
+// CoderStats reports the throughput of a logger returned by
+// CoderWithStats.
+type CoderStats struct {
+	// Sent is the number of log records accepted by Coder.
+	Sent uint64
+	// Retried is the number of log records in requests to Coder that
+	// failed and were kept to be sent again.
+	Retried uint64
+	// Dropped is the number of log records that will never be sent, e.g.
+	// because the queue was full or the server log limit was reached. Once
+	// the logger is done, it includes everything that was not sent.
+	Dropped uint64
+	// LastSendLatency is how long the most recent request to Coder took,
+	// whether or not it succeeded.
+	LastSendLatency time.Duration
+}
+
+// coderStats counts the log records sent to Coder. It is safe for
+// concurrent use.
+type coderStats struct {
+	logged      atomic.Uint64
+	sent        atomic.Uint64
+	retried     atomic.Uint64
+	dropped     atomic.Uint64
+	lastLatency atomic.Int64
+}
+
+func (s *coderStats) snapshot() CoderStats {
+	return CoderStats{
+		Sent:            s.sent.Load(),
+		Retried:         s.retried.Load(),
+		Dropped:         s.dropped.Load(),
+		LastSendLatency: time.Duration(s.lastLatency.Load()),
+	}
+}
+
+// record counts the outcome of a request to Coder with n log records.
+func (s *coderStats) record(n int, start time.Time, err error) {
+	s.lastLatency.Store(int64(time.Since(start)))
+	if err != nil {
+		s.retried.Add(uint64(n))
+		return
+	}
+	s.sent.Add(uint64(n))
+}
+
+// count counts the log records passed to f.
+func (s *coderStats) count(f Func) Func {
+	return func(l Level, msg string, args ...any) {
+		s.logged.Add(1)
+		f(l, msg, args...)
+	}
+}
+
+// finish wraps done so that, once it returns, everything logged but not
+// sent is counted as dropped.
+func (s *coderStats) finish(done func()) func() {
+	return func() {
+		done()
+		logged, sent := s.logged.Load(), s.sent.Load()
+		if logged > sent {
+			s.dropped.Store(logged - sent)
+		}
+	}
+}
+
+func (s *coderStats) logDest(dest agentsdk.LogDest) agentsdk.LogDest {
+	return &statsLogDest{dest: dest, stats: s}
+}
+
+type statsLogDest struct {
+	dest  agentsdk.LogDest
+	stats *coderStats
+}
+
+func (d *statsLogDest) BatchCreateLogs(ctx context.Context, req *proto.BatchCreateLogsRequest) (*proto.BatchCreateLogsResponse, error) {
+	start := time.Now()
+	resp, err := d.dest.BatchCreateLogs(ctx, req)
+	if err == nil && resp.LogLimitExceeded {
+		// The log sender discards this batch and everything after it.
+		d.stats.lastLatency.Store(int64(time.Since(start)))
+		d.stats.dropped.Add(uint64(len(req.Logs)))
+		return resp, err
+	}
+	d.stats.record(len(req.Logs), start, err)
+	return resp, err
+}
+
+func (s *coderStats) patchLogs(patchLogs func(context.Context, agentsdk.PatchLogs) error) func(context.Context, agentsdk.PatchLogs) error {
+	return func(ctx context.Context, req agentsdk.PatchLogs) error {
+		start := time.Now()
+		err := patchLogs(ctx, req)
+		s.record(len(req.Logs), start, err)
+		return err
+	}
+}
@@ -3,11 +3,15 @@ package log
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,6 +22,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 )
 
 func TestCoder(t *testing.T) {
@@ -112,9 +117,32 @@ func TestCoder(t *testing.T) {
 		_, _, err = Coder(ctx, u, token)
 		require.ErrorContains(t, err, "get coder build version")
 		require.ErrorContains(t, err, "unexpected non-JSON response")
+		require.ErrorIs(t, err, ErrNotCoder)
+		require.NotErrorIs(t, err, ErrCoderUnauthorized)
 		<-handlerCalled
 	})
 
+	t.Run("ErrUnauthorized", func(t *testing.T) {
+		t.Parallel()
+
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"message": "Invalid session token"}`))
+		}
+		srv := httptest.NewServer(http.HandlerFunc(handler))
+		defer srv.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		_, _, err = Coder(ctx, u, uuid.NewString())
+		require.ErrorContains(t, err, "Invalid session token")
+		require.ErrorIs(t, err, ErrCoderUnauthorized)
+		require.NotErrorIs(t, err, ErrNotCoder)
+	})
+
 	// In this test, we just fake out the DRPC server.
 	t.Run("V2/OK", func(t *testing.T) {
 		t.Parallel()
@@ -124,7 +152,7 @@ func TestCoder(t *testing.T) {
 
 		ld := &fakeLogDest{t: t}
 		ls := agentsdk.NewLogSender(slogtest.Make(t, nil))
-		logFunc, logsDone := sendLogsV2(ctx, ld, ls, slogtest.Make(t, nil))
+		logFunc, logsDone := sendLogsV2(ctx, ld, nil, ls, slogtest.Make(t, nil))
 		defer logsDone()
 
 		// Send some logs
@@ -140,6 +168,45 @@ func TestCoder(t *testing.T) {
 		require.Len(t, ld.logs, 10)
 	})
 
+	// In this test, the first batch fails as if the connection dropped.
+	// The sender reconnects and resends only what was not acknowledged.
+	t.Run("V2/Reconnect", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ld := &flakyLogDest{failures: 1}
+		var reconnects atomic.Int32
+		reconnect := func(context.Context) (agentsdk.LogDest, error) {
+			reconnects.Add(1)
+			return ld, nil
+		}
+		ls := agentsdk.NewLogSender(slogtest.Make(t, nil))
+		logFunc, logsDone := sendLogsV2(ctx, ld, reconnect, ls, slogtest.Make(t, nil))
+		defer logsDone()
+
+		for i := 0; i < 10; i++ {
+			logFunc(LevelInfo, "info log %d", i+1)
+		}
+		require.Eventually(t, func() bool {
+			return len(ld.received()) == 10
+		}, 10*time.Second, 10*time.Millisecond)
+		// Acknowledged logs must not be sent again after reconnecting.
+		logFunc(LevelInfo, "info log 11")
+		require.Eventually(t, func() bool {
+			return len(ld.received()) == 11
+		}, 10*time.Second, 10*time.Millisecond)
+
+		cancel()
+		logsDone()
+
+		require.EqualValues(t, 1, reconnects.Load())
+		for i, l := range ld.received() {
+			require.Equal(t, fmt.Sprintf("info log %d", i+1), l.Output)
+		}
+	})
+
 	// In this test, we just stand up an endpoint that does not
 	// do dRPC. We'll try to connect, fail to websocket upgrade
 	// and eventually give up.
@@ -221,6 +288,29 @@ func TestCoder(t *testing.T) {
 	})
 }
 
+func TestLogBuffer(t *testing.T) {
+	t.Parallel()
+
+	var b logBuffer
+	b.add(LevelDebug, "connecting (attempt %d)", 1)
+	b.add(LevelWarn, "connecting (attempt %d)", 2)
+
+	var got []string
+	f := func(l Level, msg string, args ...any) {
+		got = append(got, fmt.Sprintf("%s: %s", l, fmt.Sprintf(msg, args...)))
+	}
+	b.flush(f)
+	require.Equal(t, []string{
+		"debug: connecting (attempt 1)",
+		"warn: connecting (attempt 2)",
+	}, got)
+
+	// The buffer is emptied by flush.
+	got = nil
+	b.flush(f)
+	require.Empty(t, got)
+}
+
 type fakeLogDest struct {
 	t    testing.TB
 	logs []*proto.Log
@@ -231,3 +321,255 @@ func (d *fakeLogDest) BatchCreateLogs(ctx context.Context, request *proto.BatchC
 	d.logs = append(d.logs, request.Logs...)
 	return &proto.BatchCreateLogsResponse{}, nil
 }
+
+func TestSendLogsV2Done(t *testing.T) {
+	// Not parallel: goroutines of other tests would count as leaks.
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	t.Run("Done", func(t *testing.T) {
+		ld := &fakeLogDest{t: t}
+		ls := agentsdk.NewLogSender(slogtest.Make(t, nil))
+		// The context is never canceled, calling done is enough.
+		logFunc, logsDone := sendLogsV2(context.Background(), ld, nil, ls, slogtest.Make(t, nil))
+		for i := 0; i < 10; i++ {
+			logFunc(LevelInfo, "info log %d", i+1)
+		}
+
+		start := time.Now()
+		logsDone()
+		// The remaining logs were sent without waiting for the grace
+		// period to run out.
+		require.Less(t, time.Since(start), logSendGracePeriod)
+		require.Len(t, ld.logs, 10)
+		// Calling it again returns straight away.
+		logsDone()
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		ld := &fakeLogDest{t: t}
+		ls := agentsdk.NewLogSender(slogtest.Make(t, nil))
+		logFunc, logsDone := sendLogsV2(ctx, ld, nil, ls, slogtest.Make(t, nil))
+		logFunc(LevelInfo, "info log")
+		cancel()
+		logsDone()
+		logsDone()
+		require.Len(t, ld.logs, 1)
+	})
+}
+
+func TestCoderStats(t *testing.T) {
+	t.Parallel()
+
+	t.Run("V2/OK", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var stats coderStats
+		ld := &fakeLogDest{t: t}
+		ls := agentsdk.NewLogSender(slogtest.Make(t, nil))
+		logFunc, logsDone := sendLogsV2(ctx, stats.logDest(ld), nil, ls, slogtest.Make(t, nil))
+		logFunc = stats.count(logFunc)
+		logsDone = stats.finish(logsDone)
+
+		for i := 0; i < 10; i++ {
+			logFunc(LevelInfo, "info log %d", i+1)
+		}
+		cancel()
+		logsDone()
+
+		got := stats.snapshot()
+		require.EqualValues(t, 10, got.Sent)
+		require.Zero(t, got.Dropped)
+		require.Zero(t, got.Retried)
+	})
+
+	t.Run("V2/LogLimitExceeded", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var stats coderStats
+		ls := agentsdk.NewLogSender(slogtest.Make(t, nil))
+		logFunc, logsDone := sendLogsV2(ctx, stats.logDest(limitLogDest{}), nil, ls, slogtest.Make(t, nil))
+		logFunc = stats.count(logFunc)
+		logsDone = stats.finish(logsDone)
+
+		for i := 0; i < 10; i++ {
+			logFunc(LevelInfo, "info log %d", i+1)
+		}
+		cancel()
+		logsDone()
+
+		got := stats.snapshot()
+		require.Zero(t, got.Sent)
+		require.EqualValues(t, 10, got.Dropped)
+	})
+
+	t.Run("V1/Retried", func(t *testing.T) {
+		t.Parallel()
+
+		var stats coderStats
+		patchLogs := stats.patchLogs(func(context.Context, agentsdk.PatchLogs) error {
+			return assert.AnError
+		})
+		err := patchLogs(context.Background(), agentsdk.PatchLogs{Logs: make([]agentsdk.Log, 3)})
+		require.ErrorIs(t, err, assert.AnError)
+		require.EqualValues(t, 3, stats.snapshot().Retried)
+		require.Zero(t, stats.snapshot().Sent)
+	})
+}
+
+func TestClassifyPatchLogs(t *testing.T) {
+	t.Parallel()
+
+	req := agentsdk.PatchLogs{Logs: make([]agentsdk.Log, 2)}
+	for _, tc := range []struct {
+		name    string
+		err     error
+		retried bool
+	}{
+		{name: "OK"},
+		{name: "Network", err: assert.AnError, retried: true},
+		{name: "ServerError", err: statusError(http.StatusBadGateway), retried: true},
+		{name: "BadRequest", err: statusError(http.StatusBadRequest)},
+		{name: "Forbidden", err: statusError(http.StatusForbidden)},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			reauthed := false
+			patchLogs := classifyPatchLogs(func(context.Context, agentsdk.PatchLogs) error {
+				return tc.err
+			}, func(context.Context) error {
+				reauthed = true
+				return nil
+			}, slogtest.Make(t, nil))
+			err := patchLogs(context.Background(), req)
+			if tc.retried {
+				require.ErrorIs(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.False(t, reauthed)
+		})
+	}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		t.Parallel()
+		reauths := 0
+		patchLogs := classifyPatchLogs(func(context.Context, agentsdk.PatchLogs) error {
+			return statusError(http.StatusUnauthorized)
+		}, func(context.Context) error {
+			reauths++
+			return nil
+		}, slogtest.Make(t, nil))
+		for i := 0; i < maxV1Reauths; i++ {
+			require.Error(t, patchLogs(context.Background(), req))
+		}
+		require.Equal(t, maxV1Reauths, reauths)
+		// Reauthenticating did not help, so the batch is dropped.
+		require.NoError(t, patchLogs(context.Background(), req))
+		require.Equal(t, maxV1Reauths, reauths)
+	})
+
+	t.Run("UnauthorizedRecovers", func(t *testing.T) {
+		t.Parallel()
+		authorized := false
+		var sent int
+		patchLogs := classifyPatchLogs(func(context.Context, agentsdk.PatchLogs) error {
+			if !authorized {
+				return statusError(http.StatusUnauthorized)
+			}
+			sent++
+			return nil
+		}, func(context.Context) error {
+			authorized = true
+			return nil
+		}, slogtest.Make(t, nil))
+		require.Error(t, patchLogs(context.Background(), req))
+		require.NoError(t, patchLogs(context.Background(), req))
+		require.Equal(t, 1, sent)
+	})
+}
+
+// statusError is an error with an HTTP status code, like codersdk.Error.
+type statusError int
+
+func (e statusError) Error() string {
+	return http.StatusText(int(e))
+}
+
+func (e statusError) StatusCode() int {
+	return int(e)
+}
+
+type limitLogDest struct{}
+
+func (limitLogDest) BatchCreateLogs(context.Context, *proto.BatchCreateLogsRequest) (*proto.BatchCreateLogsResponse, error) {
+	return &proto.BatchCreateLogsResponse{LogLimitExceeded: true}, nil
+}
+
+// flakyLogDest fails the first failures batches, like a dropped
+// connection, and accepts the rest.
+type flakyLogDest struct {
+	mu       sync.Mutex
+	failures int
+	logs     []*proto.Log
+}
+
+func (d *flakyLogDest) BatchCreateLogs(_ context.Context, request *proto.BatchCreateLogsRequest) (*proto.BatchCreateLogsResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failures > 0 {
+		d.failures--
+		return nil, errors.New("connection reset")
+	}
+	d.logs = append(d.logs, request.Logs...)
+	return &proto.BatchCreateLogsResponse{}, nil
+}
+
+func (d *flakyLogDest) received() []*proto.Log {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.logs)
+}
+
+func TestCoderMetadata(t *testing.T) {
+	t.Parallel()
+
+	var got []string
+	f := func(_ Level, msg string, args ...any) {
+		got = append(got, fmt.Sprintf(msg, args...))
+	}
+	md := CoderMetadata{Owner: "alice", Template: "docker", BuildNumber: 3}
+	require.NoError(t, md.Validate())
+	md.tag(f)(LevelInfo, "100%% %s", "done")
+	CoderMetadata{Template: "docker"}.tag(f)(LevelInfo, "hello")
+	CoderMetadata{}.tag(f)(LevelInfo, "untagged")
+	require.Equal(t, []string{
+		"[owner=alice template=docker build=3] 100% done",
+		"[template=docker] hello",
+		"untagged",
+	}, got)
+
+	long := strings.Repeat("a", maxMetadataLen+1)
+	require.ErrorContains(t, CoderMetadata{Owner: long}.Validate(), "log metadata owner is 129 bytes")
+	require.ErrorContains(t, CoderMetadata{Template: long}.Validate(), "log metadata template")
+	require.ErrorContains(t, CoderMetadata{BuildNumber: -1}.Validate(), "must not be negative")
+
+	// Invalid metadata does not fail the logger, it is cut down instead.
+	sanitized, problems := CoderMetadata{Owner: long, Template: "docker", BuildNumber: -1}.sanitize()
+	require.Equal(t, CoderMetadata{Owner: long[:maxMetadataLen], Template: "docker"}, sanitized)
+	require.NoError(t, sanitized.Validate())
+	require.Equal(t, []string{
+		"owner is 129 bytes, truncated to 128",
+		"build number -1 is negative, left out",
+	}, problems)
+	sanitized, problems = md.sanitize()
+	require.Equal(t, md, sanitized)
+	require.Empty(t, problems)
+}
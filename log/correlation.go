@@ -0,0 +1,42 @@
+package log
+
+import (
+	"context"
+	"strings"
+)
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying id, which identifies a
+// build across systems. Loggers derived with Correlated tag every message
+// with it.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by ctx, or "" if there
+// is none.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// Correlated returns f with "[correlation=<id>]" prepended to every
+// message, so that all activity for one build can be found by grepping
+// for it. Messages that are already tagged with id are passed through,
+// so wrapping a correlated Func again is harmless. f is returned as is if
+// it is nil or id is empty.
+func Correlated(f Func, id string) Func {
+	if f == nil || id == "" {
+		return f
+	}
+	// The tag is part of the format, escaped, so that it can be detected.
+	tag := strings.ReplaceAll("[correlation="+id+"] ", "%", "%%")
+	return func(l Level, msg string, args ...any) {
+		if strings.HasPrefix(msg, tag) {
+			f(l, msg, args...)
+			return
+		}
+		f(l, tag+msg, args...)
+	}
+}
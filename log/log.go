@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/coder/coder/v2/codersdk"
 )
@@ -38,6 +39,29 @@ func New(w io.Writer, verbose bool) Func {
 	}
 }
 
+// LevelDrop is returned by a Transform to drop a message.
+const LevelDrop = Level("drop")
+
+// Transform rewrites a formatted log message and its level before it is
+// logged, or returns LevelDrop to drop it.
+type Transform func(l Level, msg string) (Level, string)
+
+// Transformed returns f with t applied to every message, which is
+// formatted first so that t sees it as it would be logged. f is returned
+// as is if t is nil.
+func Transformed(f Func, t Transform) Func {
+	if f == nil || t == nil {
+		return f
+	}
+	return func(l Level, msg string, args ...any) {
+		l, s := t(l, fmt.Sprintf(msg, args...))
+		if l == LevelDrop {
+			return
+		}
+		f(l, "%s", s)
+	}
+}
+
 // Wrap wraps the provided LogFuncs into a single Func.
 func Wrap(fs ...Func) Func {
 	return func(l Level, msg string, args ...any) {
@@ -74,3 +98,63 @@ func Writer(logf Func) (io.Writer, func()) {
 	}
 	return pipeWriter, closer
 }
+
+// DefaultMaxMessageSize is the size in bytes that Capped limits messages
+// to when no size is given.
+const DefaultMaxMessageSize = 64 * 1024
+
+// Modes for messages longer than the limit of Capped.
+const (
+	OversizeSplit    = "split"
+	OversizeTruncate = "truncate"
+)
+
+const (
+	continuedMarker = "(continued) "
+	ellipsis        = "…"
+)
+
+// Capped limits the messages logged to f to maxSize bytes, so that a
+// single huge message, e.g. a dumped stack, is not rejected by a log
+// sink with a per-message limit. In split mode, the default, a long
+// message is logged as several messages, each after the first marked
+// "(continued)". In truncate mode it is cut short and ends in an
+// ellipsis. A maxSize of 0 or less means DefaultMaxMessageSize.
+func Capped(f Func, maxSize int, mode string) Func {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	// Leave room for the marker in every message.
+	maxSize = max(maxSize, len(continuedMarker)+utf8.UTFMax)
+	return func(l Level, msg string, args ...any) {
+		s := fmt.Sprintf(msg, args...)
+		if len(s) <= maxSize {
+			f(l, msg, args...)
+			return
+		}
+		if mode == OversizeTruncate {
+			f(l, "%s", truncateUTF8(s, maxSize-len(ellipsis))+ellipsis)
+			return
+		}
+		for prefix := ""; s != ""; prefix = continuedMarker {
+			chunk := truncateUTF8(s, maxSize-len(prefix))
+			f(l, "%s", prefix+chunk)
+			s = s[len(chunk):]
+		}
+	}
+}
+
+// truncateUTF8 returns the longest prefix of s that is at most n bytes
+// and does not cut a UTF-8 sequence in half. n must be positive.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for i := n; i > n-utf8.UTFMax && i > 0; i-- {
+		if utf8.RuneStart(s[i]) {
+			return s[:i]
+		}
+	}
+	// Not valid UTF-8, so cut anywhere.
+	return s[:n]
+}
@@ -1,8 +1,12 @@
 package log_test
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/coder/envbuilder/log"
 	"github.com/stretchr/testify/require"
@@ -27,3 +31,222 @@ func Test_Verbose(t *testing.T) {
 		require.Equal(t, "world\n", sb.String())
 	})
 }
+
+func Test_Prefixed(t *testing.T) {
+	t.Parallel()
+
+	t.Run("default", func(t *testing.T) {
+		var sb strings.Builder
+		l := log.Prefixed(log.New(&sb, false), nil, log.PhaseCloning)
+		l(log.LevelInfo, "hello %s", "world")
+		require.Equal(t, "#1: hello world\n", sb.String())
+	})
+
+	t.Run("phase", func(t *testing.T) {
+		var sb strings.Builder
+		prefix := log.PrefixerFor(log.PrefixStylePhase)
+		log.Prefixed(log.New(&sb, false), prefix, log.PhaseResolvingAuth)(log.LevelInfo, "auth")
+		log.Prefixed(log.New(&sb, false), prefix, log.PhaseCloning)(log.LevelInfo, "100%% done")
+		require.Equal(t, "[auth] auth\n[clone] 100% done\n", sb.String())
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		require.Nil(t, log.Prefixed(nil, nil, log.PhaseCloning))
+	})
+}
+
+func Test_LoggerScope(t *testing.T) {
+	t.Parallel()
+
+	var sb strings.Builder
+	logger := log.Logger{Func: log.New(&sb, false), Prefix: log.PhasePrefix}
+	logger.Scope(log.PhaseResolvingAuth)(log.LevelInfo, "auth")
+	logger.Scope(log.PhaseCheckingOut)(log.LevelInfo, "%d files", 3)
+	logger.Func(log.LevelInfo, "raw")
+	require.Equal(t, "[auth] auth\n[checkout] 3 files\nraw\n", sb.String())
+
+	sb.Reset()
+	log.Logger{Func: log.New(&sb, false)}.Scope(log.PhaseCloning)(log.LevelInfo, "clone")
+	require.Equal(t, "#1: clone\n", sb.String())
+
+	require.Nil(t, log.Logger{}.Scope(log.PhaseCloning))
+}
+
+func Test_Capped(t *testing.T) {
+	t.Parallel()
+
+	huge := strings.Repeat("é", 512*1024) // 1MB
+
+	t.Run("split", func(t *testing.T) {
+		var msgs []string
+		l := log.Capped(func(_ log.Level, msg string, args ...any) {
+			msgs = append(msgs, fmt.Sprintf(msg, args...))
+		}, 1000, log.OversizeSplit)
+		l(log.LevelInfo, "%s", huge)
+		require.Greater(t, len(msgs), 1)
+		var sb strings.Builder
+		for i, msg := range msgs {
+			require.LessOrEqual(t, len(msg), 1000)
+			require.True(t, utf8.ValidString(msg))
+			if i > 0 {
+				require.True(t, strings.HasPrefix(msg, "(continued) "))
+				msg = strings.TrimPrefix(msg, "(continued) ")
+			}
+			sb.WriteString(msg)
+		}
+		require.Equal(t, huge, sb.String())
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		var msgs []string
+		l := log.Capped(func(_ log.Level, msg string, args ...any) {
+			msgs = append(msgs, fmt.Sprintf(msg, args...))
+		}, 1000, log.OversizeTruncate)
+		l(log.LevelInfo, "%s", huge)
+		require.Len(t, msgs, 1)
+		require.LessOrEqual(t, len(msgs[0]), 1000)
+		require.True(t, strings.HasSuffix(msgs[0], "…"))
+		require.True(t, strings.HasPrefix(huge, strings.TrimSuffix(msgs[0], "…")))
+	})
+
+	t.Run("short", func(t *testing.T) {
+		var sb strings.Builder
+		l := log.Capped(log.New(&sb, false), 0, "")
+		l(log.LevelInfo, "hello %s", "world")
+		require.Equal(t, "hello world\n", sb.String())
+	})
+}
+
+func Test_Correlated(t *testing.T) {
+	t.Parallel()
+
+	t.Run("tag", func(t *testing.T) {
+		var sb strings.Builder
+		l := log.Correlated(log.New(&sb, false), "build-42")
+		l(log.LevelInfo, "hello %s", "world")
+		require.Equal(t, "[correlation=build-42] hello world\n", sb.String())
+	})
+
+	t.Run("once", func(t *testing.T) {
+		var sb strings.Builder
+		l := log.Correlated(log.Correlated(log.New(&sb, false), "100%"), "100%")
+		l(log.LevelInfo, "%d%% done", 50)
+		require.Equal(t, "[correlation=100%] 50% done\n", sb.String())
+	})
+
+	t.Run("context", func(t *testing.T) {
+		ctx := log.WithCorrelationID(context.Background(), "build-42")
+		require.Equal(t, "build-42", log.CorrelationID(ctx))
+		require.Empty(t, log.CorrelationID(context.Background()))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		require.Nil(t, log.Correlated(nil, "build-42"))
+		var sb strings.Builder
+		log.Correlated(log.New(&sb, false), "")(log.LevelInfo, "hello")
+		require.Equal(t, "hello\n", sb.String())
+	})
+}
+
+func Test_Transformed(t *testing.T) {
+	t.Parallel()
+
+	redact := func(l log.Level, msg string) (log.Level, string) {
+		switch {
+		case strings.Contains(msg, "noise"):
+			return log.LevelDrop, ""
+		case strings.Contains(msg, "secret"):
+			return log.LevelWarn, strings.ReplaceAll(msg, "secret", "*****")
+		}
+		return l, msg
+	}
+
+	t.Run("transform", func(t *testing.T) {
+		var levels []log.Level
+		var sb strings.Builder
+		l := log.Transformed(log.Wrap(log.New(&sb, false), func(l log.Level, _ string, _ ...any) {
+			levels = append(levels, l)
+		}), redact)
+		l(log.LevelInfo, "token is %s", "secret")
+		l(log.LevelInfo, "some %s", "noise")
+		l(log.LevelInfo, "%d%% done", 50)
+		require.Equal(t, "token is *****\n50% done\n", sb.String())
+		require.Equal(t, []log.Level{log.LevelWarn, log.LevelInfo}, levels)
+	})
+
+	t.Run("correlated", func(t *testing.T) {
+		var sb strings.Builder
+		l := log.Transformed(log.Correlated(log.New(&sb, false), "build-42"), redact)
+		l(log.LevelInfo, "hello %s", "secret")
+		require.Equal(t, "[correlation=build-42] hello *****\n", sb.String())
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		require.Nil(t, log.Transformed(nil, redact))
+		var sb strings.Builder
+		log.Transformed(log.New(&sb, false), nil)(log.LevelInfo, "hello")
+		require.Equal(t, "hello\n", sb.String())
+	})
+}
+
+func Test_Syslog(t *testing.T) {
+	t.Parallel()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	logf, closeSyslog, err := log.Syslog("udp", conn.LocalAddr().String(), "")
+	require.NoError(t, err)
+	defer closeSyslog()
+
+	read := func() string {
+		buf := make([]byte, 1024)
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+	for _, tc := range []struct {
+		level    log.Level
+		priority string
+	}{
+		{log.LevelDebug, "<15>"},
+		{log.LevelInfo, "<14>"},
+		{log.LevelWarn, "<12>"},
+		{log.LevelError, "<11>"},
+	} {
+		logf(tc.level, "hello %s", "world")
+		msg := read()
+		require.True(t, strings.HasPrefix(msg, tc.priority), "%s: %q", tc.level, msg)
+		require.Contains(t, msg, log.DefaultSyslogTag+"[")
+		require.True(t, strings.HasSuffix(msg, "hello world\n"), "%s: %q", tc.level, msg)
+	}
+}
+
+func Test_ParseSyslogAddress(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		in      string
+		network string
+		addr    string
+		err     bool
+	}{
+		{in: "local"},
+		{in: "udp://syslog.tld:1514", network: "udp", addr: "syslog.tld:1514"},
+		{in: "tcp://syslog.tld", network: "tcp", addr: "syslog.tld:514"},
+		{in: "udp://[::1]", network: "udp", addr: "[::1]:514"},
+		{in: "syslog.tld:514", err: true},
+		{in: "http://syslog.tld", err: true},
+		{in: "tcp://syslog.tld/path", err: true},
+	} {
+		network, addr, err := log.ParseSyslogAddress(tc.in)
+		if tc.err {
+			require.Error(t, err, tc.in)
+			continue
+		}
+		require.NoError(t, err, tc.in)
+		require.Equal(t, tc.network, network, tc.in)
+		require.Equal(t, tc.addr, addr, tc.in)
+	}
+}
@@ -0,0 +1,114 @@
+package log
+
+import "fmt"
+
+// Phase identifies a stage of preparing the workspace repository.
+type Phase string
+
+const (
+	// PhaseResolvingAuth is reported while determining how to authenticate
+	// with the Git remote.
+	PhaseResolvingAuth Phase = "resolving_auth"
+	// PhaseConnecting is reported while connecting to the Git remote.
+	PhaseConnecting Phase = "connecting"
+	// PhaseCloning is reported once the remote starts sending objects.
+	PhaseCloning Phase = "cloning"
+	// PhaseCheckingOut is reported while the worktree is populated.
+	PhaseCheckingOut Phase = "checking_out"
+)
+
+// ProgressReporter is notified as envbuilder moves between phases, so that
+// UIs can show progress across the whole flow rather than only the clone.
+type ProgressReporter interface {
+	Phase(p Phase)
+}
+
+// ProgressFunc adapts a function to a ProgressReporter.
+type ProgressFunc func(p Phase)
+
+func (f ProgressFunc) Phase(p Phase) {
+	f(p)
+}
+
+// ReportPhase notifies r that p has started. It is a no-op if r is nil.
+func ReportPhase(r ProgressReporter, p Phase) {
+	if r != nil {
+		r.Phase(p)
+	}
+}
+
+// Prefixer returns the label prepended to log lines emitted during a phase.
+type Prefixer func(p Phase) string
+
+// StepPrefix labels every phase with the same build step number, e.g.
+// "#1:". This is the default.
+func StepPrefix(step int) Prefixer {
+	label := fmt.Sprintf("#%d:", step)
+	return func(Phase) string {
+		return label
+	}
+}
+
+// PhasePrefix labels each phase by name, e.g. "[auth]" or "[clone]".
+func PhasePrefix(p Phase) string {
+	switch p {
+	case PhaseResolvingAuth:
+		return "[auth]"
+	case PhaseConnecting:
+		return "[connect]"
+	case PhaseCloning:
+		return "[clone]"
+	case PhaseCheckingOut:
+		return "[checkout]"
+	default:
+		return "[" + string(p) + "]"
+	}
+}
+
+// Prefix styles accepted by PrefixerFor.
+const (
+	PrefixStyleStep  = "step"
+	PrefixStylePhase = "phase"
+)
+
+// PrefixerFor returns the Prefixer for the named style. Unknown or empty
+// styles use StepPrefix(1).
+func PrefixerFor(style string) Prefixer {
+	if style == PrefixStylePhase {
+		return PhasePrefix
+	}
+	return StepPrefix(1)
+}
+
+// Prefixed returns a Func that logs to f with the label for p prepended to
+// every message. A nil prefix uses StepPrefix(1), and a nil f is returned
+// as is.
+func Prefixed(f Func, prefix Prefixer, p Phase) Func {
+	if f == nil {
+		return nil
+	}
+	if prefix == nil {
+		prefix = StepPrefix(1)
+	}
+	label := prefix(p)
+	return func(l Level, msg string, args ...any) {
+		f(l, "%s "+msg, append([]any{label}, args...)...)
+	}
+}
+
+// Logger is a Func along with the Prefixer that labels its lines, so that
+// a single logger can be passed through auth, clone and build and scoped
+// to each phase where it is used.
+type Logger struct {
+	// Func is the underlying Func, which can still be called directly
+	// for unlabeled lines. If nil, Scope returns nil.
+	Func Func
+	// Prefix labels the lines of each phase. If nil, StepPrefix(1) is
+	// used.
+	Prefix Prefixer
+}
+
+// Scope returns a Func that labels every message with the prefix for p.
+func (l Logger) Scope(p Phase) Func {
+	return Prefixed(l.Func, l.Prefix, p)
+}
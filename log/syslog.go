@@ -0,0 +1,65 @@
+package log
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+	"strings"
+)
+
+// DefaultSyslogTag is the tag Syslog sends messages with when no tag is
+// given.
+const DefaultSyslogTag = "envbuilder"
+
+// Syslog sends log messages to a syslog server, as the user facility with
+// the severity of their level. An empty network and addr send them to
+// the local syslog daemon, e.g. at /dev/log. Otherwise network is udp or
+// tcp and addr the host:port of a remote server. If a write fails, e.g.
+// because the server restarted, the connection is re-established and the
+// write retried once. Messages that cannot be sent are dropped, so that
+// logging never fails the build. The returned function closes the
+// connection.
+func Syslog(network, addr, tag string) (Func, func(), error) {
+	if tag == "" {
+		tag = DefaultSyslogTag
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_USER|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to syslog: %w", err)
+	}
+	logf := func(l Level, msg string, args ...any) {
+		s := fmt.Sprintf(msg, args...)
+		switch l {
+		case LevelTrace, LevelDebug:
+			_ = w.Debug(s)
+		case LevelWarn:
+			_ = w.Warning(s)
+		case LevelError:
+			_ = w.Err(s)
+		default:
+			_ = w.Info(s)
+		}
+	}
+	return logf, func() { _ = w.Close() }, nil
+}
+
+// ParseSyslogAddress parses the address of a syslog server for Syslog:
+// "local" for the local syslog daemon, or udp://host:port or
+// tcp://host:port for a remote one. The port defaults to 514.
+func ParseSyslogAddress(s string) (network, addr string, err error) {
+	if s == "local" {
+		return "", "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid syslog address %q: %w", s, err)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return "", "", fmt.Errorf("invalid syslog address %q: must be local, udp://host:port or tcp://host:port", s)
+	}
+	addr = u.Host
+	if u.Port() == "" {
+		addr += ":514"
+	}
+	return u.Scheme, addr, nil
+}
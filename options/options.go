@@ -1,16 +1,23 @@
 package options
 
 import (
+	"context"
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"net/url"
 	"os"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/coder/envbuilder/constants"
 	"github.com/coder/envbuilder/log"
 	"github.com/coder/serpent"
 	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"golang.org/x/crypto/ssh"
 )
 
 // Options contains the configuration for the envbuilder.
@@ -96,27 +103,244 @@ type Options struct {
 	SkipRebuild bool
 	// GitURL is the URL of the Git repository to clone. This is optional.
 	GitURL string
+	// GitExpandEnv expands ${VAR} and $VAR environment variable references
+	// in GitURL, GitMirrors, GitArchiveURL and GitHTTPProxyURL. See
+	// ExpandGitURLs.
+	GitExpandEnv bool
+	// GitCloneRetries is the number of times a clone that failed with a
+	// transient error is retried.
+	GitCloneRetries int64
+	// GitCloneRetryBackoff is the delay before the first clone retry. It
+	// doubles for each retry, up to 30 seconds.
+	GitCloneRetryBackoff time.Duration
+	// GitCloneRetryNoJitter disables the random jitter applied to the
+	// delay between clone retries.
+	GitCloneRetryNoJitter bool
+	// GitMirrors is a list of fallback URLs to clone from, in order, if
+	// cloning GitURL fails for a reason other than authentication.
+	GitMirrors []string
+	// GitAdditionalRemotes maps remote names to URLs that are added to a
+	// fresh clone and fetched after it, e.g. the upstream of a fork. Auth
+	// is resolved for each URL as for GitURL, but HTTP credentials are
+	// only sent to the host of GitURL.
+	GitAdditionalRemotes map[string]string
+	// GitCheckoutRemoteRef is a branch of any remote, e.g. upstream/main,
+	// to check out after the additional remotes are fetched instead of
+	// the ref in GitURL. This is optional.
+	GitCheckoutRemoteRef string
 	// GitCloneDepth is the depth to use when cloning the Git repository.
 	GitCloneDepth int64
+	// GitMaxBandwidthBytesPerSec limits the rate at which the clone
+	// downloads from the remote, over any protocol, so that it does not
+	// saturate a shared link. Zero means unlimited.
+	GitMaxBandwidthBytesPerSec int64
+	// GitMaxFileCount aborts the checkout once the repository has more
+	// files than this, to protect the host from pathological repositories.
+	// Zero means unlimited.
+	GitMaxFileCount int64
 	// GitCloneSingleBranch clone only a single branch of the Git repository.
 	GitCloneSingleBranch bool
+	// GitRequireExplicitRef fails single-branch clones without a ref in
+	// GitURL, instead of cloning refs/heads/main.
+	GitRequireExplicitRef bool
+	// GitFollowRedirectCredentials sends Git HTTP credentials to a different
+	// host if the remote redirects the clone there.
+	GitFollowRedirectCredentials bool
+	// GitMaxRedirects is the maximum number of HTTP redirects to follow when
+	// cloning. Zero uses the default of 10, and a negative value refuses all
+	// redirects.
+	GitMaxRedirects int64
+	// GitHTTPAnonymousFirst clones over HTTP without credentials first and
+	// only sends them once the remote asks for them with a 401, for servers
+	// that advertise refs anonymously but require auth to fetch packs.
+	GitHTTPAnonymousFirst bool
+	// GitCloner selects what clones the repository: "go-git", the default,
+	// or "cli" to run the git CLI, which falls back to go-git for options
+	// it does not support.
+	GitCloner string
+	// GitProtocolVersion forces the Git wire protocol version: auto, v0 or
+	// v2. v2 requires GitCloner "cli", go-git always uses v0.
+	GitProtocolVersion string
+	// GitMaxResolveWorkers bounds the threads git uses to resolve the
+	// fetched pack during the clone with GitCloner "cli". go-git always
+	// uses one.
+	GitMaxResolveWorkers int64
+	// GitCheckoutWorkers is the number of goroutines that write the
+	// worktree during the checkout. Defaults to 1, a serial checkout.
+	GitCheckoutWorkers int64
+	// GitTagFilter is a glob restricting the tags fetched during the clone,
+	// e.g. "v*". If unset, tags are fetched as usual.
+	GitTagFilter string
+	// GitGiteaHosts are the hostnames of self-hosted Gitea or Forgejo
+	// servers, for cloning their pull requests with a #pr/<id> fragment.
+	GitGiteaHosts []string
+	// GitHostTypeOverrides maps hostnames to the type of Git host they
+	// run, one of github, gitlab, bitbucket, gitea, azure-devops or
+	// unknown, for self-hosted servers whose type cannot be inferred from
+	// their name.
+	GitHostTypeOverrides map[string]string
+	// RequiredPaths are paths that must exist in the repository after it is
+	// cloned. Glob patterns are supported.
+	RequiredPaths []string
+	// GitClonePrecheck fetches only the tree of the ref before cloning, to
+	// check that the RequiredPaths, or a devcontainer.json if there are
+	// none, exist. If they do not and FallbackImage is set, the clone is
+	// skipped and the fallback image is used.
+	GitClonePrecheck bool
+	// GitExcludePaths are paths that are deleted from the worktree after it
+	// is cloned to keep the build context small. Glob patterns are
+	// supported.
+	GitExcludePaths []string
+	// GitAlternateObjectDirs are object directories of shared, read-only
+	// Git caches that the clone reuses objects from through Git alternates
+	// instead of downloading and storing them again.
+	GitAlternateObjectDirs []string
 	// GitUsername is the username to use for Git authentication. This is
 	// optional.
 	GitUsername string
 	// GitPassword is the password to use for Git authentication. This is
 	// optional.
 	GitPassword string
+	// GitUsernameFile is the path to a file containing the username to use
+	// for Git authentication. If set, it takes precedence over GitUsername.
+	GitUsernameFile string
+	// GitPasswordFile is the path to a file containing the password to use
+	// for Git authentication. If set, it takes precedence over GitPassword.
+	GitPasswordFile string
+	// GitPathCredentials maps URL path prefixes, e.g. /org/team-a/, to
+	// username:password credentials for HTTP requests to paths under them,
+	// for Git proxies that authenticate by path. The longest prefix wins,
+	// and GitUsername and GitPassword are used for other paths.
+	GitPathCredentials map[string]string
 	// GitSSHPrivateKeyPath is the path to an SSH private key to be used for
 	// Git authentication.
 	GitSSHPrivateKeyPath string
+	// GitSSHAgentKeyFingerprint selects a single key from the SSH agent by
+	// its fingerprint, e.g. "SHA256:...", as printed by ssh-add -l. Only
+	// used when falling back to agent authentication.
+	GitSSHAgentKeyFingerprint string
+	// GitSSHDisableAgentFallback fails Git authentication when no SSH key
+	// could be read, instead of falling back to the SSH agent.
+	GitSSHDisableAgentFallback bool
+	// GitDNSServers is a list of DNS servers, as host or host:port, used to
+	// resolve the Git host for HTTP and SSH clones instead of those in
+	// /etc/resolv.conf.
+	GitDNSServers []string
+	// GitHostAliases maps Git host names to the IP address to connect to
+	// for HTTP and SSH clones, like entries in /etc/hosts. Other hosts are
+	// resolved as usual. TLS certificates and SSH host keys are still
+	// checked against the host name.
+	GitHostAliases map[string]string
+	// GitResolveHostToIP is an IP address to connect to instead of
+	// resolving the host of the Git URL, e.g. during a migration or with
+	// split-horizon DNS. TLS certificates are still verified against the
+	// host name.
+	GitResolveHostToIP string
+	// GitTLSServerName is the server name sent in the TLS handshake and
+	// Host header, and verified against the certificate, when cloning over
+	// HTTPS or gits://. It defaults to the host of the Git URL.
+	GitTLSServerName string
+	// GitSSHDialTimeout is the maximum amount of time to wait for a TCP
+	// connection to the SSH host to be established when cloning. If zero,
+	// the system default is used.
+	GitSSHDialTimeout time.Duration
+	// GitSSHPort is the port to use for SSH Git URLs that do not specify
+	// one. Defaults to 22.
+	GitSSHPort int64
+	// GitSSHCiphers restricts the ciphers offered to the SSH host, in order
+	// of preference, e.g. for servers with a non-default crypto policy. If
+	// empty, the defaults of golang.org/x/crypto/ssh are used.
+	GitSSHCiphers []string
+	// GitSSHKeyExchanges restricts the key exchange algorithms offered to
+	// the SSH host, in order of preference. If empty, the defaults of
+	// golang.org/x/crypto/ssh are used.
+	GitSSHKeyExchanges []string
+	// GitSSHToHTTPSFallback retries a Git clone over the equivalent HTTPS
+	// URL, with GitUsername and GitPassword, when cloning over SSH fails to
+	// connect or authenticate. It only applies if GitPassword is set.
+	GitSSHToHTTPSFallback bool
+	// GitSSHKnownHostsPath is the path to a known_hosts file, or a list of
+	// them separated by the OS path list separator, used to verify SSH host
+	// keys. If not set, all host keys are accepted and logged. For backward
+	// compatibility this is also read from SSH_KNOWN_HOSTS.
+	GitSSHKnownHostsPath string
 	// GitHTTPProxyURL is the URL for the HTTP proxy. This is optional.
 	GitHTTPProxyURL string
+	// GitHTTPProxyUsername is the username to use for HTTP proxy
+	// authentication. This is optional.
+	GitHTTPProxyUsername string
+	// GitHTTPProxyPassword is the password to use for HTTP proxy
+	// authentication. This is optional.
+	GitHTTPProxyPassword string
+	// GitConfig is a set of section.key=value pairs that are written to the
+	// cloned repository's .git/config, e.g. core.autocrlf=input. Subsections
+	// are supported using section.subsection.key=value.
+	GitConfig map[string]string
+	// GitURLRewrites maps Git URL prefixes to replacement prefixes, similar
+	// to git's url.<base>.insteadOf. The longest matching prefix is applied
+	// to GitURL before cloning, and the rewrites are persisted in the cloned
+	// repository's config so that later fetches are also redirected.
+	GitURLRewrites map[string]string
+	// GitSubmoduleURLRewrites maps submodule URL prefixes to replacement
+	// prefixes. The longest matching prefix is applied to the URL of each
+	// submodule in .gitmodules after a fresh clone, and the result is
+	// recorded in the repository's config so that git submodule update
+	// fetches from it, e.g. from an internal mirror.
+	GitSubmoduleURLRewrites map[string]string
+	// GitPruneAfterClone controls what happens to the .git directory after
+	// a fresh clone. One of "none", "shallow" (repack and prune objects) or
+	// "remove" (delete the .git directory). Defaults to "none".
+	GitPruneAfterClone string
+	// GitWriteCommitGraph writes a commit-graph file after a fresh clone to
+	// speed up git log, git describe and similar operations.
+	GitWriteCommitGraph bool
+	// GitSafeDirectory adds the workspace folder to safe.directory in
+	// GitSafeDirectoryConfig after cloning, so that git run by a user other
+	// than the owner of the clone does not refuse it as having dubious
+	// ownership.
+	GitSafeDirectory bool
+	// GitSafeDirectoryWildcard adds "*" to safe.directory instead of the
+	// workspace folder, trusting every repository.
+	GitSafeDirectoryWildcard bool
+	// GitSafeDirectoryConfig is the global or system gitconfig that
+	// GitSafeDirectory writes to. Defaults to /etc/gitconfig.
+	GitSafeDirectoryConfig string
+	// GitRepackAfterClone repacks the objects of a fresh clone with the
+	// GitRepack settings, so that later fetches into a workspace that is
+	// rebuilt often are faster. It is skipped for shallow clones.
+	GitRepackAfterClone bool
+	// GitRepackWindow is the number of objects compared to find deltas
+	// when repacking. Defaults to 10.
+	GitRepackWindow int64
+	// GitRepackDepth is the maximum length of delta chains when
+	// repacking. Defaults to 50.
+	GitRepackDepth int64
+	// GitRepackWriteBitmaps writes a reachability bitmap index when
+	// repacking with the git CLI.
+	GitRepackWriteBitmaps bool
+	// GitWriteProvenance is a path that a JSON record of the clone is
+	// written to after cloning: the repository URL, ref, commit SHA,
+	// submodule commit SHAs and clone time. This is optional.
+	GitWriteProvenance string
+	// GitForceReclone removes an existing repository in the workspace folder
+	// and clones it again.
+	GitForceReclone bool
+	// GitMismatchPolicy controls what happens when the repository in the
+	// workspace folder has a different origin URL or branch than requested.
+	// One of "ignore", "error", "checkout" or "reclone". Defaults to "ignore".
+	GitMismatchPolicy string
 	// WorkspaceFolder is the path to the workspace folder that will be built.
 	// This is optional.
 	WorkspaceFolder string
 	// SSLCertBase64 is the content of an SSL cert file. This is useful for
 	// self-signed certificates.
 	SSLCertBase64 string
+	// GitTLSClientCertPath is the path to a PEM encoded client certificate
+	// presented to git daemons behind a TLS terminator (gits:// URLs).
+	GitTLSClientCertPath string
+	// GitTLSClientKeyPath is the path to the PEM encoded private key for
+	// GitTLSClientCertPath.
+	GitTLSClientKeyPath string
 	// ExportEnvFile is the optional file path to a .env file where envbuilder
 	// will dump environment variables from devcontainer.json and the built
 	// container image.
@@ -127,10 +351,93 @@ type Options struct {
 	// specified InitCommand should check for the presence of this script and
 	// execute it after successful startup.
 	PostStartScriptPath string
+	// GitAutoCRLF sets core.autocrlf for the checkout. One of true (convert
+	// LF to CRLF in text files), input or false (check files out as
+	// committed).
+	GitAutoCRLF string
+	// GitDisableSymlinks sets core.symlinks to false, so that symbolic links
+	// are checked out as plain files containing the link target.
+	GitDisableSymlinks bool
+	// GitApplyAttributes applies the text and eol attributes of the
+	// repository's .gitattributes files to the checkout.
+	GitApplyAttributes bool
+	// GitTempDir is a directory for temporary files written while cloning,
+	// such as downloaded pack files. Defaults to the .git directory.
+	GitTempDir string
+	// GitVerifyHead checks that the checked out commit is the one the remote
+	// advertised for the requested ref, and logs a warning if not.
+	GitVerifyHead bool
+	// GitVerifyHeadStrict is like GitVerifyHead, but fails the build on a
+	// mismatch.
+	GitVerifyHeadStrict bool
+	// GitVerifyObjects checks after cloning that the HEAD commit and every
+	// object in its tree are intact. With GitForceReclone, a corrupt clone
+	// is cloned once more.
+	GitVerifyObjects bool
+	// GitCachePath is the path to an existing clone of the repository,
+	// e.g. from a previous build. If the workspace folder has no
+	// repository, the cache is copied and only the requested ref fetched.
+	GitCachePath string
+	// GitArchiveURL is the URL of a gzipped tarball snapshot of the
+	// repository to extract instead of cloning on the first build, or
+	// "auto" to derive it for GitHub and GitLab. No .git directory is
+	// created. A normal clone is used if the download fails.
+	GitArchiveURL string
+	// GitTransport, if set, is used for all requests to the Git remote
+	// instead of the default go-git client. SSLCertBase64, Insecure and the
+	// Git HTTP proxy options do not apply to it, and must be configured on
+	// the transport itself. This is only settable programmatically.
+	GitTransport transport.Transport
+	// GitSecretFetcher, if set, fetches short-lived Git credentials, e.g.
+	// from Vault or AWS Secrets Manager, right before cloning. They take
+	// precedence over GitUsername, GitPassword and their files, and are
+	// fetched once per clone, or per call to git.SetupRepoAuth. This is only
+	// settable programmatically.
+	GitSecretFetcher func(ctx context.Context) (username, password string, err error)
+	// GitSSHHostKeyObserver, if set, is called with each SSH host key that
+	// is accepted because GitSSHKnownHostsPath is unset, so that it can be
+	// recorded and pinned in later builds. The host is as dialed, e.g.
+	// "github.com:22". This is only settable programmatically.
+	GitSSHHostKeyObserver func(host string, key ssh.PublicKey)
 	// Logger is the logger to use for all operations.
 	Logger log.Func
+	// LogTransform, if set, is applied to every log message before Logger,
+	// and so every sink, receives it, e.g. to redact or reformat messages.
+	// See log.Transformed. This is only settable programmatically.
+	LogTransform log.Transform
+	// ProgressReporter is notified of phase transitions while the repository
+	// is prepared. This is optional.
+	ProgressReporter log.ProgressReporter
 	// Verbose controls whether to send verbose logs.
 	Verbose bool
+	// LogPrefixStyle controls how log lines are labelled. "step" prefixes
+	// every line with the build step, e.g. "#1:", and "phase" labels each
+	// phase by name, e.g. "[auth]" or "[clone]". Defaults to step.
+	LogPrefixStyle string
+	// LogMaxMessageSize is the maximum size in bytes of a log message sent
+	// to Coder. Defaults to 64KiB.
+	LogMaxMessageSize int64
+	// LogOversizeMode is what to do with log messages longer than
+	// LogMaxMessageSize: "split" them into several messages, or "truncate"
+	// them. Defaults to split.
+	LogOversizeMode string
+	// LogWorkspaceOwner, LogTemplate and LogBuildNumber tag every log
+	// message sent to Coder, e.g. "[owner=alice template=docker build=3]",
+	// so that logs can be filtered by workspace build. Each is optional.
+	LogWorkspaceOwner string
+	LogTemplate       string
+	LogBuildNumber    int64
+	// LogCorrelationID tags every log message, on stderr and sent to Coder,
+	// e.g. "[correlation=abc123]", so that all activity for one build can
+	// be found across systems. This is optional.
+	LogCorrelationID string
+	// LogSyslog also sends log messages to a syslog server: "local" for
+	// the local syslog daemon, or udp://host:port or tcp://host:port for a
+	// remote one. This is optional.
+	LogSyslog string
+	// LogSyslogTag is the tag log messages are sent to syslog with.
+	// Defaults to envbuilder.
+	LogSyslogTag string
 	// Filesystem is the filesystem to use for all operations. Defaults to the
 	// host filesystem.
 	Filesystem billy.Filesystem
@@ -172,6 +479,14 @@ const envPrefix = "ENVBUILDER_"
 
 // Generate CLI options for the envbuilder command.
 func (o *Options) CLI() serpent.OptionSet {
+	knownHostsOpt := serpent.Option{
+		Flag:  "git-ssh-known-hosts-path",
+		Env:   WithEnvPrefix("GIT_SSH_KNOWN_HOSTS_PATH"),
+		Value: serpent.StringOf(&o.GitSSHKnownHostsPath),
+		Description: "Path to a known_hosts file used to verify SSH host " +
+			"keys. Multiple files may be separated by a colon. If not set, " +
+			"all host keys are accepted and logged.",
+	}
 	options := serpent.OptionSet{
 		{
 			Flag:  "setup-script",
@@ -333,18 +648,225 @@ func (o *Options) CLI() serpent.OptionSet {
 			Value:       serpent.StringOf(&o.GitURL),
 			Description: "The URL of a Git repository containing a Devcontainer or Docker image to clone. This is optional.",
 		},
+		{
+			Flag:  "git-expand-env",
+			Env:   WithEnvPrefix("GIT_EXPAND_ENV"),
+			Value: serpent.BoolOf(&o.GitExpandEnv),
+			Description: "Expand ${VAR} and $VAR environment variable references " +
+				"in the Git URL, mirrors, archive URL and HTTP proxy URL, failing " +
+				"if a referenced variable is not set. Off by default, so that " +
+				"URLs containing a literal $ are used as is.",
+		},
+		{
+			Flag:  "git-clone-retries",
+			Env:   WithEnvPrefix("GIT_CLONE_RETRIES"),
+			Value: serpent.Int64Of(&o.GitCloneRetries),
+			Description: "The number of times to retry cloning after a transient " +
+				"error such as a network error or an HTTP 5xx response.",
+		},
+		{
+			Flag:  "git-clone-retry-backoff",
+			Env:   WithEnvPrefix("GIT_CLONE_RETRY_BACKOFF"),
+			Value: serpent.DurationOf(&o.GitCloneRetryBackoff),
+			Description: "The delay before the first clone retry, defaults to " +
+				"1s. It doubles for each retry, up to 30s. Each delay is randomized " +
+				"between zero and the current backoff (full jitter) so that many " +
+				"workspaces do not retry at the same time.",
+		},
+		{
+			Flag:        "git-clone-retry-no-jitter",
+			Env:         WithEnvPrefix("GIT_CLONE_RETRY_NO_JITTER"),
+			Value:       serpent.BoolOf(&o.GitCloneRetryNoJitter),
+			Description: "Wait the full backoff between clone retries instead of a random fraction of it.",
+		},
+		{
+			Flag:  "git-mirrors",
+			Env:   WithEnvPrefix("GIT_MIRRORS"),
+			Value: serpent.StringArrayOf(&o.GitMirrors),
+			Description: "Comma separated list of fallback URLs to clone from, " +
+				"in order, if cloning the Git URL fails for a reason other than " +
+				"authentication.",
+		},
+		{
+			Flag:  "git-additional-remotes",
+			Env:   WithEnvPrefix("GIT_ADDITIONAL_REMOTES"),
+			Value: stringMapOf(&o.GitAdditionalRemotes),
+			Description: "Comma separated list of name=url pairs of remotes " +
+				"to add to a fresh clone and fetch after it, e.g. the upstream " +
+				"of a fork. HTTP credentials are only sent to the host of the " +
+				"Git URL.",
+		},
+		{
+			Flag:  "git-checkout-remote-ref",
+			Env:   WithEnvPrefix("GIT_CHECKOUT_REMOTE_REF"),
+			Value: serpent.StringOf(&o.GitCheckoutRemoteRef),
+			Description: "A branch of any remote, e.g. upstream/main, to check " +
+				"out after fetching the additional remotes instead of the ref " +
+				"in the Git URL.",
+		},
 		{
 			Flag:        "git-clone-depth",
 			Env:         WithEnvPrefix("GIT_CLONE_DEPTH"),
 			Value:       serpent.Int64Of(&o.GitCloneDepth),
 			Description: "The depth to use when cloning the Git repository.",
 		},
+		{
+			Flag:  "git-max-bandwidth-bytes-per-sec",
+			Env:   WithEnvPrefix("GIT_MAX_BANDWIDTH_BYTES_PER_SEC"),
+			Value: serpent.Int64Of(&o.GitMaxBandwidthBytesPerSec),
+			Description: "The maximum rate in bytes per second at which the " +
+				"clone downloads from the remote, over HTTP, SSH or the git " +
+				"protocol. Zero means unlimited.",
+		},
+		{
+			Flag:  "git-max-file-count",
+			Env:   WithEnvPrefix("GIT_MAX_FILE_COUNT"),
+			Value: serpent.Int64Of(&o.GitMaxFileCount),
+			Description: "Abort the checkout as soon as the repository has more " +
+				"files than this, to protect the host from repositories that " +
+				"would exhaust its inodes. Zero means unlimited.",
+		},
 		{
 			Flag:        "git-clone-single-branch",
 			Env:         WithEnvPrefix("GIT_CLONE_SINGLE_BRANCH"),
 			Value:       serpent.BoolOf(&o.GitCloneSingleBranch),
 			Description: "Clone only a single branch of the Git repository.",
 		},
+		{
+			Flag:  "git-require-explicit-ref",
+			Env:   WithEnvPrefix("GIT_REQUIRE_EXPLICIT_REF"),
+			Value: serpent.BoolOf(&o.GitRequireExplicitRef),
+			Description: "Fail single-branch clones if the Git URL has no #ref, " +
+				"instead of cloning refs/heads/main.",
+		},
+		{
+			Flag:  "git-follow-redirect-credentials",
+			Env:   WithEnvPrefix("GIT_FOLLOW_REDIRECT_CREDENTIALS"),
+			Value: serpent.BoolOf(&o.GitFollowRedirectCredentials),
+			Description: "Send Git HTTP credentials to a different host if the " +
+				"remote redirects the clone there. By default credentials are only " +
+				"sent to the host in the Git URL.",
+		},
+		{
+			Flag:  "git-max-redirects",
+			Env:   WithEnvPrefix("GIT_MAX_REDIRECTS"),
+			Value: serpent.Int64Of(&o.GitMaxRedirects),
+			Description: "The maximum number of HTTP redirects to follow when " +
+				"cloning. Defaults to 10. Set to -1 to refuse all redirects. " +
+				"Redirect loops always fail the clone.",
+		},
+		{
+			Flag:  "git-http-anonymous-first",
+			Env:   WithEnvPrefix("GIT_HTTP_ANONYMOUS_FIRST"),
+			Value: serpent.BoolOf(&o.GitHTTPAnonymousFirst),
+			Description: "Clone over HTTP without credentials first, and only " +
+				"send them once the remote responds with 401. Use this for " +
+				"servers that advertise refs anonymously but require " +
+				"authentication to download packs.",
+		},
+		{
+			Flag:  "git-cloner",
+			Env:   WithEnvPrefix("GIT_CLONER"),
+			Value: serpent.EnumOf(&o.GitCloner, "go-git", "cli"),
+			Description: "What to clone the repository with. One of go-git or " +
+				"cli, which runs the git CLI and falls back to go-git if git " +
+				"is not installed or for options the CLI does not support, " +
+				"such as SSH URLs. The CLI requires the default filesystem. " +
+				"Defaults to go-git.",
+		},
+		{
+			Flag:  "git-protocol-version",
+			Env:   WithEnvPrefix("GIT_PROTOCOL_VERSION"),
+			Value: serpent.EnumOf(&o.GitProtocolVersion, "auto", "v0", "v2"),
+			Description: "The Git wire protocol version to clone with. One of " +
+				"auto, v0 or v2. v2 is only used with --git-cloner=cli, " +
+				"and a warning is logged if the server does not support it. " +
+				"Defaults to auto.",
+		},
+		{
+			Flag:  "git-max-resolve-workers",
+			Env:   WithEnvPrefix("GIT_MAX_RESOLVE_WORKERS"),
+			Value: serpent.Int64Of(&o.GitMaxResolveWorkers),
+			Description: "The maximum number of threads the git CLI uses to " +
+				"resolve the fetched pack during the clone with " +
+				"--git-cloner=cli, to leave room for other work on shared " +
+				"hosts. go-git resolves packs on a single thread and ignores " +
+				"it. Defaults to the number of CPUs.",
+		},
+		{
+			Flag:  "git-checkout-workers",
+			Env:   WithEnvPrefix("GIT_CHECKOUT_WORKERS"),
+			Value: serpent.Int64Of(&o.GitCheckoutWorkers),
+			Description: "The number of goroutines that write files to the " +
+				"worktree during the checkout. Parallel checkouts are faster " +
+				"for large worktrees. Defaults to 1, a serial checkout.",
+		},
+		{
+			Flag:  "git-tag-filter",
+			Env:   WithEnvPrefix("GIT_TAG_FILTER"),
+			Value: serpent.StringOf(&o.GitTagFilter),
+			Description: "A glob restricting the tags fetched during the clone " +
+				"to those whose name matches, e.g. v*. Only matching tags are " +
+				"downloaded.",
+		},
+		{
+			Flag:  "git-gitea-hosts",
+			Env:   WithEnvPrefix("GIT_GITEA_HOSTS"),
+			Value: serpent.StringArrayOf(&o.GitGiteaHosts),
+			Description: "The hostnames of self-hosted Gitea or Forgejo " +
+				"servers, whose pull requests are cloned from " +
+				"refs/pull/N/head for a #pr/N Git URL fragment. Hosts " +
+				"with gitea or forgejo in their name are detected without " +
+				"being listed.",
+		},
+		{
+			Flag:  "git-host-type-overrides",
+			Env:   WithEnvPrefix("GIT_HOST_TYPE_OVERRIDES"),
+			Value: stringMapOf(&o.GitHostTypeOverrides),
+			Description: "Comma separated list of host=type pairs setting " +
+				"the type of self-hosted Git servers whose type cannot be " +
+				"inferred from their name, e.g. git.corp.tld=gitlab. Types " +
+				"are github, gitlab, bitbucket, gitea, azure-devops and " +
+				"unknown.",
+		},
+		{
+			Flag:  "required-paths",
+			Env:   WithEnvPrefix("REQUIRED_PATHS"),
+			Value: serpent.StringArrayOf(&o.RequiredPaths),
+			Description: "Comma separated list of paths, relative to the " +
+				"repository root, that must exist after cloning. Glob patterns " +
+				"such as .devcontainer/*.json are supported. Cloning fails if " +
+				"any path is missing.",
+		},
+		{
+			Flag:  "git-clone-precheck",
+			Env:   WithEnvPrefix("GIT_CLONE_PRECHECK"),
+			Value: serpent.BoolOf(&o.GitClonePrecheck),
+			Description: "Fetch only the tree of the ref before cloning to check " +
+				"that the required paths, or a devcontainer.json if none are " +
+				"set, exist. If they do not and a fallback image is set, the " +
+				"clone is skipped and the fallback image is used.",
+		},
+		{
+			Flag:  "git-exclude-paths",
+			Env:   WithEnvPrefix("GIT_EXCLUDE_PATHS"),
+			Value: serpent.StringArrayOf(&o.GitExcludePaths),
+			Description: "Comma separated list of paths, relative to the " +
+				"repository root, that are deleted from the worktree after " +
+				"cloning to keep the build context small, e.g. docs. Glob " +
+				"patterns are supported. Unlike sparse checkout, the full " +
+				"history is still fetched.",
+		},
+		{
+			Flag:  "git-alternate-object-dirs",
+			Env:   WithEnvPrefix("GIT_ALTERNATE_OBJECT_DIRS"),
+			Value: serpent.StringArrayOf(&o.GitAlternateObjectDirs),
+			Description: "Comma separated list of object directories of shared " +
+				"Git caches, e.g. /cache/repo.git/objects, that the clone reuses " +
+				"objects from through Git alternates. Commits already in a cache " +
+				"are not downloaded, and new objects are written to the " +
+				"workspace. The directories must exist and stay mounted.",
+		},
 		{
 			Flag:        "git-username",
 			Env:         WithEnvPrefix("GIT_USERNAME"),
@@ -357,18 +879,358 @@ func (o *Options) CLI() serpent.OptionSet {
 			Value:       serpent.StringOf(&o.GitPassword),
 			Description: "The password to use for Git authentication. This is optional.",
 		},
+		{
+			Flag:  "git-username-file",
+			Env:   WithEnvPrefix("GIT_USERNAME_FILE"),
+			Value: serpent.StringOf(&o.GitUsernameFile),
+			Description: "Path to a file containing the username to use for Git " +
+				"authentication. Takes precedence over the Git username if set.",
+		},
+		{
+			Flag:  "git-password-file",
+			Env:   WithEnvPrefix("GIT_PASSWORD_FILE"),
+			Value: serpent.StringOf(&o.GitPasswordFile),
+			Description: "Path to a file containing the password to use for Git " +
+				"authentication. Takes precedence over the Git password if set.",
+		},
+		{
+			Flag:  "git-path-credentials",
+			Env:   WithEnvPrefix("GIT_PATH_CREDENTIALS"),
+			Value: stringMapOf(&o.GitPathCredentials),
+			Description: "Comma separated list of prefix=username:password pairs " +
+				"giving the credentials for HTTP requests to URL paths under each " +
+				"prefix, e.g. /org/team-a/, for Git proxies that authenticate by " +
+				"path. The longest prefix wins, and the Git username and password " +
+				"are used for other paths.",
+		},
 		{
 			Flag:        "git-ssh-private-key-path",
 			Env:         WithEnvPrefix("GIT_SSH_PRIVATE_KEY_PATH"),
 			Value:       serpent.StringOf(&o.GitSSHPrivateKeyPath),
 			Description: "Path to an SSH private key to be used for Git authentication.",
 		},
+		{
+			Flag:  "git-ssh-agent-key-fingerprint",
+			Env:   WithEnvPrefix("GIT_SSH_AGENT_KEY_FINGERPRINT"),
+			Value: serpent.StringOf(&o.GitSSHAgentKeyFingerprint),
+			Description: "The fingerprint of the SSH agent key to use for Git " +
+				"authentication, as printed by ssh-add -l. Only this key is " +
+				"offered to the server, which avoids too many authentication " +
+				"failures when the agent holds many keys.",
+		},
+		{
+			Flag:  "git-ssh-disable-agent-fallback",
+			Env:   WithEnvPrefix("GIT_SSH_DISABLE_AGENT_FALLBACK"),
+			Value: serpent.BoolOf(&o.GitSSHDisableAgentFallback),
+			Description: "Fail instead of falling back to the SSH agent when " +
+				"no SSH private key could be read for Git authentication.",
+		},
+		{
+			Flag:  "git-dns-servers",
+			Env:   WithEnvPrefix("GIT_DNS_SERVERS"),
+			Value: serpent.StringArrayOf(&o.GitDNSServers),
+			Description: "Comma separated list of DNS servers, as host or " +
+				"host:port, used to resolve the Git host for HTTP and SSH clones " +
+				"instead of those in /etc/resolv.conf. SSH clones require SSH auth " +
+				"to be configured.",
+		},
+		{
+			Flag:  "git-host-aliases",
+			Env:   WithEnvPrefix("GIT_HOST_ALIASES"),
+			Value: stringMapOf(&o.GitHostAliases),
+			Description: "Comma separated list of host=ip pairs used to resolve " +
+				"Git hosts for HTTP and SSH clones before DNS, like entries in " +
+				"/etc/hosts. TLS certificates and SSH host keys are still checked " +
+				"against the host name. SSH clones require SSH auth to be configured.",
+		},
+		{
+			Flag:  "git-resolve-host-to-ip",
+			Env:   WithEnvPrefix("GIT_RESOLVE_HOST_TO_IP"),
+			Value: serpent.StringOf(&o.GitResolveHostToIP),
+			Description: "An IP address to connect to instead of resolving the " +
+				"host of the Git URL. TLS certificates are still verified against " +
+				"the host name. SSH clones require SSH auth to be configured.",
+		},
+		{
+			Flag:  "git-tls-server-name",
+			Env:   WithEnvPrefix("GIT_TLS_SERVER_NAME"),
+			Value: serpent.StringOf(&o.GitTLSServerName),
+			Description: "The server name to send in the TLS handshake and Host " +
+				"header, and to verify the certificate against, when cloning over " +
+				"HTTPS or gits://. Defaults to the host of the Git URL.",
+		},
+		{
+			Flag:  "git-ssh-dial-timeout",
+			Env:   WithEnvPrefix("GIT_SSH_DIAL_TIMEOUT"),
+			Value: serpent.DurationOf(&o.GitSSHDialTimeout),
+			Description: "The maximum amount of time to wait for a connection " +
+				"to the SSH host to be established when cloning. If not set, the " +
+				"system default is used.",
+		},
+		{
+			Flag:  "git-ssh-port",
+			Env:   WithEnvPrefix("GIT_SSH_PORT"),
+			Value: serpent.Int64Of(&o.GitSSHPort),
+			Description: "The port to use for SSH Git URLs that do not " +
+				"specify one. Defaults to 22.",
+		},
+		{
+			Flag:  "git-ssh-ciphers",
+			Env:   WithEnvPrefix("GIT_SSH_CIPHERS"),
+			Value: serpent.StringArrayOf(&o.GitSSHCiphers),
+			Description: "Comma separated list of ciphers to offer to the SSH " +
+				"host, in order of preference, e.g. aes256-ctr,aes128-cbc. " +
+				"Unsupported names are ignored with a warning. If not set, the " +
+				"defaults are used.",
+		},
+		{
+			Flag:  "git-ssh-key-exchanges",
+			Env:   WithEnvPrefix("GIT_SSH_KEY_EXCHANGES"),
+			Value: serpent.StringArrayOf(&o.GitSSHKeyExchanges),
+			Description: "Comma separated list of key exchange algorithms to " +
+				"offer to the SSH host, in order of preference, e.g. " +
+				"diffie-hellman-group14-sha1. Unsupported names are ignored with " +
+				"a warning. If not set, the defaults are used.",
+		},
+		{
+			Flag:  "git-ssh-to-https-fallback",
+			Env:   WithEnvPrefix("GIT_SSH_TO_HTTPS_FALLBACK"),
+			Value: serpent.BoolOf(&o.GitSSHToHTTPSFallback),
+			Description: "Retry cloning over the equivalent HTTPS URL, with " +
+				"the Git username and password, when cloning over SSH fails to " +
+				"connect or authenticate. Only applies if a Git password is set.",
+		},
+		knownHostsOpt,
+		{
+			// SSH_KNOWN_HOSTS was historically read directly from the
+			// environment by go-git.
+			Flag:        "ssh-known-hosts",
+			Env:         "SSH_KNOWN_HOSTS",
+			Value:       serpent.StringOf(&o.GitSSHKnownHostsPath),
+			Hidden:      true,
+			UseInstead:  []serpent.Option{knownHostsOpt},
+			Description: "Path to a known_hosts file used to verify SSH host keys.",
+		},
 		{
 			Flag:        "git-http-proxy-url",
 			Env:         WithEnvPrefix("GIT_HTTP_PROXY_URL"),
 			Value:       serpent.StringOf(&o.GitHTTPProxyURL),
 			Description: "The URL for the HTTP proxy. This is optional.",
 		},
+		{
+			Flag:        "git-http-proxy-username",
+			Env:         WithEnvPrefix("GIT_HTTP_PROXY_USERNAME"),
+			Value:       serpent.StringOf(&o.GitHTTPProxyUsername),
+			Description: "The username to use for HTTP proxy authentication. This is optional.",
+		},
+		{
+			Flag:        "git-http-proxy-password",
+			Env:         WithEnvPrefix("GIT_HTTP_PROXY_PASSWORD"),
+			Value:       serpent.StringOf(&o.GitHTTPProxyPassword),
+			Description: "The password to use for HTTP proxy authentication. This is optional.",
+		},
+		{
+			Flag:  "git-config",
+			Env:   WithEnvPrefix("GIT_CONFIG"),
+			Value: stringMapOf(&o.GitConfig),
+			Description: "Comma separated list of section.key=value pairs to " +
+				"write to the cloned repository's .git/config, e.g. " +
+				"core.autocrlf=input.",
+		},
+		{
+			Flag:  "git-url-rewrites",
+			Env:   WithEnvPrefix("GIT_URL_REWRITES"),
+			Value: stringMapOf(&o.GitURLRewrites),
+			Description: "Comma separated list of prefix=replacement pairs " +
+				"used to rewrite Git URLs before cloning, similar to git's " +
+				"url.<base>.insteadOf. The longest matching prefix wins.",
+		},
+		{
+			Flag:  "git-submodule-url-rewrites",
+			Env:   WithEnvPrefix("GIT_SUBMODULE_URL_REWRITES"),
+			Value: stringMapOf(&o.GitSubmoduleURLRewrites),
+			Description: "Comma separated list of prefix=replacement pairs " +
+				"used to rewrite the URLs of submodules after cloning. The " +
+				"longest matching prefix wins, and the rewritten URLs are " +
+				"recorded in the repository's config for git submodule update.",
+		},
+		{
+			Flag:  "git-prune-after-clone",
+			Env:   WithEnvPrefix("GIT_PRUNE_AFTER_CLONE"),
+			Value: serpent.EnumOf(&o.GitPruneAfterClone, "none", "shallow", "remove"),
+			Description: "What to do with the .git directory after a fresh " +
+				"clone to reduce its size. One of none, shallow (repack and prune " +
+				"objects) or remove (delete the .git directory). The .git directory " +
+				"is kept if the repository uses submodules or Git LFS. Defaults " +
+				"to none.",
+		},
+		{
+			Flag:  "git-write-commit-graph",
+			Env:   WithEnvPrefix("GIT_WRITE_COMMIT_GRAPH"),
+			Value: serpent.BoolOf(&o.GitWriteCommitGraph),
+			Description: "Write a commit-graph file after a fresh clone to " +
+				"speed up history operations such as git log and git describe. " +
+				"This is skipped for shallow clones.",
+		},
+		{
+			Flag:  "git-safe-directory",
+			Env:   WithEnvPrefix("GIT_SAFE_DIRECTORY"),
+			Value: serpent.BoolOf(&o.GitSafeDirectory),
+			Description: "Add the workspace folder to safe.directory in the " +
+				"gitconfig set by --git-safe-directory-config after cloning, so " +
+				"that git run by another user does not refuse the repository " +
+				"as having dubious ownership.",
+		},
+		{
+			Flag:  "git-safe-directory-wildcard",
+			Env:   WithEnvPrefix("GIT_SAFE_DIRECTORY_WILDCARD"),
+			Value: serpent.BoolOf(&o.GitSafeDirectoryWildcard),
+			Description: "Add * to safe.directory instead of the workspace " +
+				"folder, trusting every repository regardless of its owner.",
+		},
+		{
+			Flag:  "git-safe-directory-config",
+			Env:   WithEnvPrefix("GIT_SAFE_DIRECTORY_CONFIG"),
+			Value: serpent.StringOf(&o.GitSafeDirectoryConfig),
+			Description: "The global or system gitconfig that " +
+				"--git-safe-directory writes to. git ignores safe.directory in " +
+				"a repository's own config. Defaults to /etc/gitconfig.",
+		},
+		{
+			Flag:  "git-repack-after-clone",
+			Env:   WithEnvPrefix("GIT_REPACK_AFTER_CLONE"),
+			Value: serpent.BoolOf(&o.GitRepackAfterClone),
+			Description: "Repack the objects of a fresh clone into a single " +
+				"pack with tuned delta settings, so that later fetches into " +
+				"a workspace that is rebuilt often are faster. This is skipped " +
+				"for shallow clones.",
+		},
+		{
+			Flag:  "git-repack-window",
+			Env:   WithEnvPrefix("GIT_REPACK_WINDOW"),
+			Value: serpent.Int64Of(&o.GitRepackWindow),
+			Description: "The number of objects compared to find deltas when " +
+				"repacking after clone. Larger windows produce smaller packs " +
+				"but take longer. Defaults to 10.",
+		},
+		{
+			Flag:  "git-repack-depth",
+			Env:   WithEnvPrefix("GIT_REPACK_DEPTH"),
+			Value: serpent.Int64Of(&o.GitRepackDepth),
+			Description: "The maximum length of delta chains when repacking " +
+				"after clone. go-git caps chains at 50, so larger values only " +
+				"apply to the git CLI. Defaults to 50.",
+		},
+		{
+			Flag:  "git-repack-write-bitmaps",
+			Env:   WithEnvPrefix("GIT_REPACK_WRITE_BITMAPS"),
+			Value: serpent.BoolOf(&o.GitRepackWriteBitmaps),
+			Description: "Write a reachability bitmap index when repacking " +
+				"after clone. Only the git CLI writes bitmaps.",
+		},
+		{
+			Flag:  "git-write-provenance",
+			Env:   WithEnvPrefix("GIT_WRITE_PROVENANCE"),
+			Value: serpent.StringOf(&o.GitWriteProvenance),
+			Description: "A path to write a JSON record of the clone to: the " +
+				"repository URL, ref, commit SHA, submodule commit SHAs and " +
+				"clone time. This is optional.",
+		},
+		{
+			Flag:  "git-force-reclone",
+			Env:   WithEnvPrefix("GIT_FORCE_RECLONE"),
+			Value: serpent.BoolOf(&o.GitForceReclone),
+			Description: "Remove an existing repository in the workspace folder, " +
+				"along with everything else in it, and clone it again. Use this " +
+				"to recover from a corrupt checkout or a changed Git URL. Nothing " +
+				"is removed unless the folder contains a valid Git repository.",
+		},
+		{
+			Flag:  "git-autocrlf",
+			Env:   WithEnvPrefix("GIT_AUTOCRLF"),
+			Value: serpent.EnumOf(&o.GitAutoCRLF, "true", "input", "false"),
+			Description: "Sets core.autocrlf for the checkout. One of true (convert " +
+				"LF line endings to CRLF in text files), input or false (check " +
+				"files out as committed).",
+		},
+		{
+			Flag:  "git-disable-symlinks",
+			Env:   WithEnvPrefix("GIT_DISABLE_SYMLINKS"),
+			Value: serpent.BoolOf(&o.GitDisableSymlinks),
+			Description: "Sets core.symlinks to false, so that symbolic links in " +
+				"the repository are checked out as plain files containing the link " +
+				"target. Useful for repositories created on Windows.",
+		},
+		{
+			Flag:  "git-apply-attributes",
+			Env:   WithEnvPrefix("GIT_APPLY_ATTRIBUTES"),
+			Value: serpent.BoolOf(&o.GitApplyAttributes),
+			Description: "Apply the text and eol attributes of the repository's " +
+				".gitattributes files to the checkout, converting the line endings " +
+				"of matching text files. Binary files are never converted.",
+		},
+		{
+			Flag:  "git-temp-dir",
+			Env:   WithEnvPrefix("GIT_TEMP_DIR"),
+			Value: serpent.StringOf(&o.GitTempDir),
+			Description: "A directory for temporary files written while cloning, " +
+				"such as downloaded pack files, e.g. on a larger volume. It must " +
+				"exist and be writable. Defaults to the .git directory.",
+		},
+		{
+			Flag:  "git-verify-head",
+			Env:   WithEnvPrefix("GIT_VERIFY_HEAD"),
+			Value: serpent.BoolOf(&o.GitVerifyHead),
+			Description: "Record the commit the remote advertises for the " +
+				"requested ref before cloning, and warn if a different commit is " +
+				"checked out.",
+		},
+		{
+			Flag:  "git-verify-head-strict",
+			Env:   WithEnvPrefix("GIT_VERIFY_HEAD_STRICT"),
+			Value: serpent.BoolOf(&o.GitVerifyHeadStrict),
+			Description: "Like --git-verify-head, but fail the build if the " +
+				"checked out commit does not match the advertised one.",
+		},
+		{
+			Flag:  "git-verify-objects",
+			Env:   WithEnvPrefix("GIT_VERIFY_OBJECTS"),
+			Value: serpent.BoolOf(&o.GitVerifyObjects),
+			Description: "Check after cloning that the HEAD commit and every " +
+				"object in its tree exist and match their hashes, and fail if " +
+				"they are corrupt. With --git-force-reclone, a corrupt clone " +
+				"is cloned once more.",
+		},
+		{
+			Flag:  "git-cache-path",
+			Env:   WithEnvPrefix("GIT_CACHE_PATH"),
+			Value: serpent.StringOf(&o.GitCachePath),
+			Description: "The path to an existing clone of the repository, e.g. " +
+				"from a previous build. If the workspace folder has no repository, " +
+				"the clone is copied and only the requested ref is fetched instead " +
+				"of cloning from scratch. Falls back to a full clone if the fetch " +
+				"fails.",
+		},
+		{
+			Flag:  "git-archive-url",
+			Env:   WithEnvPrefix("GIT_ARCHIVE_URL"),
+			Value: serpent.StringOf(&o.GitArchiveURL),
+			Description: "The URL of a gzipped tarball snapshot of the repository " +
+				"to extract instead of cloning when the workspace folder is empty, " +
+				"or auto to derive it for GitHub and GitLab. This is faster when " +
+				"history is not needed, but no .git directory is created. Falls " +
+				"back to cloning if the download fails.",
+		},
+		{
+			Flag:  "git-mismatch-policy",
+			Env:   WithEnvPrefix("GIT_MISMATCH_POLICY"),
+			Value: serpent.EnumOf(&o.GitMismatchPolicy, "ignore", "error", "checkout", "reclone"),
+			Description: "What to do when the repository in the workspace folder " +
+				"has a different origin URL or branch than requested. One of " +
+				"ignore (log a warning), error, checkout (fetch and check out the " +
+				"requested ref) or reclone. A changed URL is recloned when set to " +
+				"checkout. Defaults to ignore.",
+		},
 		{
 			Flag:  "workspace-folder",
 			Env:   WithEnvPrefix("WORKSPACE_FOLDER"),
@@ -383,6 +1245,20 @@ func (o *Options) CLI() serpent.OptionSet {
 			Description: "The content of an SSL cert file. This is useful " +
 				"for self-signed certificates.",
 		},
+		{
+			Flag:  "git-tls-client-cert-path",
+			Env:   WithEnvPrefix("GIT_TLS_CLIENT_CERT_PATH"),
+			Value: serpent.StringOf(&o.GitTLSClientCertPath),
+			Description: "Path to a PEM encoded client certificate presented " +
+				"when cloning gits:// URLs, i.e. the git protocol tunneled over " +
+				"TLS. Requires --git-tls-client-key-path.",
+		},
+		{
+			Flag:        "git-tls-client-key-path",
+			Env:         WithEnvPrefix("GIT_TLS_CLIENT_KEY_PATH"),
+			Value:       serpent.StringOf(&o.GitTLSClientKeyPath),
+			Description: "Path to the PEM encoded private key for the Git TLS client certificate.",
+		},
 		{
 			Flag:  "export-env-file",
 			Env:   WithEnvPrefix("EXPORT_ENV_FILE"),
@@ -469,6 +1345,74 @@ func (o *Options) CLI() serpent.OptionSet {
 			Value:       serpent.BoolOf(&o.Verbose),
 			Description: "Enable verbose logging.",
 		},
+		{
+			Flag:  "log-prefix-style",
+			Env:   WithEnvPrefix("LOG_PREFIX_STYLE"),
+			Value: serpent.EnumOf(&o.LogPrefixStyle, log.PrefixStyleStep, log.PrefixStylePhase),
+			Description: "How log lines are labelled. One of step (prefix every " +
+				"line with the build step, e.g. #1:) or phase (label each phase " +
+				"by name, e.g. [auth] or [clone]). Defaults to step.",
+		},
+		{
+			Flag:  "log-max-message-size",
+			Env:   WithEnvPrefix("LOG_MAX_MESSAGE_SIZE"),
+			Value: serpent.Int64Of(&o.LogMaxMessageSize),
+			Description: "The maximum size in bytes of a log message sent to " +
+				"Coder. Defaults to 65536.",
+		},
+		{
+			Flag:  "log-oversize-mode",
+			Env:   WithEnvPrefix("LOG_OVERSIZE_MODE"),
+			Value: serpent.EnumOf(&o.LogOversizeMode, log.OversizeSplit, log.OversizeTruncate),
+			Description: "What to do with log messages longer than the maximum " +
+				"size. One of split (send several messages, marking the rest " +
+				"as continued) or truncate (cut the message short with an " +
+				"ellipsis). Defaults to split.",
+		},
+		{
+			Flag:  "log-workspace-owner",
+			Env:   WithEnvPrefix("LOG_WORKSPACE_OWNER"),
+			Value: serpent.StringOf(&o.LogWorkspaceOwner),
+			Description: "The workspace owner to tag log messages sent to Coder " +
+				"with, e.g. owner=alice.",
+		},
+		{
+			Flag:  "log-template",
+			Env:   WithEnvPrefix("LOG_TEMPLATE"),
+			Value: serpent.StringOf(&o.LogTemplate),
+			Description: "The workspace template to tag log messages sent to " +
+				"Coder with, e.g. template=docker.",
+		},
+		{
+			Flag:  "log-build-number",
+			Env:   WithEnvPrefix("LOG_BUILD_NUMBER"),
+			Value: serpent.Int64Of(&o.LogBuildNumber),
+			Description: "The workspace build number to tag log messages sent " +
+				"to Coder with, e.g. build=3.",
+		},
+		{
+			Flag:  "log-correlation-id",
+			Env:   WithEnvPrefix("LOG_CORRELATION_ID"),
+			Value: serpent.StringOf(&o.LogCorrelationID),
+			Description: "An ID, e.g. of the CI job or build, to tag every log " +
+				"message with, e.g. correlation=abc123, so that all activity " +
+				"for one build can be found across systems.",
+		},
+		{
+			Flag:  "log-syslog",
+			Env:   WithEnvPrefix("LOG_SYSLOG"),
+			Value: serpent.StringOf(&o.LogSyslog),
+			Description: "Also send log messages to a syslog server: local for " +
+				"the local syslog daemon, or udp://host:port or tcp://host:port " +
+				"for a remote one. The port defaults to 514.",
+		},
+		{
+			Flag:  "log-syslog-tag",
+			Env:   WithEnvPrefix("LOG_SYSLOG_TAG"),
+			Value: serpent.StringOf(&o.LogSyslogTag),
+			Description: "The tag to send log messages to syslog with. " +
+				"Defaults to envbuilder.",
+		},
 	}
 
 	// Add options without the prefix for backward compatibility. These options
@@ -551,6 +1495,71 @@ func (o *Options) CABundle() ([]byte, error) {
 	return data, nil
 }
 
+// ExpandGitURLs expands ${VAR} and $VAR references in GitURL, GitMirrors,
+// GitArchiveURL and GitHTTPProxyURL with lookup, usually os.LookupEnv. It
+// fails if a referenced variable is not set. It must be called before
+// SetDefaults, which derives the workspace folder from GitURL.
+func (o *Options) ExpandGitURLs(lookup func(string) (string, bool)) error {
+	var undefined []string
+	expand := func(s string) string {
+		return os.Expand(s, func(name string) string {
+			value, ok := lookup(name)
+			if !ok && !slices.Contains(undefined, name) {
+				undefined = append(undefined, name)
+			}
+			return value
+		})
+	}
+	o.GitURL = expand(o.GitURL)
+	o.GitArchiveURL = expand(o.GitArchiveURL)
+	o.GitHTTPProxyURL = expand(o.GitHTTPProxyURL)
+	for i, mirror := range o.GitMirrors {
+		o.GitMirrors[i] = expand(mirror)
+	}
+	if len(undefined) > 0 {
+		return fmt.Errorf("expand Git URLs: undefined environment variables: %s", strings.Join(undefined, ", "))
+	}
+	return nil
+}
+
+// stringMap is a serpent value for comma separated key=value pairs.
+type stringMap map[string]string
+
+func stringMapOf(m *map[string]string) *stringMap {
+	return (*stringMap)(m)
+}
+
+func (m *stringMap) Set(v string) error {
+	if *m == nil {
+		*m = make(stringMap)
+	}
+	for _, kv := range strings.Split(v, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("invalid key=value pair %q", kv)
+		}
+		(*m)[k] = v
+	}
+	return nil
+}
+
+func (m *stringMap) String() string {
+	pairs := make([]string, 0, len(*m))
+	for k, v := range *m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (*stringMap) Type() string {
+	return "string-map"
+}
+
 func skipDeprecatedOptions(options []serpent.Option) []serpent.Option {
 	var activeOptions []serpent.Option
 
@@ -582,3 +1591,94 @@ func UnsetEnv() {
 		_ = os.Unsetenv(strings.TrimPrefix(opt.Env, envPrefix))
 	}
 }
+
+// redactedValue replaces secrets in the output of Redacted.
+const redactedValue = "********"
+
+// Redacted returns a copy of the options with secrets masked, so that they
+// can be logged or included in a support bundle. Secret fields that are
+// set are replaced, and passwords are removed from URLs. Unset fields are
+// left empty to show that they were not configured.
+//
+// Secret fields added to Options must also be masked here.
+func (o *Options) Redacted() Options {
+	r := *o
+	for _, secret := range []*string{
+		&r.GitPassword,
+		&r.GitHTTPProxyPassword,
+		&r.CoderAgentToken,
+		&r.DockerConfigBase64,
+	} {
+		if *secret != "" {
+			*secret = redactedValue
+		}
+	}
+	for _, u := range []*string{
+		&r.GitURL,
+		&r.GitHTTPProxyURL,
+		&r.GitArchiveURL,
+		&r.CoderAgentURL,
+	} {
+		*u = redactURL(*u)
+	}
+	if r.GitMirrors != nil {
+		r.GitMirrors = make([]string, len(o.GitMirrors))
+		for i, mirror := range o.GitMirrors {
+			r.GitMirrors[i] = redactURL(mirror)
+		}
+	}
+	if r.GitAdditionalRemotes != nil {
+		r.GitAdditionalRemotes = make(map[string]string, len(o.GitAdditionalRemotes))
+		for name, remoteURL := range o.GitAdditionalRemotes {
+			r.GitAdditionalRemotes[name] = redactURL(remoteURL)
+		}
+	}
+	if r.GitURLRewrites != nil {
+		r.GitURLRewrites = make(map[string]string, len(o.GitURLRewrites))
+		for prefix, replacement := range o.GitURLRewrites {
+			r.GitURLRewrites[redactURL(prefix)] = redactURL(replacement)
+		}
+	}
+	if r.GitSubmoduleURLRewrites != nil {
+		r.GitSubmoduleURLRewrites = make(map[string]string, len(o.GitSubmoduleURLRewrites))
+		for prefix, replacement := range o.GitSubmoduleURLRewrites {
+			r.GitSubmoduleURLRewrites[redactURL(prefix)] = redactURL(replacement)
+		}
+	}
+	if r.GitPathCredentials != nil {
+		r.GitPathCredentials = make(map[string]string, len(o.GitPathCredentials))
+		for prefix, creds := range o.GitPathCredentials {
+			username, _, _ := strings.Cut(creds, ":")
+			r.GitPathCredentials[prefix] = username + ":" + redactedValue
+		}
+	}
+	if r.GitConfig != nil {
+		r.GitConfig = make(map[string]string, len(o.GitConfig))
+		for key, value := range o.GitConfig {
+			// http.extraHeader is commonly used to pass a token.
+			if strings.Contains(strings.ToLower(key), "extraheader") {
+				value = redactedValue
+			}
+			r.GitConfig[key] = value
+		}
+	}
+	return r
+}
+
+// redactURL masks the credentials in rawURL, if any. A bare HTTP username
+// is masked too, since tokens are often passed that way. Values that do
+// not parse as URLs, such as scp-like Git URLs, cannot carry a password
+// and are returned as is.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		return u.Redacted()
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		u.User = url.User(redactedValue)
+	}
+	return u.String()
+}
@@ -37,6 +37,9 @@ type Options struct {
 	Password string
 	AuthMW   func(http.Handler) http.Handler
 	TLS      bool
+	// Middleware wraps the server outside of AuthMW, the first outermost,
+	// e.g. to inject failures with mwtest.FailMW or mwtest.SlowMW.
+	Middleware []func(http.Handler) http.Handler
 }
 
 // CreateGitServer creates a git repository with an in-memory filesystem
@@ -52,10 +55,14 @@ func CreateGitServer(t *testing.T, opts Options) *httptest.Server {
 	}
 	fs := memfs.New()
 	_ = NewRepo(t, fs, commits...)
+	handler := opts.AuthMW(NewServer(fs))
+	for i := len(opts.Middleware) - 1; i >= 0; i-- {
+		handler = opts.Middleware[i](handler)
+	}
 	if opts.TLS {
-		return httptest.NewTLSServer(opts.AuthMW(NewServer(fs)))
+		return httptest.NewTLSServer(handler)
 	}
-	return httptest.NewServer(opts.AuthMW(NewServer(fs)))
+	return httptest.NewServer(handler)
 }
 
 // NewServer returns a http.Handler that serves a git repository.
@@ -230,7 +237,7 @@ func handleSession(sess ssh.Session) {
 type CommitFunc func(billy.Filesystem, *git.Repository)
 
 // Commit is a test helper for committing a single file to a repo.
-func Commit(t *testing.T, path, content, msg string) CommitFunc {
+func Commit(t testing.TB, path, content, msg string) CommitFunc {
 	return func(fs billy.Filesystem, repo *git.Repository) {
 		t.Helper()
 		tree, err := repo.Worktree()
@@ -252,7 +259,7 @@ func Commit(t *testing.T, path, content, msg string) CommitFunc {
 }
 
 // NewRepo returns a new Git repository.
-func NewRepo(t *testing.T, fs billy.Filesystem, commits ...CommitFunc) *git.Repository {
+func NewRepo(t testing.TB, fs billy.Filesystem, commits ...CommitFunc) *git.Repository {
 	t.Helper()
 	storage := filesystem.NewStorage(fs, cache.NewObjectLRU(cache.DefaultMaxSize))
 	repo, err := git.Init(storage, fs)
@@ -270,9 +277,9 @@ func NewRepo(t *testing.T, fs billy.Filesystem, commits ...CommitFunc) *git.Repo
 }
 
 // WriteFile writes a file to the filesystem.
-func WriteFile(t *testing.T, fs billy.Filesystem, path, content string) {
+func WriteFile(t testing.TB, fs billy.Filesystem, path, content string) {
 	t.Helper()
-	file, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
 	require.NoError(t, err)
 	_, err = file.Write([]byte(content))
 	require.NoError(t, err)
@@ -0,0 +1,134 @@
+package gittest_test
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coder/envbuilder/testutil/gittest"
+	"github.com/coder/envbuilder/testutil/mwtest"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// clone clones url into memory and returns the content of README.md.
+func clone(t *testing.T, url string, opts git.CloneOptions) (string, error) {
+	t.Helper()
+	opts.URL = url
+	fs := memfs.New()
+	if _, err := git.Clone(memory.NewStorage(), fs, &opts); err != nil {
+		return "", err
+	}
+	f, err := fs.Open("README.md")
+	require.NoError(t, err)
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	return string(content), err
+}
+
+func TestCreateGitServer(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{"README.md": "Hello, world!"}
+
+	t.Run("Clone", func(t *testing.T) {
+		t.Parallel()
+		srv := gittest.CreateGitServer(t, gittest.Options{Files: files})
+		defer srv.Close()
+		content, err := clone(t, srv.URL, git.CloneOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world!", content)
+	})
+
+	t.Run("Auth", func(t *testing.T) {
+		t.Parallel()
+		srv := gittest.CreateGitServer(t, gittest.Options{Files: files, Username: "user", Password: "pass"})
+		defer srv.Close()
+		_, err := clone(t, srv.URL, git.CloneOptions{})
+		require.ErrorIs(t, err, transport.ErrAuthenticationRequired)
+		content, err := clone(t, srv.URL, git.CloneOptions{Auth: &githttp.BasicAuth{Username: "user", Password: "pass"}})
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world!", content)
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		t.Parallel()
+		srv := gittest.CreateGitServer(t, gittest.Options{Files: files, TLS: true})
+		defer srv.Close()
+		content, err := clone(t, srv.URL, git.CloneOptions{InsecureSkipTLS: true})
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world!", content)
+	})
+
+	t.Run("Middleware", func(t *testing.T) {
+		t.Parallel()
+		var outer, inner atomic.Int32
+		srv := gittest.CreateGitServer(t, gittest.Options{
+			Files:    files,
+			Username: "user",
+			Password: "pass",
+			Middleware: []func(http.Handler) http.Handler{
+				mwtest.FailMW(0, 0, &outer),
+				mwtest.FailMW(1, http.StatusServiceUnavailable, &inner),
+			},
+		})
+		defer srv.Close()
+		_, err := clone(t, srv.URL, git.CloneOptions{})
+		require.ErrorContains(t, err, "503")
+		// Failures are injected before authentication.
+		_, err = clone(t, srv.URL, git.CloneOptions{})
+		require.ErrorIs(t, err, transport.ErrAuthenticationRequired)
+		require.EqualValues(t, 2, outer.Load())
+		require.EqualValues(t, 2, inner.Load())
+	})
+}
+
+func TestNewProxy(t *testing.T) {
+	t.Parallel()
+
+	srv := gittest.CreateGitServer(t, gittest.Options{Files: map[string]string{"README.md": "Hello, world!"}})
+	t.Cleanup(srv.Close)
+
+	t.Run("Forward", func(t *testing.T) {
+		t.Parallel()
+		proxy := gittest.NewProxy(t, "", "")
+		content, err := clone(t, srv.URL, git.CloneOptions{ProxyOptions: transport.ProxyOptions{URL: proxy.URL}})
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world!", content)
+		require.Positive(t, proxy.Requests.Load())
+	})
+
+	t.Run("Auth", func(t *testing.T) {
+		t.Parallel()
+		proxy := gittest.NewProxy(t, "proxyuser", "proxypass")
+		_, err := clone(t, srv.URL, git.CloneOptions{ProxyOptions: transport.ProxyOptions{URL: proxy.URL}})
+		require.ErrorContains(t, err, "407")
+		require.Zero(t, proxy.Requests.Load())
+		content, err := clone(t, srv.URL, git.CloneOptions{ProxyOptions: transport.ProxyOptions{
+			URL:      proxy.URL,
+			Username: "proxyuser",
+			Password: "proxypass",
+		}})
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world!", content)
+	})
+
+	t.Run("Connect", func(t *testing.T) {
+		t.Parallel()
+		tlsSrv := gittest.CreateGitServer(t, gittest.Options{Files: map[string]string{"README.md": "Hello, world!"}, TLS: true})
+		defer tlsSrv.Close()
+		proxy := gittest.NewProxy(t, "", "")
+		content, err := clone(t, tlsSrv.URL, git.CloneOptions{
+			InsecureSkipTLS: true,
+			ProxyOptions:    transport.ProxyOptions{URL: proxy.URL},
+		})
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world!", content)
+		require.Positive(t, proxy.Requests.Load())
+	})
+}
@@ -0,0 +1,90 @@
+package gittest
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Proxy is a forward HTTP proxy for tests. Plain HTTP requests are
+// forwarded, and CONNECT requests tunneled, to their destination.
+type Proxy struct {
+	*httptest.Server
+	// Requests counts the requests the proxy accepted, including CONNECT
+	// requests but not the requests tunneled through them.
+	Requests atomic.Int32
+}
+
+// NewProxy starts a Proxy that is closed when the test ends. If username
+// or password is set, requests must carry them in Proxy-Authorization.
+func NewProxy(t testing.TB, username, password string) *Proxy {
+	t.Helper()
+	p := &Proxy{}
+	forward := &httputil.ReverseProxy{
+		// The request is already in absolute form for its destination.
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.Header.Del("Proxy-Authorization")
+		},
+	}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username != "" || password != "" {
+			want := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+			if r.Header.Get("Proxy-Authorization") != want {
+				w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+		}
+		p.Requests.Add(1)
+		if r.Method == http.MethodConnect {
+			tunnel(w, r)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Scheme, "http") {
+			http.Error(w, "not a proxy request", http.StatusBadRequest)
+			return
+		}
+		forward.ServeHTTP(w, r)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// tunnel connects the client of the CONNECT request r to its destination.
+func tunnel(w http.ResponseWriter, r *http.Request) {
+	remote, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	local, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer local.Close()
+	if _, err := local.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(remote, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -8,6 +8,7 @@ func BasicAuthMW(username, password string) func(http.Handler) http.Handler {
 			if username != "" || password != "" {
 				authUser, authPass, ok := r.BasicAuth()
 				if !ok || username != authUser || password != authPass {
+					w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
 					w.WriteHeader(http.StatusUnauthorized)
 					return
 				}
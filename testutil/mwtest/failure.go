@@ -0,0 +1,97 @@
+package mwtest
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// FailMW fails the first failures requests with status and passes the
+// rest on. If requests is not nil, every request is counted in it.
+func FailMW(failures int32, status int, requests *atomic.Int32) func(http.Handler) http.Handler {
+	if requests == nil {
+		requests = new(atomic.Int32)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) <= failures {
+				w.WriteHeader(status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HangMW holds every request open without responding until release is
+// closed, after which requests are passed on, or the client gives up.
+// A nil release hangs forever, so the client must time out or cancel for
+// the server to be able to close.
+func HangMW(release <-chan struct{}) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-release:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// DelayMW waits for d before passing each request on, or until the
+// client gives up.
+func DelayMW(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			select {
+			case <-r.Context().Done():
+			case <-timer.C:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// SlowMW writes responses at no more than bytesPerSec bytes per second,
+// flushing as it goes, so that the client sees a slow transfer rather
+// than a stalled one.
+func SlowMW(bytesPerSec int) func(http.Handler) http.Handler {
+	// Writes are paced in tenths of a second.
+	chunk := max(bytesPerSec/10, 1)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&slowWriter{ResponseWriter: w, r: r, chunk: chunk}, r)
+		})
+	}
+}
+
+type slowWriter struct {
+	http.ResponseWriter
+	r     *http.Request
+	chunk int
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := min(len(p), w.chunk)
+		n, err := w.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		select {
+		case <-w.r.Context().Done():
+			return written, w.r.Context().Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return written, nil
+}
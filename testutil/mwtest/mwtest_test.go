@@ -0,0 +1,111 @@
+package mwtest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/envbuilder/testutil/mwtest"
+	"github.com/stretchr/testify/require"
+)
+
+var hello = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+	_, _ = io.WriteString(w, "hello")
+})
+
+func get(t *testing.T, ctx context.Context, url string) (int, string, error) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return res.StatusCode, string(body), err
+}
+
+func TestBasicAuthMW(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(mwtest.BasicAuthMW("user", "pass")(hello))
+	defer srv.Close()
+
+	status, _, err := get(t, context.Background(), srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, body, err := get(t, context.Background(), strings.Replace(srv.URL, "://", "://user:pass@", 1))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "hello", body)
+}
+
+func TestFailMW(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(mwtest.FailMW(2, http.StatusServiceUnavailable, &requests)(hello))
+	defer srv.Close()
+
+	for _, want := range []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK, http.StatusOK} {
+		status, _, err := get(t, context.Background(), srv.URL)
+		require.NoError(t, err)
+		require.Equal(t, want, status)
+	}
+	require.EqualValues(t, 4, requests.Load())
+}
+
+func TestHangMW(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(mwtest.HangMW(release)(hello))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err := get(t, ctx, srv.URL)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	status, body, err := get(t, context.Background(), srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "hello", body)
+}
+
+func TestDelayMW(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(mwtest.DelayMW(200 * time.Millisecond)(hello))
+	defer srv.Close()
+
+	start := time.Now()
+	_, body, err := get(t, context.Background(), srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, "hello", body)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestSlowMW(t *testing.T) {
+	t.Parallel()
+
+	content := strings.Repeat("x", 100)
+	srv := httptest.NewServer(mwtest.SlowMW(200)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, content)
+	})))
+	defer srv.Close()
+
+	// 20 bytes every tenth of a second.
+	start := time.Now()
+	_, body, err := get(t, context.Background(), srv.URL)
+	require.NoError(t, err)
+	require.Equal(t, content, body)
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}